@@ -1,101 +1,75 @@
 package gmtls
 
-import "strconv"
+import "github.com/nnnewb/gmtls/internal/handshaking"
 
-// An AlertError is a TLS alert.
-//
-// When using a QUIC transport, QUICConn methods will return an error
-// which wraps AlertError rather than sending a TLS alert.
-type AlertError uint8
-
-func (e AlertError) Error() string {
-	return alert(e).String()
-}
-
-type alert uint8
+// AlertLevel 是报警的级别。
+type AlertLevel = handshaking.AlertLevel
 
 const (
-	// alert level
-	alertLevelWarning = 1
-	alertLevelError   = 2
+	AlertLevelWarning = handshaking.AlertLevelWarning
+	AlertLevelFatal   = handshaking.AlertLevelFatal
 )
 
+// AlertDescription 是报警的描述，定义于 GM/T 0024-2014 第 6.4.2 节。
+//
+// AlertDescription 实现了 error，可以用 errors.Is 判断连接是否因为某个报警而中止。
+type AlertDescription = handshaking.AlertDescription
+
 const (
-	alertCloseNotify            alert = 0
-	alertUnexpectedMessage      alert = 10
-	alertBadRecordMAC           alert = 20
-	alertDecryptionFailed       alert = 21
-	alertRecordOverflow         alert = 22
-	alertDecompressionFailure   alert = 30
-	alertHandshakeFailure       alert = 40
-	alertBadCertificate         alert = 42
-	alertUnsupportedCertificate alert = 43
-	alertCertificateRevoked     alert = 44
-	alertCertificateExpired     alert = 45
-	alertCertificateUnknown     alert = 46
-	alertIllegalParameter       alert = 47
-	alertUnknownCA              alert = 48
-	alertAccessDenied           alert = 49
-	alertDecodeError            alert = 50
-	alertDecryptError           alert = 51
-	alertExportRestriction      alert = 60
-	alertProtocolVersion        alert = 70
-	alertInsufficientSecurity   alert = 71
-	alertInternalError          alert = 80
-	alertInappropriateFallback  alert = 86
-	alertUserCanceled           alert = 90
+	AlertCloseNotify            = handshaking.AlertDescriptionCloseNotify
+	AlertUnexpectedMessage      = handshaking.AlertDescriptionUnexpectedMessage
+	AlertBadRecordMAC           = handshaking.AlertDescriptionBadRecordMac
+	AlertDecryptionFailed       = handshaking.AlertDescriptionDecryptionFailed
+	AlertRecordOverflow         = handshaking.AlertDescriptionRecordOverflow
+	AlertDecompressionFailure   = handshaking.AlertDescriptionDecompressionFailure
+	AlertHandshakeFailure       = handshaking.AlertDescriptionHandshakeFailure
+	AlertBadCertificate         = handshaking.AlertDescriptionBadCertificate
+	AlertUnsupportedCertificate = handshaking.AlertDescriptionUnsupportedCertificate
+	AlertCertificateRevoked     = handshaking.AlertDescriptionCertificateRevoked
+	AlertCertificateExpired     = handshaking.AlertDescriptionCertificateExpired
+	AlertCertificateUnknown     = handshaking.AlertDescriptionCertificateUnknown
+	AlertIllegalParameter       = handshaking.AlertDescriptionIllegalParameter
+	AlertUnknownCA              = handshaking.AlertDescriptionUnknownCa
+	AlertAccessDenied           = handshaking.AlertDescriptionAccessDenied
+	AlertDecodeError            = handshaking.AlertDescriptionDecodeError
+	AlertDecryptError           = handshaking.AlertDescriptionDecryptError
+	AlertExportRestriction      = handshaking.AlertDescriptionExportRestriction
+	AlertProtocolVersion        = handshaking.AlertDescriptionProtocolVersion
+	AlertInsufficientSecurity   = handshaking.AlertDescriptionInsufficientSecurity
+	AlertInternalError          = handshaking.AlertDescriptionInternalError
+	AlertInappropriateFallback  = handshaking.AlertDescriptionInappropriateFallback
+	AlertUserCanceled           = handshaking.AlertDescriptionUserCanceled
+	AlertNoRenegotiation        = handshaking.AlertDescriptionNoRenegotiation
+	AlertUnsupportedExtension   = handshaking.AlertDescriptionUnsupportedExtension
+	AlertNoApplicationProtocol  = handshaking.AlertDescriptionNoApplicationProtocol
 
 	// 定义于 GM/T 0024-2014 第 6.4.2.2 节
-	alertUnsupportedSite2site alert = 200
-	alertNoArea               alert = 201
-	alertUnsupportedAreatype  alert = 202
-	alertBadIbcparam          alert = 203
-	alertUnsupportedIbcparam  alert = 204
-	alertIdentityNeed         alert = 205
+	AlertUnsupportedSite2site = handshaking.AlertDescriptionUnsupportedSite2site
+	AlertNoArea               = handshaking.AlertDescriptionNoArea
+	AlertUnsupportedAreatype  = handshaking.AlertDescriptionUnsupportedAreatype
+	AlertBadIbcparam          = handshaking.AlertDescriptionBadIbcparam
+	AlertUnsupportedIbcparam  = handshaking.AlertDescriptionUnsupportedIbcparam
+	AlertIdentityNeed         = handshaking.AlertDescriptionIdentityNeed
 )
 
-var alertText = map[alert]string{
-	alertCloseNotify:            "close notify",
-	alertUnexpectedMessage:      "unexpected message",
-	alertBadRecordMAC:           "bad record MAC",
-	alertDecryptionFailed:       "decryption failed",
-	alertRecordOverflow:         "record overflow",
-	alertDecompressionFailure:   "decompression failure",
-	alertHandshakeFailure:       "handshake failure",
-	alertBadCertificate:         "bad certificate",
-	alertUnsupportedCertificate: "unsupported certificate",
-	alertCertificateRevoked:     "revoked certificate",
-	alertCertificateExpired:     "expired certificate",
-	alertCertificateUnknown:     "unknown certificate",
-	alertIllegalParameter:       "illegal parameter",
-	alertUnknownCA:              "unknown certificate authority",
-	alertAccessDenied:           "access denied",
-	alertDecodeError:            "error decoding message",
-	alertDecryptError:           "error decrypting message",
-	alertExportRestriction:      "export restriction",
-	alertProtocolVersion:        "protocol version not supported",
-	alertInsufficientSecurity:   "insufficient security level",
-	alertInternalError:          "internal error",
-	alertInappropriateFallback:  "inappropriate fallback",
-	alertUserCanceled:           "user canceled",
+// AlertError 是导致连接中止的报警。
+//
+// 连接因为报警而中止时，Conn 的方法返回的 *net.OpError 包装了 AlertError：
+// Op 为 "remote error" 表示报警由对方发送，为 "local error" 表示报警由本端发送。
+// 可以使用 errors.As 获取报警的级别和描述，或者使用 errors.Is 与 AlertDescription 比较。
+type AlertError struct {
+	// Level 是报警记录中的级别。对方以警告级别发送了 GM/T 0024-2014 规定为致命的报警时，连接同样会中止。
+	Level AlertLevel
 
-	// 定义于 GM/T 0024-2014 第 6.4.2.2 节
-	alertUnsupportedSite2site: "不支持 site2site",
-	alertNoArea:               "没有保护域",
-	alertUnsupportedAreatype:  "不支持的保护域类型",
-	alertBadIbcparam:          "接收到一个无效的IBC公共参数",
-	alertUnsupportedIbcparam:  "不支持IBC公共参数中定义的信息",
-	alertIdentityNeed:         "缺少对方的IBC标识",
+	// Description 是报警的描述。
+	Description AlertDescription
 }
 
-func (e alert) String() string {
-	s, ok := alertText[e]
-	if ok {
-		return "tls: " + s
-	}
-	return "tls: alert(" + strconv.Itoa(int(e)) + ")"
+func (e AlertError) Error() string {
+	return e.Description.String()
 }
 
-func (e alert) Error() string {
-	return e.String()
+// Unwrap 返回报警的描述。
+func (e AlertError) Unwrap() error {
+	return e.Description
 }
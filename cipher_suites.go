@@ -1,85 +1,196 @@
 package gmtls
 
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"hash"
+	"slices"
+
+	"github.com/tjfoc/gmsm/sm3"
+	"github.com/tjfoc/gmsm/sm4"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
+
 // CipherSuite 密码套件。定义于 GM/T 0024-2014 第 6.4.4.1.1 节。
 // 每个密码套件包含一个秘钥交换算法、一个加密算法和一个校验算法。
-type CipherSuite uint16
+type CipherSuite = common.CipherSuite
 
 const (
-	CipherSuite_ECDHE_SM1_SM3 = 0xe001
-	CipherSuite_ECC_SM1_SM3   = 0xe003
-	CipherSuite_IBSDH_SM1_SM3 = 0xe005
-	CipherSuite_IBC_SM1_SM3   = 0xe007
-	CipherSuite_RSA_SM1_SM3   = 0xe009
-	CipherSuite_RSA_SM1_SHA1  = 0xe00a
-	CipherSuite_ECDHE_SM4_SM3 = 0xe011
-	CipherSuite_ECC_SM4_SM3   = 0xe013
-	CipherSuite_IBSDH_SM4_SM3 = 0xe015
-	CipherSuite_IBC_SM4_SM3   = 0xe017
-	CipherSuite_RSA_SM4_SM3   = 0xe019
-	CipherSuite_RSA_SM4_SHA1  = 0xe01a
+	CipherSuite_ECDHE_SM1_SM3 = common.CipherSuite_ECDHE_SM1_SM3
+	CipherSuite_ECC_SM1_SM3   = common.CipherSuite_ECC_SM1_SM3
+	CipherSuite_IBSDH_SM1_SM3 = common.CipherSuite_IBSDH_SM1_SM3
+	CipherSuite_IBC_SM1_SM3   = common.CipherSuite_IBC_SM1_SM3
+	CipherSuite_RSA_SM1_SM3   = common.CipherSuite_RSA_SM1_SM3
+	CipherSuite_RSA_SM1_SHA1  = common.CipherSuite_RSA_SM1_SHA1
+	CipherSuite_ECDHE_SM4_SM3 = common.CipherSuite_ECDHE_SM4_SM3
+	CipherSuite_ECC_SM4_SM3   = common.CipherSuite_ECC_SM4_SM3
+	CipherSuite_IBSDH_SM4_SM3 = common.CipherSuite_IBSDH_SM4_SM3
+	CipherSuite_IBC_SM4_SM3   = common.CipherSuite_IBC_SM4_SM3
+	CipherSuite_RSA_SM4_SM3   = common.CipherSuite_RSA_SM4_SM3
+	CipherSuite_RSA_SM4_SHA1  = common.CipherSuite_RSA_SM4_SHA1
 )
 
-func (c CipherSuite) String() string {
-	switch c {
-	case CipherSuite_ECDHE_SM1_SM3:
-		return "ECDHE_SM1_SM3"
-	case CipherSuite_ECC_SM1_SM3:
-		return "ECC_SM1_SM3"
-	case CipherSuite_IBSDH_SM1_SM3:
-		return "IBSDH_SM1_SM3"
-	case CipherSuite_IBC_SM1_SM3:
-		return "IBC_SM1_SM3"
-	case CipherSuite_RSA_SM1_SM3:
-		return "RSA_SM1_SM3"
-	case CipherSuite_RSA_SM1_SHA1:
-		return "RSA_SM1_SHA1"
-	case CipherSuite_ECDHE_SM4_SM3:
-		return "ECDHE_SM4_SM3"
-	case CipherSuite_ECC_SM4_SM3:
-		return "ECC_SM4_SM3"
-	case CipherSuite_IBSDH_SM4_SM3:
-		return "IBSDH_SM4_SM3"
-	case CipherSuite_IBC_SM4_SM3:
-		return "IBC_SM4_SM3"
-	case CipherSuite_RSA_SM4_SM3:
-		return "RSA_SM4_SM3"
-	case CipherSuite_RSA_SM4_SHA1:
-		return "RSA_SM4_SHA1"
-	default:
-		return "unknown"
-	}
-}
-
 // KeyExchangeAlgorithm 密钥交换算法。定义于 GM/T 0024-2014 第 6.4.4.3 节。
-type KeyExchangeAlgorithm uint8
+type KeyExchangeAlgorithm = common.KeyExchangeAlgorithm
 
 const (
-	KeyExchangeAlgorithmECDHE KeyExchangeAlgorithm = 1
-	KeyExchangeAlgorithmECC   KeyExchangeAlgorithm = 2
-	KeyExchangeAlgorithmIBSDH KeyExchangeAlgorithm = 3
-	KeyExchangeAlgorithmIBC   KeyExchangeAlgorithm = 4
-	KeyExchangeAlgorithmRSA   KeyExchangeAlgorithm = 5
+	KeyExchangeAlgorithmECDHE = common.KeyExchangeAlgorithmECDHE
+	KeyExchangeAlgorithmECC   = common.KeyExchangeAlgorithmECC
+	KeyExchangeAlgorithmIBSDH = common.KeyExchangeAlgorithmIBSDH
+	KeyExchangeAlgorithmIBC   = common.KeyExchangeAlgorithmIBC
+	KeyExchangeAlgorithmRSA   = common.KeyExchangeAlgorithmRSA
 )
 
-func (a KeyExchangeAlgorithm) String() string {
-	switch a {
-	case KeyExchangeAlgorithmECDHE:
-		return "ECDHE"
-	case KeyExchangeAlgorithmECC:
-		return "ECC"
-	case KeyExchangeAlgorithmIBSDH:
-		return "IBSDH"
-	case KeyExchangeAlgorithmIBC:
-		return "IBC"
-	case KeyExchangeAlgorithmRSA:
-		return "RSA"
-	default:
-		return "unknown"
+// CipherSuiteInfo 描述一个密码套件的算法组成。
+type CipherSuiteInfo struct {
+	ID   CipherSuite
+	Name string
+	// KeyExchange 是密钥交换算法
+	KeyExchange KeyExchangeAlgorithm
+	// Cipher 是记录层使用的对称加密算法和工作模式，例如 "SM4-CBC"
+	Cipher string
+	// MAC 是记录层使用的校验算法，例如 "HMAC-SM3"
+	MAC string
+	// PRFHash 是 PRF 使用的杂凑算法
+	PRFHash string
+	// AEAD 表示 Cipher 是否为 AEAD 算法。GM/T 0024-2014 定义的密码套件都使用 CBC 模式和独立的 MAC。
+	AEAD bool
+	// SupportedVersions 是可以使用该密码套件的协议版本
+	SupportedVersions []ProtocolVersion
+	// Insecure 表示密码套件存在已知的安全问题，不应使用。使用 SHA-1 校验的密码套件是不安全的。
+	Insecure bool
+}
+
+// CipherSuites 返回本包实现的安全的密码套件，按默认的优先级排列。
+// 需要调整优先级或者禁用部分密码套件时，从中选择一部分设置到 Config.CipherSuites。
+func CipherSuites() []*CipherSuiteInfo {
+	var suites []*CipherSuiteInfo
+	for _, suite := range cipherSuites {
+		if suite.ka != nil && !suite.insecure {
+			suites = append(suites, suite.info())
+		}
 	}
+	return suites
 }
 
-var (
-	defaultCipherSuites = []CipherSuite{CipherSuite_ECC_SM4_SM3}
-)
+// InsecureCipherSuites 返回本包实现的、存在已知安全问题的密码套件。
+// 这些密码套件不在默认的列表中，只有在 Config.CipherSuites 中明确列出时才会使用。
+//
+// 使用 SHA-1 的 RSA 密码套件没有实现，目前返回的列表为空。
+func InsecureCipherSuites() []*CipherSuiteInfo {
+	var suites []*CipherSuiteInfo
+	for _, suite := range cipherSuites {
+		if suite.ka != nil && suite.insecure {
+			suites = append(suites, suite.info())
+		}
+	}
+	return suites
+}
+
+// defaultCipherSuites 是 Config.CipherSuites 为空时使用的密码套件列表，按服务端的优先级排列。
+var defaultCipherSuites = []CipherSuite{CipherSuite_ECC_SM4_SM3, CipherSuite_ECDHE_SM4_SM3}
+
+// cipherSuite 描述了一个 GM/T 0024-2014 定义的密码套件。没有实现的密码套件只有算法信息，ka 为 nil。
+type cipherSuite struct {
+	id CipherSuite
+	// kex 是密钥交换算法
+	kex KeyExchangeAlgorithm
+	// cipherName、macName 和 prfHash 是算法名称，见 CipherSuiteInfo
+	cipherName, macName, prfHash string
+	// aead 表示 cipherName 是否为 AEAD 算法，见 CipherSuiteInfo.AEAD
+	aead bool
+	// insecure 表示密码套件不安全，见 CipherSuiteInfo.Insecure
+	insecure bool
+
+	// keyLen 是加密密钥的长度
+	keyLen int
+	// macLen 是 MAC 密钥的长度
+	macLen int
+	// ivLen 是 IV 的长度
+	ivLen int
+	// ka 返回密钥交换算法的实现
+	ka func() keyAgreement
+	// cipher 返回分组密码算法的实现
+	cipher func(key []byte) cipher.Block
+	// mac 返回校验算法的实现
+	mac func(key []byte) hash.Hash
+}
+
+func (s *cipherSuite) info() *CipherSuiteInfo {
+	return &CipherSuiteInfo{
+		ID:                s.id,
+		Name:              s.id.String(),
+		KeyExchange:       s.kex,
+		Cipher:            s.cipherName,
+		MAC:               s.macName,
+		PRFHash:           s.prfHash,
+		AEAD:              s.aead,
+		SupportedVersions: slices.Clone(supportedVersions),
+		Insecure:          s.insecure,
+	}
+}
+
+// cipherSuites 是 GM/T 0024-2014 定义的全部密码套件，已实现的排在前面，按默认的优先级排列。
+//
+// SM1 算法不公开，只能在密码设备中使用，IBC、IBSDH 和 RSA 密钥交换也没有实现，因此只实现了 ECC_SM4_SM3 和 ECDHE_SM4_SM3。
+var cipherSuites = []*cipherSuite{
+	{id: CipherSuite_ECC_SM4_SM3, kex: KeyExchangeAlgorithmECC, cipherName: "SM4-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false,
+		keyLen: 16, macLen: 32, ivLen: 16, ka: eccKA, cipher: cipherSM4, mac: macSM3},
+	{id: CipherSuite_ECDHE_SM4_SM3, kex: KeyExchangeAlgorithmECDHE, cipherName: "SM4-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false,
+		keyLen: 16, macLen: 32, ivLen: 16, ka: ecdheKA, cipher: cipherSM4, mac: macSM3},
+
+	{id: CipherSuite_IBSDH_SM4_SM3, kex: KeyExchangeAlgorithmIBSDH, cipherName: "SM4-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_IBC_SM4_SM3, kex: KeyExchangeAlgorithmIBC, cipherName: "SM4-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_RSA_SM4_SM3, kex: KeyExchangeAlgorithmRSA, cipherName: "SM4-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_RSA_SM4_SHA1, kex: KeyExchangeAlgorithmRSA, cipherName: "SM4-CBC", macName: "HMAC-SHA1", prfHash: "SHA1", aead: false, insecure: true},
+	{id: CipherSuite_ECDHE_SM1_SM3, kex: KeyExchangeAlgorithmECDHE, cipherName: "SM1-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_ECC_SM1_SM3, kex: KeyExchangeAlgorithmECC, cipherName: "SM1-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_IBSDH_SM1_SM3, kex: KeyExchangeAlgorithmIBSDH, cipherName: "SM1-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_IBC_SM1_SM3, kex: KeyExchangeAlgorithmIBC, cipherName: "SM1-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_RSA_SM1_SM3, kex: KeyExchangeAlgorithmRSA, cipherName: "SM1-CBC", macName: "HMAC-SM3", prfHash: "SM3", aead: false},
+	{id: CipherSuite_RSA_SM1_SHA1, kex: KeyExchangeAlgorithmRSA, cipherName: "SM1-CBC", macName: "HMAC-SHA1", prfHash: "SHA1", aead: false, insecure: true},
+}
+
+// lookupCipherSuite 返回 id 对应的密码套件，包括没有实现的密码套件。id 不是 GM/T 0024-2014 定义的密码套件时返回 nil。
+func lookupCipherSuite(id CipherSuite) *cipherSuite {
+	for _, suite := range cipherSuites {
+		if suite.id == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+// cipherSuiteByID 返回 id 对应的已实现的密码套件，没有实现时返回 nil。
+func cipherSuiteByID(id CipherSuite) *cipherSuite {
+	if suite := lookupCipherSuite(id); suite != nil && suite.ka != nil {
+		return suite
+	}
+	return nil
+}
+
+// scsvRenegotiation 是 TLS_EMPTY_RENEGOTIATION_INFO_SCSV，客户端用它表示支持安全重新协商，定义于 RFC 5746 第 3.3 节。
+const scsvRenegotiation CipherSuite = 0x00ff
+
+// mutualCipherSuite 在 have 中查找 want，返回对应的已实现的密码套件，找不到时返回 nil。
+func mutualCipherSuite(have []CipherSuite, want CipherSuite) *cipherSuite {
+	for _, id := range have {
+		if id == want {
+			return cipherSuiteByID(id)
+		}
+	}
+	return nil
+}
 
-var _ = defaultCipherSuites
+func cipherSM4(key []byte) cipher.Block {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		panic("gmtls: internal error: " + err.Error())
+	}
+	return block
+}
+
+func macSM3(key []byte) hash.Hash {
+	return hmac.New(sm3.New, key)
+}
@@ -0,0 +1,96 @@
+package gmtls
+
+import "testing"
+
+func TestCipherSuites(t *testing.T) {
+	seen := make(map[CipherSuite]bool)
+	for _, suite := range cipherSuites {
+		if seen[suite.id] {
+			t.Errorf("%s is registered twice", suite.id)
+		}
+		seen[suite.id] = true
+		if suite.id.String() == "unknown" {
+			t.Errorf("%#04x has no name", uint16(suite.id))
+		}
+		if suite.ka != nil && (suite.cipher == nil || suite.mac == nil || suite.keyLen == 0 || suite.macLen == 0 || suite.ivLen == 0) {
+			t.Errorf("%s is only partially implemented", suite.id)
+		}
+	}
+	for id := CipherSuite(0xe000); id <= 0xe0ff; id++ {
+		if id.String() != "unknown" && !seen[id] {
+			t.Errorf("%s is missing from the registry", id)
+		}
+	}
+
+	secure := CipherSuites()
+	if len(secure) != len(defaultCipherSuites) {
+		t.Fatalf("CipherSuites returned %d suites, want %d", len(secure), len(defaultCipherSuites))
+	}
+	for i, info := range secure {
+		if info.ID != defaultCipherSuites[i] {
+			t.Errorf("CipherSuites()[%d] = %s, want %s", i, info.ID, defaultCipherSuites[i])
+		}
+		if info.Insecure || info.AEAD || info.Cipher != "SM4-CBC" || info.MAC != "HMAC-SM3" || info.PRFHash != "SM3" {
+			t.Errorf("unexpected metadata for %s: %+v", info.Name, info)
+		}
+		if len(info.SupportedVersions) == 0 {
+			t.Errorf("%s supports no versions", info.Name)
+		}
+	}
+	if info := secure[1]; info.Name != "ECDHE_SM4_SM3" || info.KeyExchange != KeyExchangeAlgorithmECDHE {
+		t.Errorf("unexpected metadata for ECDHE_SM4_SM3: %+v", info)
+	}
+	secure[0].SupportedVersions[0] = 0
+	if CipherSuites()[0].SupportedVersions[0] == 0 {
+		t.Error("modifying SupportedVersions affected later calls")
+	}
+	for _, info := range InsecureCipherSuites() {
+		if !info.Insecure {
+			t.Errorf("%s is listed as insecure but not marked Insecure", info.Name)
+		}
+	}
+	for _, id := range []CipherSuite{CipherSuite_RSA_SM4_SHA1, CipherSuite_RSA_SM1_SHA1} {
+		if !lookupCipherSuite(id).insecure {
+			t.Errorf("%s is not marked insecure", id)
+		}
+	}
+}
+
+func TestCipherSuitePreference(t *testing.T) {
+	pki := getTestPKI(t)
+	tests := []struct {
+		name           string
+		client, server []CipherSuite
+		want           CipherSuite // 为零时握手应当失败
+	}{
+		{"ServerPrefersECDHE", []CipherSuite{CipherSuite_ECC_SM4_SM3, CipherSuite_ECDHE_SM4_SM3},
+			[]CipherSuite{CipherSuite_ECDHE_SM4_SM3, CipherSuite_ECC_SM4_SM3}, CipherSuite_ECDHE_SM4_SM3},
+		{"ServerPrefersECC", []CipherSuite{CipherSuite_ECDHE_SM4_SM3, CipherSuite_ECC_SM4_SM3},
+			[]CipherSuite{CipherSuite_ECC_SM4_SM3, CipherSuite_ECDHE_SM4_SM3}, CipherSuite_ECC_SM4_SM3},
+		{"ServerDisablesECC", []CipherSuite{CipherSuite_ECC_SM4_SM3, CipherSuite_ECDHE_SM4_SM3},
+			[]CipherSuite{CipherSuite_ECDHE_SM4_SM3}, CipherSuite_ECDHE_SM4_SM3},
+		{"NoMutualSuite", []CipherSuite{CipherSuite_ECC_SM4_SM3}, []CipherSuite{CipherSuite_ECDHE_SM4_SM3}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, clientConfig := testConfigs(t)
+			clientConfig.Certificates = []Certificate{pki.clientSign, pki.clientEnc}
+			clientConfig.CipherSuites = tt.client
+			serverConfig.CipherSuites = tt.server
+
+			serverState, _, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+			if tt.want == 0 {
+				if serverErr == nil || clientErr == nil {
+					t.Fatal("handshake without a mutual cipher suite succeeded")
+				}
+				return
+			}
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+			}
+			if got := CipherSuite(serverState.CipherSuite); got != tt.want {
+				t.Errorf("negotiated %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,27 +2,60 @@ package gmtls
 
 import (
 	"crypto"
-	"crypto/x509"
+	"crypto/rand"
+	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	"github.com/tjfoc/gmsm/sm2"
 	x510 "github.com/tjfoc/gmsm/x509"
 
 	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/handshaking"
 )
 
+// ProtocolVersion 是协议版本号。
+type ProtocolVersion = common.ProtocolVersion
+
+const (
+	// VersionGMSSL11 是 GM/T 0024-2014《SSL VPN 技术规范》定义的协议版本 1.1（0x0101）。
+	VersionGMSSL11 = common.VersionGMSSL11
+
+	// VersionTLCP11 是 GB/T 38636-2020《传输层密码协议（TLCP）》定义的协议版本 1.1，与 VersionGMSSL11 相同。
+	VersionTLCP11 = common.VersionTLCP11
+)
+
+// supportedVersions 是已实现的协议版本，按优先级从高到低排列。
+var supportedVersions = []ProtocolVersion{
+	VersionTLCP11,
+}
+
 // ConnectionState 记录了连接的基本 TLS 详细信息。
 type ConnectionState struct {
-	// Version 是连接使用的 TLS 版本（例如：VersionTLS12）。
-	Version common.ProtocolVersion
+	// Version 是连接使用的协议版本（例如：VersionTLCP11）。
+	Version ProtocolVersion
 
 	// HandshakeComplete 表示握手是否已经完成。
 	HandshakeComplete bool
 
-	// CipherSuite 是为连接协商的加密套件（例如：
-	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_AES_128_GCM_SHA256）。
+	// CipherSuite 是为连接协商的加密套件（例如：CipherSuite_ECC_SM4_SM3）。
 	CipherSuite uint16
 
+	// KeyExchangeAlgorithm 是加密套件使用的密钥交换算法（例如：KeyExchangeAlgorithmECC）。
+	KeyExchangeAlgorithm KeyExchangeAlgorithm
+
+	// DidResume 表示连接是否恢复了之前的会话。目前不支持会话恢复，总是为 false。
+	DidResume bool
+
+	// SessionID 是服务端在 ServerHello 中分配的会话标识。
+	// 本包的服务端不缓存会话，总是发送空的会话标识，因此与本包的服务端建立的连接 SessionID 为空。
+	SessionID []byte
+
+	// ServerName 是客户端通过 server_name 扩展请求的服务端名称。
+	// 在客户端是 Config.ServerName；在服务端，客户端没有发送该扩展时为空。
+	ServerName string
+
 	// PeerCertificates 是对等方发送的已解析证书列表，按发送顺序排列。
 	// 第一个元素是用于验证连接的叶证书。
 	//
@@ -30,7 +63,9 @@ type ConnectionState struct {
 	// RequireAnyClientCert 或 RequireAndVerifyClientCert，则此列表可以为空。
 	//
 	// 不应修改 PeerCertificates 及其内容。
-	PeerCertificates []*x509.Certificate
+	//
+	// GM/T 0024-2014 规定对等方发送的第一个证书是签名证书，第二个证书是加密证书。
+	PeerCertificates []*x510.Certificate
 
 	// VerifiedChains 是一个或多个链的列表，其中第一个元素是 PeerCertificates[0]，
 	// 最后一个元素来自 Config.RootCAs（在客户端）或 Config.ClientCAs（在服务器端）。
@@ -40,7 +75,68 @@ type ConnectionState struct {
 	// 或 RequireAndVerifyClientCert，则会设置此字段。
 	//
 	// 不应修改 VerifiedChains 及其内容。
-	VerifiedChains [][]*x509.Certificate
+	VerifiedChains [][]*x510.Certificate
+
+	// PeerSigningCertificate 和 PeerEncryptionCertificate 是对等方的签名证书和加密证书，
+	// 即 PeerCertificates 的前两个元素。对等方没有发送证书时为 nil。
+	PeerSigningCertificate    *x510.Certificate
+	PeerEncryptionCertificate *x510.Certificate
+
+	// NegotiatedProtocol 是通过 ALPN 协商的应用层协议，没有协商时为空。
+	NegotiatedProtocol string
+
+	// CompressionMethod 是协商的记录压缩算法。
+	CompressionMethod CompressionMethod
+
+	// TLSUnique 是 tls-unique 通道绑定值，即握手中第一个 Finished 消息的 verify_data，参见 RFC 5929 第 3 节。
+	// 握手完成之前为 nil。
+	TLSUnique []byte
+
+	// LocalSM2UserID 是本端 SM2 签名使用的用户标识。
+	LocalSM2UserID []byte
+
+	// PeerSM2UserID 是验证对等方 SM2 签名时使用的用户标识。
+	PeerSM2UserID []byte
+
+	// ekm 是 ExportKeyingMaterial 使用的密钥导出函数
+	ekm func(label string, context []byte, length int) ([]byte, error)
+}
+
+// ExportKeyingMaterial 返回长度为 length 的导出密钥，定义于 RFC 5705，使用 SM3 PRF 从主密钥和双方的随机数计算。
+// context 为 nil 时不参与计算。
+//
+// 握手完成之前，或者 label 是 GM/T 0024-2014 使用的标签时返回错误。
+func (cs *ConnectionState) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if cs.ekm == nil {
+		return noEKMBecauseHandshakeNotComplete(label, context, length)
+	}
+	return cs.ekm(label, context, length)
+}
+
+// DefaultSM2UserID 是 GM/T 0009-2012 规定的默认 SM2 用户标识 "1234567812345678"。
+const DefaultSM2UserID = common.DefaultSM2UserID
+
+// SM2SignerOpts 是 SM2 签名的参数。
+//
+// 握手过程中使用 SM2 私钥签名时，如果私钥不是 *sm2.PrivateKey，会把 *SM2SignerOpts 作为 opts 传给
+// crypto.Signer.Sign，实现应当使用其中的 UID 计算 Z 值。
+type SM2SignerOpts = common.SM2SignerOpts
+
+// SM2Agreement 是一次进行中的 SM2 密钥协商，定义于 GM/T 0003.3-2012 第 6 节。
+type SM2Agreement interface {
+	// TempPublicKey 返回本方临时公钥，需要发送给对方。
+	TempPublicKey() *sm2.PublicKey
+
+	// GenerateKey 根据对方的标识、加密公钥和临时公钥计算长度为 length 字节的共享密钥。
+	GenerateKey(peerID []byte, peerPub, peerTempPub *sm2.PublicKey, length int) ([]byte, error)
+}
+
+// SM2KeyAgreement 由支持 SM2 密钥协商的加密私钥实现。
+//
+// ECDHE 密钥交换需要使用加密证书的私钥进行 SM2 密钥协商。如果加密证书的私钥不是 *sm2.PrivateKey，
+// 则必须实现这个接口，例如 device.PrivateKey。sponsor 表示本方是否为协商发起方，id 是本方的 SM2 用户标识。
+type SM2KeyAgreement interface {
+	GenerateAgreementData(sponsor bool, id []byte) (SM2Agreement, error)
 }
 
 // ClientAuthType declares the policy the server will follow for
@@ -77,18 +173,47 @@ type Certificate struct {
 	Certificate [][]byte
 
 	// PrivateKey 包含与 Leaf 中公钥对应的私钥。
-	// 该私钥必须实现 crypto.Signer，并且其 PublicKey 必须是 RSA、ECDSA 或 Ed25519 类型。
-	// 对于 TLS 1.2 及以下版本的服务器，它也可以实现 crypto.Decrypter 并具有 RSA PublicKey。
+	// 签名证书的私钥必须实现 crypto.Signer，例如 *sm2.PrivateKey。
+	// 加密证书的私钥必须是 *sm2.PrivateKey 或实现 crypto.Decrypter；使用 ECDHE 密码套件时还必须实现 SM2KeyAgreement。
 	PrivateKey crypto.PrivateKey
 
 	// Leaf 是叶证书的解析形式，可以使用 x509.ParseCertificate 初始化以减少每次握手的处理开销。
 	// 如果为 nil，则会在需要时解析叶证书。
 	Leaf *x510.Certificate
+
+	// SM2UserID 是使用 PrivateKey 进行 SM2 签名时的用户标识。
+	// 对等方验证签名时必须使用相同的标识。如果为空，使用 DefaultSM2UserID。
+	SM2UserID []byte
+}
+
+// sm2UserID 返回证书签名使用的 SM2 用户标识。
+func (c *Certificate) sm2UserID() []byte {
+	return common.SM2UserID(c.SM2UserID)
 }
 
+// RenegotiationSupport 列举了客户端对重新协商的支持程度。
+//
+// 重新协商发生在第一次握手之后，双方重新执行一次完整的握手，服务端可以借此在会话中途要求客户端证书。
+// 重新协商使状态机变得复杂，并曾导致多个安全问题，因此默认禁用。
+//
+// 重新协商时不会重新验证服务端证书，而是要求服务端证书与第一次握手时相同。
+type RenegotiationSupport int
+
+const (
+	// RenegotiateNever 禁用重新协商。
+	RenegotiateNever RenegotiationSupport = iota
+
+	// RenegotiateOnceAsClient 允许服务端在每个连接上请求一次重新协商。
+	RenegotiateOnceAsClient
+
+	// RenegotiateFreelyAsClient 允许服务端重复请求重新协商。
+	RenegotiateFreelyAsClient
+)
+
 // Config 结构用于配置 TLS 客户端或服务器。
-// 传递给 TLS 函数后，不得修改该结构。
+// 传递给 TLS 函数后，不得修改该结构；需要修改时使用 Clone 得到的副本。
 // Config 可以重复使用；tls 包也不会修改它。
+// 连接在握手开始时用 Validate 检查配置，配置有误时握手返回 *ConfigError。
 type Config struct {
 	// Rand 提供用于生成 nonces 和 RSA 盲化的熵源。
 	// 如果 Rand 为 nil，TLS 使用 crypto/rand 包中的加密随机读取器。
@@ -99,14 +224,12 @@ type Config struct {
 	// 如果 Time 为 nil，TLS 使用 time.Now。
 	Time func() time.Time
 
-	// Certificates 包含一个或多个要呈现给连接另一端的证书链。
-	// 第一个与对等方要求兼容的证书会自动选择。
+	// Certificates 包含要呈现给连接另一端的证书链。
 	//
-	// 服务器配置必须设置 Certificates
-	// 进行客户端认证的客户端可以设置 Certificates 。
+	// GM/T 0024-2014 使用双证书体系：Certificates[0] 是签名证书，Certificates[1] 是加密证书。
 	//
-	// 注意：如果有多个 Certificates，并且它们没有设置可选字段 Leaf，
-	// 证书选择会在每次握手时产生显著的性能开销。
+	// 服务器配置必须设置 Certificates
+	// 进行客户端认证的客户端可以设置 Certificates ，使用 ECDHE 密码套件的客户端必须设置 Certificates。
 	Certificates []Certificate
 
 	// VerifyPeerCertificate 如果不为 nil，在正常的证书验证之后，无论是 TLS 客户端还是服务器都会调用此函数。
@@ -127,7 +250,7 @@ type Config struct {
 	// 在重新协商的连接上不会调用此回调，因为证书在重新协商时不会重新验证。
 	//
 	// 不应修改 verifiedChains 及其内容。
-	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x510.Certificate) error
 
 	// VerifyConnection 如果不为 nil， 在正常的证书验证和 VerifyPeerCertificate 之后，
 	// 无论是 TLS 客户端还是服务器都会调用此函数。
@@ -141,7 +264,15 @@ type Config struct {
 
 	// RootCAs 定义了客户端在验证服务器证书时使用的根证书权威机构集合。
 	// 如果 RootCAs 为 nil， TLS 将使用主机的根 CA 集合。
-	RootCAs *x509.CertPool
+	RootCAs *x510.CertPool
+
+	// NextProtos 是支持的应用层协议列表，按优先级排列，通过 ALPN 扩展（RFC 7301）协商。
+	// 如果双方都支持 ALPN 但没有共同的协议，服务端会以 no_application_protocol 报警中止握手。
+	// 如果对方不支持 ALPN，握手正常完成，ConnectionState.NegotiatedProtocol 为空。
+	NextProtos []string
+
+	// ServerName 用于验证服务端证书中的主机名。除非设置了 InsecureSkipVerify，否则客户端必须设置 ServerName 或在 Dial 时提供主机名。
+	ServerName string
 
 	// ClientAuth 确定了服务器对 TLS 客户端认证的策略。默认值为 NoClientCert（不要求客户端证书）。
 	ClientAuth ClientAuthType
@@ -155,8 +286,179 @@ type Config struct {
 	// 此选项仅应在测试时使用，或与 VerifyConnection 或 VerifyPeerCertificate 结合使用。
 	InsecureSkipVerify bool
 
-	// CipherSuites 是 GM/T 0024-2014 规定的 CipherSuite 列表。
-	// 此列表的顺序无关紧要。如果 CipherSuites 为空，则使用默认的 CipherSuite 列表。
-	// 当前仅支持 ECC_SM4_SM3 密码套件。
-	CipherSuites []common.CipherSuite
+	// CipherSuites 是启用的 GM/T 0024-2014 密码套件列表，按优先级排列。如果 CipherSuites 为空，则使用 CipherSuites() 返回的默认列表。
+	// 服务端选择列表中第一个客户端也支持的密码套件，例如把 ECDHE_SM4_SM3 放在前面可以优先使用具有前向安全性的密钥交换；
+	// 客户端按此顺序发送密码套件列表。
+	//
+	// 当前支持 ECC_SM4_SM3 和 ECDHE_SM4_SM3 密码套件，其他密码套件会被 Config.Validate 拒绝。
+	CipherSuites []CipherSuite
+
+	// CompressionMethods 是可以协商的记录压缩算法，按优先级排列，算法的实现需要通过 RegisterCompression 注册（CompressionDeflate 已经注册）。
+	// 客户端总是同时提供 CompressionNull，服务端选择自己列表中第一个客户端也提供的算法，没有共同的算法时不压缩。
+	//
+	// 默认为空，不压缩。压缩后的记录长度会泄露明文的信息，攻击者能够影响部分明文时可以据此猜测同一连接中的秘密数据
+	// （CRIME 攻击），只应在明文不含这类数据时启用。由 HandshakeConn 驱动的握手和 DTLCP 连接不使用压缩。
+	CompressionMethods []CompressionMethod
+
+	// MinVersion 是可接受的最低协议版本。如果为零，则使用已实现的最低版本。
+	MinVersion ProtocolVersion
+
+	// MaxVersion 是可接受的最高协议版本。如果为零，则使用已实现的最高版本。
+	MaxVersion ProtocolVersion
+
+	// PeerSM2UserID 是对等方 SM2 签名使用的用户标识，验证对等方的签名时使用。
+	// 部分 CA 签发的证书约定了非默认的用户标识，此时需要设置该字段。如果为空，使用 DefaultSM2UserID。
+	PeerSM2UserID []byte
+
+	// Renegotiation 控制客户端是否接受服务端发起的重新协商。默认值 RenegotiateNever 拒绝重新协商。
+	//
+	// 只有在第一次握手中协商了 RFC 5746 安全重新协商时才会进行重新协商。
+	// 允许重新协商时，客户端在第一次握手的 ClientHello 中加入 TLS_EMPTY_RENEGOTIATION_INFO_SCSV；
+	// RenegotiateNever 时不加入，以兼容不认识该值的实现。
+	Renegotiation RenegotiationSupport
+
+	// HandshakeTimeout 限制服务端连接完成握手的最长时间，从开始握手时计时。为零表示不限制。
+	// 它可以防止客户端缓慢发送握手消息长期占用服务端连接。客户端连接忽略该字段，使用 [Conn.HandshakeContext] 控制超时。
+	HandshakeTimeout time.Duration
+
+	// MTU 是 DTLCP 连接发送的数据报的最大长度，超过该长度的握手消息会被分片发送。为零时使用 1200 字节。
+	// TLCP 连接忽略该字段。
+	MTU int
+
+	// Site2Site 如果不为 nil，连接支持 GM/T 0024-2014 定义的 site2site 记录（类型 80），握手完成后每收到一个 site2site 记录调用一次。
+	// 它在 Read 读取记录时被调用，record 只在调用期间有效，回调中不能调用 conn 的 Read。返回错误时连接以 internal_error 报警中止。
+	//
+	// GM/T 0024-2014 没有定义协商 site2site 的方式，双方需要事先约定是否使用。
+	// 为 nil 时收到 site2site 记录会以 unsupported_site2site 报警中止连接，[Conn.WriteSite2Site] 也会返回错误。
+	Site2Site func(conn *Conn, record []byte) error
+
+	// MaxHandshakeSize 是接受的 Certificate 和 CertificateRequest 消息的最大长度，为零时使用 65536 字节。
+	// 证书链或者可接受的 CA 列表很长时需要调大该值。其他握手消息的长度不能超过 16384 字节。
+	MaxHandshakeSize int
+
+	// KeyLogWriter 可选地指定 NSS 密钥日志格式的输出目的地，可以被 Wireshark 等外部程序用来解密 TLCP 连接。
+	// 每次握手都会写入一行 "CLIENT_RANDOM <client_random> <master_secret>"。
+	// 参见 https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format。
+	// 使用 KeyLogWriter 会破坏安全性，只应用于调试。
+	KeyLogWriter io.Writer
+}
+
+// peerSM2UserID 返回验证对等方签名时使用的 SM2 用户标识。
+func (c *Config) peerSM2UserID() []byte {
+	return common.SM2UserID(c.PeerSM2UserID)
+}
+
+func (c *Config) rand() io.Reader {
+	r := c.Rand
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+func (c *Config) time() time.Time {
+	t := c.Time
+	if t == nil {
+		t = time.Now
+	}
+	return t()
+}
+
+func (c *Config) cipherSuites() []CipherSuite {
+	if len(c.CipherSuites) == 0 {
+		return defaultCipherSuites
+	}
+	return c.CipherSuites
+}
+
+// maxHandshakeSize 返回类型为 typ 的握手消息的最大长度。
+func (c *Config) maxHandshakeSize(typ handshaking.HandshakeType) int {
+	switch typ {
+	case handshaking.HandshakeTypeCertificate, handshaking.HandshakeTypeCertificateRequest:
+		if c.MaxHandshakeSize > 0 {
+			return c.MaxHandshakeSize
+		}
+		return maxHandshake
+	default:
+		return maxSmallHandshake
+	}
+}
+
+// compressionMethods 返回 CompressionMethods 中已经注册的压缩算法，不包括 CompressionNull。
+func (c *Config) compressionMethods() []CompressionMethod {
+	var methods []CompressionMethod
+	for _, method := range c.CompressionMethods {
+		if _, ok := compressionByID(method); ok {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// supportedVersions 返回 MinVersion 和 MaxVersion 范围内已实现的协议版本，按优先级从高到低排列。
+func (c *Config) supportedVersions() []ProtocolVersion {
+	versions := make([]ProtocolVersion, 0, len(supportedVersions))
+	for _, v := range supportedVersions {
+		if c.MinVersion != 0 && v < c.MinVersion {
+			continue
+		}
+		if c.MaxVersion != 0 && v > c.MaxVersion {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// maxSupportedVersion 返回可用的最高协议版本。
+func (c *Config) maxSupportedVersion() (ProtocolVersion, bool) {
+	versions := c.supportedVersions()
+	if len(versions) == 0 {
+		return 0, false
+	}
+	return versions[0], true
+}
+
+// isSupportedVersion 报告 v 是否在可用的协议版本中。
+func (c *Config) isSupportedVersion(v ProtocolVersion) bool {
+	for _, supported := range c.supportedVersions() {
+		if v == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// mutualVersion 返回服务端与客户端都支持的协议版本。peer 是 ClientHello 中的 client_version，
+// 表示客户端支持的最高版本。
+//
+// TLCP 的版本号与 TLS 不在同一个序列中：主版本号为 3 的是 TLS，即使数值更大也不表示客户端支持 TLCP，
+// 因此只在主版本号相同的版本中选择不高于 peer 的最高版本。
+func (c *Config) mutualVersion(peer ProtocolVersion) (ProtocolVersion, bool) {
+	for _, v := range c.supportedVersions() {
+		if v.Major() == peer.Major() && v <= peer {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+const keyLogLabelTLS12 = "CLIENT_RANDOM"
+
+// writerMutex 保护所有的 KeyLogWriter，避免多个连接同时写入时内容交错。
+var writerMutex sync.Mutex
+
+// writeKeyLog 以 NSS 密钥日志格式记录 secret。KeyLogWriter 为 nil 时不做任何事。
+func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
+	if c.KeyLogWriter == nil {
+		return nil
+	}
+
+	logLine := fmt.Appendf(nil, "%s %x %x\n", label, clientRandom, secret)
+
+	writerMutex.Lock()
+	_, err := c.KeyLogWriter.Write(logLine)
+	writerMutex.Unlock()
+
+	return err
 }
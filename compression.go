@@ -0,0 +1,159 @@
+package gmtls
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
+
+// CompressionMethod 是记录层的压缩算法，定义于 GM/T 0024-2014 第 6.3.1 节。
+type CompressionMethod = common.CompressionMethod
+
+const (
+	// CompressionNull 表示不压缩。
+	CompressionNull = common.CompressionMethodNull
+	// CompressionDeflate 是 RFC 3749 定义的 DEFLATE 压缩，使用 zlib 格式，每个记录结束时同步刷新。
+	CompressionDeflate = common.CompressionMethodDeflate
+)
+
+// Compressor 压缩一个方向上的记录，对应 GM/T 0024-2014 第 6.3.2.2 节的 TLSCompressed。
+// 同一个方向上的记录按顺序交给同一个 Compressor，压缩状态可以在记录之间保持。
+type Compressor interface {
+	// Compress 压缩一个记录的明文，把结果追加到 dst 之后返回。
+	Compress(dst, src []byte) ([]byte, error)
+}
+
+// Decompressor 解压一个方向上的记录，与对方的 Compressor 对应。
+type Decompressor interface {
+	// Decompress 解压一个记录，把结果追加到 dst 之后返回。解压后的长度超过 max 时必须返回错误。
+	Decompress(dst, src []byte, max int) ([]byte, error)
+}
+
+type compressionImpl struct {
+	newCompressor   func() Compressor
+	newDecompressor func() Decompressor
+}
+
+var (
+	compressionMutex sync.RWMutex
+	compressions     = map[CompressionMethod]compressionImpl{
+		CompressionDeflate: {newDeflateCompressor, newDeflateDecompressor},
+	}
+)
+
+// RegisterCompression 注册压缩算法 method 的实现，已经注册的实现会被替换。
+// 注册的算法只有在 Config.CompressionMethods 中列出时才会被协商。
+func RegisterCompression(method CompressionMethod, newCompressor func() Compressor, newDecompressor func() Decompressor) {
+	if method == CompressionNull {
+		panic("gmtls: RegisterCompression called with the null compression method")
+	}
+	if newCompressor == nil || newDecompressor == nil {
+		panic("gmtls: RegisterCompression called with a nil constructor")
+	}
+	compressionMutex.Lock()
+	defer compressionMutex.Unlock()
+	compressions[method] = compressionImpl{newCompressor, newDecompressor}
+}
+
+// compressionByID 返回注册的压缩算法，不压缩或者没有注册时返回 false。
+func compressionByID(method CompressionMethod) (compressionImpl, bool) {
+	compressionMutex.RLock()
+	defer compressionMutex.RUnlock()
+	impl, ok := compressions[method]
+	return impl, ok
+}
+
+// compressedExpansion 是 GM/T 0024-2014 允许的压缩后长度的最大增加量。
+const compressedExpansion = 1024
+
+var errDecompressionBomb = errors.New("tls: decompressed record exceeds the maximum length")
+
+type deflateCompressor struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newDeflateCompressor() Compressor {
+	c := new(deflateCompressor)
+	c.w = zlib.NewWriter(&c.buf)
+	return c
+}
+
+func (c *deflateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if _, err := c.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	dst = append(dst, c.buf.Bytes()...)
+	c.buf.Reset()
+	return dst, nil
+}
+
+// deflateDecompressor 在记录之间保持 zlib 流。
+//
+// RFC 3749 要求每个记录结束时刷新压缩器，因此每个记录都结束在 DEFLATE 块的边界上，记录之间的状态只有最近 32KB 的输出。
+// 每个记录使用最近的输出作为预设字典重置解压器，读到记录的末尾时解压器返回 io.ErrUnexpectedEOF，表示这个记录处理完毕。
+type deflateDecompressor struct {
+	r       io.ReadCloser
+	started bool   // 是否已经读取了 zlib 头部
+	history []byte // 最近 32KB 的输出
+	buf     []byte
+}
+
+const deflateWindowSize = 1 << 15
+
+func newDeflateDecompressor() Decompressor {
+	return new(deflateDecompressor)
+}
+
+func (d *deflateDecompressor) Decompress(dst, src []byte, max int) ([]byte, error) {
+	if !d.started {
+		// zlib 头部，定义于 RFC 1950 第 2.2 节：压缩方法必须是 DEFLATE，不能使用预设字典
+		if len(src) < 2 || src[0]&0x0f != 8 || src[0]>>4 > 7 || src[1]&0x20 != 0 || (uint16(src[0])<<8|uint16(src[1]))%31 != 0 {
+			return nil, errors.New("tls: invalid zlib header in compressed record")
+		}
+		src = src[2:]
+		d.started = true
+	}
+
+	if d.r == nil {
+		d.r = flate.NewReaderDict(bytes.NewReader(src), d.history)
+	} else if err := d.r.(flate.Resetter).Reset(bytes.NewReader(src), d.history); err != nil {
+		return nil, err
+	}
+	if len(d.buf) < max+1 {
+		d.buf = make([]byte, max+1)
+	}
+
+	start := len(dst)
+	for {
+		n, err := d.r.Read(d.buf[:max+1])
+		dst = append(dst, d.buf[:n]...)
+		if len(dst)-start > max {
+			return nil, errDecompressionBomb
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == io.EOF {
+			return nil, errors.New("tls: compressed stream ended")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tls: failed to decompress record: %w", err)
+		}
+	}
+
+	d.history = append(d.history, dst[start:]...)
+	if len(d.history) > deflateWindowSize {
+		d.history = append(d.history[:0], d.history[len(d.history)-deflateWindowSize:]...)
+	}
+	return dst, nil
+}
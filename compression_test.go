@@ -0,0 +1,146 @@
+package gmtls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// compressionPair 返回一对使用给定压缩算法配置完成了握手的客户端和服务端连接。
+func compressionPair(t *testing.T, clientMethods, serverMethods []CompressionMethod) (client, server *Conn) {
+	t.Helper()
+	serverConfig, clientConfig := testConfigs(t)
+	clientConfig.CompressionMethods = clientMethods
+	serverConfig.CompressionMethods = serverMethods
+	c, s := localPipe(t)
+	client = Client(c, clientConfig)
+	server = Server(s, serverConfig)
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	tests := []struct {
+		name                         string
+		clientMethods, serverMethods []CompressionMethod
+		want                         CompressionMethod
+	}{
+		{"Default", nil, nil, CompressionNull},
+		{"ClientOnly", []CompressionMethod{CompressionDeflate}, nil, CompressionNull},
+		{"ServerOnly", nil, []CompressionMethod{CompressionDeflate}, CompressionNull},
+		{"Both", []CompressionMethod{CompressionDeflate}, []CompressionMethod{CompressionDeflate}, CompressionDeflate},
+		{"Unregistered", []CompressionMethod{64}, []CompressionMethod{64}, CompressionNull},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := compressionPair(t, tt.clientMethods, tt.serverMethods)
+			if got := client.ConnectionState().CompressionMethod; got != tt.want {
+				t.Errorf("client negotiated %s, want %s", got, tt.want)
+			}
+			if got := server.ConnectionState().CompressionMethod; got != tt.want {
+				t.Errorf("server negotiated %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressionDeflate(t *testing.T) {
+	deflate := []CompressionMethod{CompressionDeflate}
+	client, server := compressionPair(t, deflate, deflate)
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64KB，分为多个记录
+	go func() {
+		client.Write(msg)
+		client.Write([]byte("end"))
+		client.Close()
+	}()
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), msg...), "end"...); !bytes.Equal(data, want) {
+		t.Fatalf("received %d bytes, want %d", len(data), len(want))
+	}
+}
+
+func TestDeflateDecompressor(t *testing.T) {
+	c := newDeflateCompressor()
+	d := newDeflateDecompressor()
+	for _, record := range [][]byte{[]byte("hello"), nil, []byte("hello, hello"), nil, nil, bytes.Repeat([]byte("x"), maxPlaintext)} {
+		compressed, err := c.Compress(nil, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.Decompress(nil, compressed, maxPlaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, record) {
+			t.Fatalf("Decompress = %q, want %q", got, record)
+		}
+	}
+
+	// 解压后超过上限的记录
+	compressed, err := c.Compress(nil, make([]byte, 10*maxPlaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) > maxPlaintext {
+		t.Fatalf("compressed bomb is %d bytes", len(compressed))
+	}
+	if _, err := d.Decompress(nil, compressed, maxPlaintext); err != errDecompressionBomb {
+		t.Errorf("Decompress of a bomb = %v, want errDecompressionBomb", err)
+	}
+
+	if _, err := newDeflateDecompressor().Decompress(nil, []byte("not zlib"), maxPlaintext); err == nil {
+		t.Error("Decompress accepted a record without a zlib header")
+	}
+}
+
+// identityCompressor 不改变数据，identityDecompressor 在收到 "bad" 时报告错误。
+type identityCompressor struct{}
+
+func (identityCompressor) Compress(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+
+type identityDecompressor struct{}
+
+func (identityDecompressor) Decompress(dst, src []byte, max int) ([]byte, error) {
+	if string(src) == "bad" {
+		return nil, errors.New("bad record")
+	}
+	return append(dst, src...), nil
+}
+
+func TestDecompressionFailure(t *testing.T) {
+	const testMethod CompressionMethod = 0xe0
+	RegisterCompression(testMethod,
+		func() Compressor { return identityCompressor{} },
+		func() Decompressor { return identityDecompressor{} })
+
+	methods := []CompressionMethod{testMethod}
+	client, server := compressionPair(t, methods, methods)
+	if _, err := client.Write([]byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 16)); err == nil {
+		t.Fatal("server Read succeeded")
+	}
+	_, err := client.Read(make([]byte, 16))
+	var alertErr AlertError
+	if !errors.As(err, &alertErr) || alertErr.Description != AlertDecompressionFailure {
+		t.Errorf("client Read = %v, want decompression_failure alert", err)
+	}
+}
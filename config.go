@@ -0,0 +1,161 @@
+package gmtls
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// ConfigError 表示 Config 中的配置错误，由 Config.Validate 返回。
+type ConfigError struct {
+	// Field 是出错的字段，例如 "CipherSuites[1]" 或 "Certificates"
+	Field string
+	// Msg 是错误描述
+	Msg string
+}
+
+func (e *ConfigError) Error() string {
+	return "tls: invalid Config." + e.Field + ": " + e.Msg
+}
+
+func configError(field, format string, args ...any) *ConfigError {
+	return &ConfigError{Field: field, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Clone 返回 c 的浅拷贝，c 为 nil 时返回 nil。
+// 正在被连接使用的 Config 可以安全地 Clone，修改副本不会影响已有的连接。
+func (c *Config) Clone() *Config {
+	if c == nil {
+		return nil
+	}
+	return &Config{
+		Rand:                  c.Rand,
+		Time:                  c.Time,
+		Certificates:          c.Certificates,
+		VerifyPeerCertificate: c.VerifyPeerCertificate,
+		VerifyConnection:      c.VerifyConnection,
+		RootCAs:               c.RootCAs,
+		NextProtos:            c.NextProtos,
+		ServerName:            c.ServerName,
+		ClientAuth:            c.ClientAuth,
+		ClientCAs:             c.ClientCAs,
+		InsecureSkipVerify:    c.InsecureSkipVerify,
+		CipherSuites:          c.CipherSuites,
+		CompressionMethods:    c.CompressionMethods,
+		MinVersion:            c.MinVersion,
+		MaxVersion:            c.MaxVersion,
+		PeerSM2UserID:         c.PeerSM2UserID,
+		Renegotiation:         c.Renegotiation,
+		HandshakeTimeout:      c.HandshakeTimeout,
+		MTU:                   c.MTU,
+		Site2Site:             c.Site2Site,
+		MaxHandshakeSize:      c.MaxHandshakeSize,
+		KeyLogWriter:          c.KeyLogWriter,
+	}
+}
+
+// Validate 检查与连接角色无关的配置，返回的错误是 *ConfigError，指出第一个有问题的字段。
+//
+// 连接在每次握手开始时调用 Validate，并检查角色相关的配置：
+// 服务端必须设置签名证书和加密证书，客户端必须设置 ServerName 或 InsecureSkipVerify。
+func (c *Config) Validate() error {
+	if err := c.validateCertificates(); err != nil {
+		return err
+	}
+	if err := c.validateCipherSuites(); err != nil {
+		return err
+	}
+
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return configError("MinVersion", "%s is greater than MaxVersion %s", c.MinVersion, c.MaxVersion)
+	}
+	if len(c.supportedVersions()) == 0 {
+		field := "MaxVersion"
+		if c.MinVersion != 0 {
+			field = "MinVersion"
+		}
+		return configError(field, "no supported versions between MinVersion %s and MaxVersion %s", c.MinVersion, c.MaxVersion)
+	}
+
+	for i, proto := range c.NextProtos {
+		if l := len(proto); l == 0 || l > 255 {
+			return configError(fmt.Sprintf("NextProtos[%d]", i), "protocol name must be 1 to 255 bytes long")
+		}
+	}
+	if c.ClientAuth < NoClientCert || c.ClientAuth > RequireAndVerifyClientCert {
+		return configError("ClientAuth", "unknown value %d", c.ClientAuth)
+	}
+	if c.Renegotiation < RenegotiateNever || c.Renegotiation > RenegotiateFreelyAsClient {
+		return configError("Renegotiation", "unknown value %d", c.Renegotiation)
+	}
+	if c.HandshakeTimeout < 0 {
+		return configError("HandshakeTimeout", "must not be negative")
+	}
+	if c.MTU != 0 && c.MTU < dtlcpMinMTU {
+		return configError("MTU", "%d is smaller than the minimum of %d bytes", c.MTU, dtlcpMinMTU)
+	}
+	if c.MaxHandshakeSize < 0 {
+		return configError("MaxHandshakeSize", "must not be negative")
+	}
+	return nil
+}
+
+// validateCertificates 检查 Certificates。设置了证书时必须同时有签名证书和加密证书，且公钥都是 SM2 公钥。
+func (c *Config) validateCertificates() error {
+	if len(c.Certificates) == 0 {
+		return nil
+	}
+	if len(c.Certificates) < 2 {
+		return configError("Certificates", "both a signing certificate and an encryption certificate are required")
+	}
+	for i, cert := range c.Certificates[:2] {
+		field := fmt.Sprintf("Certificates[%d]", i)
+		if len(cert.Certificate) == 0 {
+			return configError(field, "no certificate")
+		}
+		if cert.PrivateKey == nil {
+			return configError(field, "no private key")
+		}
+		// 私钥可能在密码设备中，只在私钥能提供公钥时检查类型
+		if key, ok := cert.PrivateKey.(interface{ Public() crypto.PublicKey }); ok {
+			if _, ok := sm2PublicKey(key.Public()); !ok {
+				return configError(field, "unsupported private key of type %T, an SM2 key is required", cert.PrivateKey)
+			}
+		}
+	}
+	return nil
+}
+
+// validateCipherSuites 检查 CipherSuites 中的每个密码套件都是已定义并且已实现的。
+func (c *Config) validateCipherSuites() error {
+	for i, id := range c.CipherSuites {
+		field := fmt.Sprintf("CipherSuites[%d]", i)
+		suite := lookupCipherSuite(id)
+		if suite == nil {
+			return configError(field, "unknown cipher suite %#04x", uint16(id))
+		}
+		if suite.kex == KeyExchangeAlgorithmRSA && len(c.Certificates) > 0 {
+			return configError(field, "RSA cipher suite %s cannot be used with SM2 certificates", id)
+		}
+		if suite.ka == nil {
+			return configError(field, "cipher suite %s is not implemented", id)
+		}
+	}
+	return nil
+}
+
+// validate 检查配置是否可以用于客户端（isClient 为 true）或服务端连接。
+func (c *Config) validate(isClient bool) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if isClient {
+		if c.ServerName == "" && !c.InsecureSkipVerify {
+			return configError("ServerName", "either ServerName or InsecureSkipVerify must be specified")
+		}
+		return nil
+	}
+	if len(c.Certificates) < 2 {
+		return configError("Certificates", "a server requires a signing certificate and an encryption certificate")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package gmtls
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
+
+func TestConfigClone(t *testing.T) {
+	var c Config
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(1)
+		case reflect.Uint8, reflect.Uint16:
+			f.SetUint(1)
+		case reflect.String:
+			f.SetString("x")
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Func:
+			f.Set(reflect.MakeFunc(f.Type(), func([]reflect.Value) []reflect.Value { return nil }))
+		case reflect.Pointer:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Interface:
+			f.Set(reflect.ValueOf(new(nopReadWriter)))
+		default:
+			t.Fatalf("unhandled field %s of kind %s", v.Type().Field(i).Name, f.Kind())
+		}
+	}
+
+	clone := reflect.ValueOf(c.Clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		want, got := v.Field(i), clone.Field(i)
+		// 函数只有在都为 nil 时才被 DeepEqual 认为相等
+		if want.Kind() == reflect.Func {
+			if got.Pointer() != want.Pointer() {
+				t.Errorf("Clone did not copy %s", name)
+			}
+		} else if !reflect.DeepEqual(got.Interface(), want.Interface()) {
+			t.Errorf("Clone did not copy %s", name)
+		}
+	}
+
+	if (*Config)(nil).Clone() != nil {
+		t.Error("Clone of a nil Config is not nil")
+	}
+}
+
+// nopReadWriter 同时实现了 io.Reader 和 io.Writer，用于填充接口类型的字段。
+type nopReadWriter struct{}
+
+func (*nopReadWriter) Read(b []byte) (int, error)  { return len(b), nil }
+func (*nopReadWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestConfigValidate(t *testing.T) {
+	pki := getTestPKI(t)
+	noKey := pki.serverEnc
+	noKey.PrivateKey = nil
+
+	tests := []struct {
+		name      string
+		modify    func(c *Config)
+		isClient  bool
+		wantField string
+	}{
+		{"ValidServer", func(c *Config) {}, false, ""},
+		{"ValidClient", func(c *Config) { c.Certificates = nil; c.ServerName = "server.example" }, true, ""},
+		{"UnknownCipherSuite", func(c *Config) {
+			c.CipherSuites = []common.CipherSuite{CipherSuite_ECC_SM4_SM3, 0x1234}
+		}, false, "CipherSuites[1]"},
+		{"UnimplementedCipherSuite", func(c *Config) {
+			c.CipherSuites = []common.CipherSuite{CipherSuite_ECC_SM1_SM3}
+		}, false, "CipherSuites[0]"},
+		{"RSACipherSuiteWithSM2Keys", func(c *Config) {
+			c.CipherSuites = []common.CipherSuite{CipherSuite_RSA_SM4_SM3}
+		}, false, "CipherSuites[0]"},
+		{"ServerWithoutCertificates", func(c *Config) { c.Certificates = nil }, false, "Certificates"},
+		{"ServerWithoutEncCertificate", func(c *Config) { c.Certificates = c.Certificates[:1] }, false, "Certificates"},
+		{"MissingPrivateKey", func(c *Config) { c.Certificates = []Certificate{pki.serverSign, noKey} }, false, "Certificates[1]"},
+		{"ClientWithoutServerName", func(c *Config) { c.Certificates = nil }, true, "ServerName"},
+		{"VersionRange", func(c *Config) { c.MinVersion, c.MaxVersion = VersionTLCP11+1, VersionTLCP11 }, false, "MinVersion"},
+		{"NoSupportedVersion", func(c *Config) { c.MaxVersion = VersionTLCP11 - 1 }, false, "MaxVersion"},
+		{"EmptyNextProto", func(c *Config) { c.NextProtos = []string{"h2", ""} }, false, "NextProtos[1]"},
+		{"ClientAuth", func(c *Config) { c.ClientAuth = RequireAndVerifyClientCert + 1 }, false, "ClientAuth"},
+		{"Renegotiation", func(c *Config) { c.Renegotiation = -1 }, false, "Renegotiation"},
+		{"HandshakeTimeout", func(c *Config) { c.HandshakeTimeout = -time.Second }, false, "HandshakeTimeout"},
+		{"MTU", func(c *Config) { c.MTU = 100 }, false, "MTU"},
+		{"MaxHandshakeSize", func(c *Config) { c.MaxHandshakeSize = -1 }, false, "MaxHandshakeSize"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _ := testConfigs(t)
+			tt.modify(config)
+			err := config.validate(tt.isClient)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("validate = %v, want nil", err)
+				}
+				return
+			}
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("validate = %v, want a *ConfigError", err)
+			}
+			if configErr.Field != tt.wantField {
+				t.Errorf("validate reported field %q (%v), want %q", configErr.Field, err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestHandshakeInvalidConfig(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	serverConfig.CipherSuites = []common.CipherSuite{0x1234}
+	clientConfig.ServerName = ""
+
+	_, _, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+	var configErr *ConfigError
+	if !errors.As(serverErr, &configErr) || configErr.Field != "CipherSuites[0]" {
+		t.Errorf("server: got %v, want a CipherSuites[0] ConfigError", serverErr)
+	}
+	if !errors.As(clientErr, &configErr) || configErr.Field != "ServerName" {
+		t.Errorf("client: got %v, want a ServerName ConfigError", clientErr)
+	}
+
+	// 服务端配置错误时，客户端应当收到 internal_error 报警
+	serverConfig, clientConfig = testConfigs(t)
+	serverConfig.CipherSuites = []common.CipherSuite{0x1234}
+	_, _, _, clientErr = runHandshake(t, serverConfig, clientConfig)
+	var alertErr AlertError
+	if !errors.As(clientErr, &alertErr) || alertErr.Description != AlertInternalError {
+		t.Errorf("client: got %v, want an internal_error alert", clientErr)
+	}
+}
@@ -1,8 +1,16 @@
 package gmtls
 
 import (
-	"crypto/x509"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,23 +18,45 @@ import (
 	gmx509 "github.com/tjfoc/gmsm/x509"
 
 	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
 )
 
+const (
+	recordHeaderLen      = 5            // 记录层头部长度：类型、版本、长度
+	maxPlaintext         = 16384        // TLSPlaintext.length 的最大值，定义于 GM/T 0024-2014 第 6.3.2.1 节
+	maxCiphertext        = 16384 + 2048 // TLSCiphertext.length 的最大值，定义于 GM/T 0024-2014 第 6.3.2.3 节
+	maxHandshake         = 65536        // Config.MaxHandshakeSize 为零时 Certificate 和 CertificateRequest 消息的最大长度
+	maxSmallHandshake    = maxPlaintext // 其他握手消息的最大长度
+	maxUselessRecord     = 16           // 连续收到的不含应用数据的记录的最大数量
+	minHandshakeFragment = 1024         // 不能凑齐握手消息的记录短于该长度时视为无用的记录
+)
+
+// Conn 表示一个安全连接。它实现了 net.Conn 接口。
 type Conn struct {
 	conn     net.Conn
 	isClient bool
 
+	// handshakeFn 是 clientHandshake 或 serverHandshake
+	handshakeFn func() error
+
 	// isHandshakeComplete 表示连接当前是否正在传输应用数据（即不处于握手状态）。
 	// isHandshakeComplete 为 true 意味着 handshakeErr == nil。
 	isHandshakeComplete atomic.Bool
 
 	// 在握手后保持不变；由 handshakeMutex 保护
+	//
+	// 加锁顺序是 handshakeMutex、c.in、c.out。唯一的例外是 Read 在持有 c.in 时处理重新协商，
+	// 会再获取 handshakeMutex。这不会死锁：持有 handshakeMutex 的 goroutine 只在握手未完成时才获取 c.in，
+	// 而握手完成后只有持有 c.in 的重新协商才会把它重新标记为未完成。
 	handshakeMutex sync.Mutex
 	handshakeErr   error                  // handshakeErr 是握手过程中产生的错误
-	version        common.ProtocolVersion // version 是 TLS 版本
-	haveVersion    bool                   // haveVersion 表示版本是否已协商
+	version        common.ProtocolVersion // version 是协商出的协议版本，为零表示还没有协商
 	config         *Config                // config 是传递给构造函数的配置
 
+	// handshakes 是在连接上完成的握手次数
+	handshakes int
+
 	// cipherSuite 是为连接协商的加密套件
 	cipherSuite CipherSuite
 
@@ -34,17 +64,1065 @@ type Conn struct {
 	peerCertificates []*gmx509.Certificate
 
 	// verifiedChains 包含我们构建的证书链，而不是服务器提供的证书链。
-	verifiedChains [][]*x509.Certificate
+	verifiedChains [][]*gmx509.Certificate
+
+	// localSM2UserID 和 peerSM2UserID 是握手过程中本端签名和验证对等方签名使用的 SM2 用户标识
+	localSM2UserID []byte
+	peerSM2UserID  []byte
+
+	// params 是握手协商出的安全参数，在计算出主密钥后设置
+	params fragment.SecurityParameters
+
+	// clientProtocol 是通过 ALPN 协商的应用层协议
+	clientProtocol string
+
+	// serverName 是客户端通过 server_name 扩展指示的服务端名称
+	serverName string
+
+	// sessionID 是服务端在 ServerHello 中分配的会话标识
+	sessionID []byte
+
+	// compression 是最近一次握手协商的压缩算法，在 ChangeCipherSpec 之后生效
+	compression CompressionMethod
+
+	// clientFinished 和 serverFinished 是最近一次握手中双方 Finished 消息的 verify_data
+	clientFinished [12]byte
+	serverFinished [12]byte
+
+	// secureRenegotiation 表示双方在第一次握手中协商了 RFC 5746 安全重新协商
+	secureRenegotiation bool
 
 	// clientFinishedIsFirst 表示在最近的握手过程中，客户端是否首先发送了 Finished 消息。
 	// 这是因为第一个传输的 Finished 消息是 tls-unique 通道绑定值。
 	clientFinishedIsFirst bool
 
-	// closeNotifyErr 是发送 alertCloseNotify 记录时的任何错误。
+	// closeNotifyErr 是发送 close_notify 记录时的任何错误。
 	closeNotifyErr error
 
-	// closeNotifySent 表示 Conn 是否尝试发送过 alertCloseNotify 记录。
+	// closeNotifySent 表示 Conn 是否尝试发送过 close_notify 记录。
 	closeNotifySent bool
+
+	// activeCall 的最低位表示是否已经调用 Close，其余位是正在执行 Write 的 goroutine 数量。
+	activeCall atomic.Int32
+
+	// 输入/输出。读写两个方向的记录层状态相互独立，分别由 in 和 out 的锁保护，
+	// 因此一个 goroutine 调用 Read 的同时另一个 goroutine 可以调用 Write。
+	// rawInput、input、hand 和 retryCount 只在读取方向使用，由 c.in 锁保护。
+	in, out  halfConn
+	rawInput bytes.Buffer // 原始输入，从记录头部开始
+	input    bytes.Reader // 等待被 Read 读取的应用数据
+	hand     bytes.Buffer // 等待被读取的握手数据
+
+	// retryCount 是连续收到的不含应用数据的记录数量
+	retryCount int
+
+	// renegotiationRequested 表示服务端通过 Renegotiate 发送了 HelloRequest，下一个握手消息开始重新协商
+	renegotiationRequested atomic.Bool
+
+	// hsState 是握手状态机的当前状态，hsBranches 是最近一条握手消息之后可以选择的状态，见 handshake_state.go
+	hsState    handshakeState
+	hsBranches []handshakeState
+
+	// driver 不为 nil 时握手由 HandshakeConn 驱动，握手消息不经过记录层和底层连接
+	driver *handshakeDriver
+}
+
+// halfConn 是连接一个方向上的记录层状态，包括密码算法、MAC 算法和序列号。
+type halfConn struct {
+	sync.Mutex
+
+	err     error                  // 第一个永久性错误
+	version common.ProtocolVersion // 协议版本
+	cipher  cipher.Block           // 分组密码算法，为 nil 时不加密
+	mac     hash.Hash              // MAC 算法
+	seq     [8]byte                // 64 位序列号
+
+	compressor   Compressor   // 写入方向的压缩算法，为 nil 时不压缩
+	decompressor Decompressor // 读取方向的解压算法，为 nil 时不解压
+
+	nextCipher       cipher.Block // 下一个要使用的分组密码算法
+	nextMac          hash.Hash    // 下一个要使用的 MAC 算法
+	nextCompressor   Compressor   // 下一个要使用的压缩算法
+	nextDecompressor Decompressor // 下一个要使用的解压算法
+}
+
+func (hc *halfConn) setErrorLocked(err error) error {
+	if e, ok := err.(net.Error); ok {
+		hc.err = &permanentError{err: e}
+	} else {
+		hc.err = err
+	}
+	return hc.err
+}
+
+// setVersion 记录协商出的协议版本，之后两个方向的记录都使用该版本。
+// 调用方必须持有 c.in 锁；写入方向的状态可能正在被 Write 使用，这里会获取 c.out 锁。
+func (c *Conn) setVersion(version common.ProtocolVersion) {
+	c.version = version
+	c.in.version = version
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.out.version = version
+}
+
+// prepareCipherSpec 根据工作密钥设置两个方向在 ChangeCipherSpec 之后使用的密码算法、MAC 算法和压缩算法。
+// 调用方必须持有 c.in 锁；写入方向的状态可能正在被 Write 使用，这里会获取 c.out 锁。
+func (c *Conn) prepareCipherSpec(suite *cipherSuite, in, out TrafficKeys) {
+	in.CipherSuite = uint16(suite.id)
+	out.CipherSuite = uint16(suite.id)
+	if c.driver != nil {
+		c.driver.readKeys = in
+		c.driver.writeKeys = out
+	}
+
+	impl, compress := compressionByID(c.compression)
+
+	c.in.prepareCipherSpec(c.version, suite.cipher(in.Key), suite.mac(in.MACKey))
+	c.in.nextDecompressor = nil
+	if compress {
+		c.in.nextDecompressor = impl.newDecompressor()
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	c.out.prepareCipherSpec(c.version, suite.cipher(out.Key), suite.mac(out.MACKey))
+	c.out.nextCompressor = nil
+	if compress {
+		c.out.nextCompressor = impl.newCompressor()
+	}
+}
+
+// prepareCipherSpec 设置 ChangeCipherSpec 之后使用的密码算法和 MAC 算法。
+func (hc *halfConn) prepareCipherSpec(version common.ProtocolVersion, cipher cipher.Block, mac hash.Hash) {
+	hc.version = version
+	hc.nextCipher = cipher
+	hc.nextMac = mac
+}
+
+// changeCipherSpec 切换到 prepareCipherSpec 设置的密码算法、MAC 算法和压缩算法。
+func (hc *halfConn) changeCipherSpec() error {
+	if hc.nextCipher == nil {
+		return AlertInternalError
+	}
+	hc.cipher = hc.nextCipher
+	hc.mac = hc.nextMac
+	hc.compressor = hc.nextCompressor
+	hc.decompressor = hc.nextDecompressor
+	hc.nextCipher = nil
+	hc.nextMac = nil
+	hc.nextCompressor = nil
+	hc.nextDecompressor = nil
+	for i := range hc.seq {
+		hc.seq[i] = 0
+	}
+	return nil
+}
+
+// incSeq 递增序列号。
+func (hc *halfConn) incSeq() {
+	for i := 7; i >= 0; i-- {
+		hc.seq[i]++
+		if hc.seq[i] != 0 {
+			return
+		}
+	}
+
+	// 不允许序列号回绕，GM/T 0024-2014 要求在序列号溢出前重新协商。
+	panic("gmtls: sequence number wraparound")
+}
+
+// extractPadding 以常数时间检查 CBC 填充，返回填充的总长度（包括长度字节）。
+// good 在填充正确时为 255，否则为 0。
+func extractPadding(payload []byte) (toRemove int, good byte) {
+	if len(payload) < 1 {
+		return 0, 0
+	}
+
+	paddingLen := payload[len(payload)-1]
+	t := uint(len(payload)-1) - uint(paddingLen)
+	// 如果 len(payload) >= (paddingLen - 1)，t 的最高位为 0
+	good = byte(int32(^t) >> 31)
+
+	// 最多检查 256 字节的填充
+	toCheck := 256
+	if toCheck > len(payload) {
+		toCheck = len(payload)
+	}
+
+	for i := 0; i < toCheck; i++ {
+		t := uint(paddingLen) - uint(i)
+		// 如果 i <= paddingLen，mask 为 0xff
+		mask := byte(int32(^t) >> 31)
+		b := payload[len(payload)-1-i]
+		good &^= mask&paddingLen ^ mask&b
+	}
+
+	// 把 good 的各位合并，只有全部为 1 时才认为填充正确
+	good &= good << 4
+	good &= good << 2
+	good &= good << 1
+	good = uint8(int8(good) >> 7)
+
+	// 填充错误时 paddingLen 置为 0，使后续的 MAC 检查失败而不是提前返回，避免计时侧信道。
+	paddingLen &= good
+
+	toRemove = int(paddingLen) + 1
+	return
+}
+
+// decrypt 验证并解密记录，返回明文和记录类型。record 包括记录头部。
+//
+// GM/T 0024-2014 第 6.3.2.3 节规定分组密码使用 CBC 模式，每个记录携带显式的 IV：
+//
+//	struct {
+//	    opaque IV[SecurityParameters.record_iv_length];
+//	    block-ciphered struct {
+//	        opaque content[TLSCompressed.length];
+//	        opaque MAC[SecurityParameters.mac_length];
+//	        uint8 padding[GenericBlockCipher.padding_length];
+//	        uint8 padding_length;
+//	    };
+//	} GenericBlockCipher;
+func (hc *halfConn) decrypt(record []byte) ([]byte, fragment.TLSFragmentContentType, error) {
+	typ := fragment.TLSFragmentContentType(record[0])
+	payload := record[recordHeaderLen:]
+
+	if hc.cipher == nil {
+		return payload, typ, nil
+	}
+
+	blockSize := hc.cipher.BlockSize()
+	macSize := hc.mac.Size()
+	minPayload := blockSize + roundUp(macSize+1, blockSize)
+	if len(payload)%blockSize != 0 || len(payload) < minPayload {
+		return nil, 0, AlertBadRecordMAC
+	}
+
+	iv := payload[:blockSize]
+	payload = payload[blockSize:]
+	cipher.NewCBCDecrypter(hc.cipher, iv).CryptBlocks(payload, payload)
+
+	paddingLen, paddingGood := extractPadding(payload)
+	n := len(payload) - macSize - paddingLen
+	n = subtle.ConstantTimeSelect(int(uint32(n)>>31), 0, n) // 如果 n < 0 则为 0
+	remoteMAC := payload[n : n+macSize]
+	payload = payload[:n]
+
+	header := record[:recordHeaderLen]
+	header[3] = byte(n >> 8)
+	header[4] = byte(n)
+	localMAC := hc.computeMAC(header, payload)
+	if subtle.ConstantTimeCompare(localMAC, remoteMAC) != 1 || paddingGood != 255 {
+		return nil, 0, AlertBadRecordMAC
+	}
+
+	hc.incSeq()
+	return payload, typ, nil
+}
+
+// encrypt 保护 payload 并追加到 record 之后，record 包括已经填写的记录头部。
+func (hc *halfConn) encrypt(record, payload []byte, rand io.Reader) ([]byte, error) {
+	if hc.cipher == nil {
+		return append(record, payload...), nil
+	}
+
+	blockSize := hc.cipher.BlockSize()
+	macSize := hc.mac.Size()
+	paddingLen := blockSize - (len(payload)+macSize)%blockSize
+
+	header := record[:recordHeaderLen]
+	mac := hc.computeMAC(header, payload)
+
+	start := len(record)
+	total := blockSize + len(payload) + macSize + paddingLen
+	record = append(record, make([]byte, total)...)
+
+	iv := record[start : start+blockSize]
+	if _, err := io.ReadFull(rand, iv); err != nil {
+		return nil, err
+	}
+	block := record[start+blockSize:]
+	copy(block, payload)
+	copy(block[len(payload):], mac)
+	for i := len(payload) + macSize; i < len(block); i++ {
+		block[i] = byte(paddingLen - 1)
+	}
+	cipher.NewCBCEncrypter(hc.cipher, iv).CryptBlocks(block, block)
+
+	n := len(record) - recordHeaderLen
+	record[3] = byte(n >> 8)
+	record[4] = byte(n)
+	hc.incSeq()
+	return record, nil
+}
+
+// computeMAC 计算记录的 MAC，定义于 GM/T 0024-2014 第 6.3.3.2 节。
+//
+//	HMAC_hash(MAC_write_secret, seq_num + TLSCompressed.type + TLSCompressed.version + TLSCompressed.length + TLSCompressed.fragment)
+//
+// header 是记录头部，其中的长度字段必须是明文的长度。
+func (hc *halfConn) computeMAC(header, payload []byte) []byte {
+	hc.mac.Reset()
+	hc.mac.Write(hc.seq[:])
+	hc.mac.Write(header[:1])
+	hc.mac.Write(header[1:3])
+	hc.mac.Write([]byte{byte(len(payload) >> 8), byte(len(payload))})
+	hc.mac.Write(payload)
+	return hc.mac.Sum(nil)
+}
+
+func roundUp(a, b int) int {
+	return a + (b-a%b)%b
+}
+
+// permanentError 包装一个 net.Error，使其不再被认为是临时性的。
+type permanentError struct {
+	err net.Error
+}
+
+func (e *permanentError) Error() string   { return e.err.Error() }
+func (e *permanentError) Unwrap() error   { return e.err }
+func (e *permanentError) Timeout() bool   { return e.err.Timeout() }
+func (e *permanentError) Temporary() bool { return false }
+
+// RecordHeaderError 在对等方发送的数据不像 TLCP 记录时返回。
+type RecordHeaderError struct {
+	// Msg 是错误描述
+	Msg string
+	// RecordHeader 是触发错误的 5 字节记录头部
+	RecordHeader [5]byte
+	// Conn 是底层连接，如果客户端发送的是明文数据，可以用它返回错误信息
+	Conn net.Conn
+}
+
+func (e RecordHeaderError) Error() string { return "tls: " + e.Msg }
+
+func (c *Conn) newRecordHeaderError(conn net.Conn, msg string) (err RecordHeaderError) {
+	err.Msg = msg
+	err.Conn = conn
+	copy(err.RecordHeader[:], c.rawInput.Bytes())
+	return err
+}
+
+// readRecord 读取一个记录。调用方必须持有 c.in 锁。
+func (c *Conn) readRecord() error {
+	return c.readRecordOrCCS(false)
+}
+
+// readChangeCipherSpec 读取 ChangeCipherSpec 消息。调用方必须持有 c.in 锁。
+func (c *Conn) readChangeCipherSpec() error {
+	if c.driver != nil {
+		return c.driverSetReadKeys()
+	}
+	return c.readRecordOrCCS(true)
+}
+
+// readHandshakeBytes 读取更多的握手数据到 c.hand。调用方必须持有 c.in 锁。
+func (c *Conn) readHandshakeBytes() error {
+	if c.driver != nil {
+		return c.driverWaitForSignal()
+	}
+	return c.readRecord()
+}
+
+// readRecordOrCCS 从连接中读取一个或多个记录，并更新记录层状态。
+// 应用数据放入 c.input，握手数据放入 c.hand，site2site 记录交给 Config.Site2Site。
+//
+// expectChangeCipherSpec 为 true 时，只接受 ChangeCipherSpec 消息，并切换读取方向的密码算法。
+func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
+	if c.in.err != nil {
+		return c.in.err
+	}
+	handshakeComplete := c.isHandshakeComplete.Load()
+
+	// 检查是否有未处理的数据
+	if c.input.Len() != 0 {
+		return c.in.setErrorLocked(errors.New("tls: internal error: attempted to read record with pending application data"))
+	}
+	c.input.Reset(nil)
+
+	// 读取记录头部
+	if err := c.readFromUntil(c.conn, recordHeaderLen); err != nil {
+		// 握手过程中没有读到任何数据时返回 io.EOF，表示对方在握手前关闭了连接。
+		// 握手完成后，对方必须先发送 close_notify 再关闭连接，否则应用数据可能被截断，
+		// 此时返回 io.ErrUnexpectedEOF 以便调用方发现截断攻击。
+		if err == io.ErrUnexpectedEOF && c.rawInput.Len() == 0 && !handshakeComplete {
+			err = io.EOF
+		}
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			c.in.setErrorLocked(err)
+		}
+		return err
+	}
+	hdr := c.rawInput.Bytes()[:recordHeaderLen]
+	typ := fragment.TLSFragmentContentType(hdr[0])
+
+	vers := common.ProtocolVersion(hdr[1])<<8 | common.ProtocolVersion(hdr[2])
+	n := int(hdr[3])<<8 | int(hdr[4])
+	if c.in.version != 0 && vers != c.in.version {
+		c.sendAlert(AlertProtocolVersion)
+		msg := fmt.Sprintf("received record with version %s when expecting version %s", vers, c.in.version)
+		return c.in.setErrorLocked(c.newRecordHeaderError(nil, msg))
+	}
+	if c.in.version == 0 {
+		// 第一条记录必须是握手消息，否则对方可能不是 TLCP 客户端或服务端。
+		if (typ != fragment.ContentTypeAlert && typ != fragment.ContentTypeHandshake) || n >= 0x3000 {
+			return c.in.setErrorLocked(c.newRecordHeaderError(c.conn, "first record does not look like a TLCP handshake"))
+		}
+	}
+	if n > maxCiphertext {
+		c.sendAlert(AlertRecordOverflow)
+		msg := fmt.Sprintf("oversized record received with length %d", n)
+		return c.in.setErrorLocked(c.newRecordHeaderError(nil, msg))
+	}
+	if err := c.readFromUntil(c.conn, recordHeaderLen+n); err != nil {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			c.in.setErrorLocked(err)
+		}
+		return err
+	}
+
+	// 解密并校验记录
+	record := c.rawInput.Next(recordHeaderLen + n)
+	data, typ, err := c.in.decrypt(record)
+	if err != nil {
+		return c.in.setErrorLocked(c.sendAlert(err.(AlertDescription)))
+	}
+	if c.in.decompressor != nil {
+		if len(data) > maxPlaintext+compressedExpansion {
+			return c.in.setErrorLocked(c.sendAlert(AlertRecordOverflow))
+		}
+		if data, err = c.in.decompressor.Decompress(nil, data, maxPlaintext); err != nil {
+			c.sendAlert(AlertDecompressionFailure)
+			return c.in.setErrorLocked(err)
+		}
+	}
+	if len(data) > maxPlaintext {
+		return c.in.setErrorLocked(c.sendAlert(AlertRecordOverflow))
+	}
+
+	// 应用数据必须受到保护
+	if c.in.cipher == nil && typ == fragment.ContentTypeApplicationData {
+		return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+	}
+
+	// 分为多个记录的握手消息之间不能插入其他类型的记录，参见 RFC 5246 第 6.2.1 节
+	if typ != fragment.ContentTypeHandshake && c.hand.Len() > 0 {
+		return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+	}
+
+	if typ != fragment.ContentTypeAlert && typ != fragment.ContentTypeChangeCipherSpec && typ != fragment.ContentTypeHandshake && len(data) > 0 {
+		// 收到了有效的数据，重置计数
+		c.retryCount = 0
+	}
+
+	switch typ {
+	default:
+		return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+
+	case fragment.ContentTypeAlert:
+		var msg handshaking.AlertMessage
+		if err := msg.Unmarshal(data); err != nil {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+		}
+		if msg.Description == AlertCloseNotify {
+			return c.in.setErrorLocked(io.EOF)
+		}
+		// 忽略警告级别的报警消息，但 GM/T 0024-2014 规定为致命的报警无论级别都会中止连接
+		if msg.Level == AlertLevelWarning && !msg.Description.IsFatal() {
+			if msg.Description == AlertNoRenegotiation && !c.isClient {
+				// 客户端拒绝了 Renegotiate 发起的重新协商，之后的 ClientHello 不再被接受
+				c.renegotiationRequested.Store(false)
+			}
+			return c.retryReadRecord(expectChangeCipherSpec)
+		}
+		return c.in.setErrorLocked(&net.OpError{Op: "remote error", Err: AlertError{Level: msg.Level, Description: msg.Description}})
+
+	case fragment.ContentTypeChangeCipherSpec:
+		if len(data) != 1 || data[0] != 1 {
+			return c.in.setErrorLocked(c.sendAlert(AlertDecodeError))
+		}
+		if !expectChangeCipherSpec {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+		}
+		if err := c.in.changeCipherSpec(); err != nil {
+			return c.in.setErrorLocked(c.sendAlert(err.(AlertDescription)))
+		}
+
+	case fragment.ContentTypeApplicationData:
+		if !handshakeComplete || expectChangeCipherSpec {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+		}
+		// 部分实现会发送空的应用数据记录，忽略它们
+		if len(data) == 0 {
+			return c.retryReadRecord(expectChangeCipherSpec)
+		}
+		c.input.Reset(data)
+
+	case fragment.ContentTypeSite2Site:
+		if !handshakeComplete || expectChangeCipherSpec {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+		}
+		if c.config.Site2Site == nil {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnsupportedSite2site))
+		}
+		if len(data) == 0 {
+			return c.retryReadRecord(expectChangeCipherSpec)
+		}
+		if err := c.config.Site2Site(c, data); err != nil {
+			c.sendAlert(AlertInternalError)
+			return c.in.setErrorLocked(err)
+		}
+
+	case fragment.ContentTypeHandshake:
+		if len(data) == 0 || expectChangeCipherSpec {
+			return c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+		}
+		c.hand.Write(data)
+		// 把握手消息拆成大量很小的记录同样会消耗本端的资源，这类记录和空记录一样计数
+		if len(data) >= minHandshakeFragment || c.hasCompleteHandshake() {
+			c.retryCount = 0
+		} else if c.retryCount++; c.retryCount > maxUselessRecord {
+			c.sendAlert(AlertUnexpectedMessage)
+			return c.in.setErrorLocked(errors.New("tls: too many fragmented handshake records"))
+		}
+	}
+
+	return nil
+}
+
+// hasCompleteHandshake 返回 c.hand 中是否有完整的握手消息。
+func (c *Conn) hasCompleteHandshake() bool {
+	if c.hand.Len() < handshaking.HeaderLength {
+		return false
+	}
+	_, n := handshaking.ParseHeader(c.hand.Bytes())
+	return c.hand.Len() >= handshaking.HeaderLength+int(n)
+}
+
+// retryReadRecord 在收到不含数据的记录后重新读取，并限制这类记录的数量。
+func (c *Conn) retryReadRecord(expectChangeCipherSpec bool) error {
+	c.retryCount++
+	if c.retryCount > maxUselessRecord {
+		c.sendAlert(AlertUnexpectedMessage)
+		return c.in.setErrorLocked(errors.New("tls: too many ignored records"))
+	}
+	return c.readRecordOrCCS(expectChangeCipherSpec)
+}
+
+// atLeastReader 读取 R，直到读到至少 N 字节或遇到错误。
+type atLeastReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *atLeastReader) Read(p []byte) (int, error) {
+	if r.N <= 0 {
+		return 0, io.EOF
+	}
+	n, err := r.R.Read(p)
+	r.N -= int64(n)
+	if r.N > 0 && err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if r.N <= 0 && err == nil {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// readFromUntil 从 r 读取数据到 c.rawInput，直到其中至少有 n 字节。
+func (c *Conn) readFromUntil(r io.Reader, n int) error {
+	if c.rawInput.Len() >= n {
+		return nil
+	}
+	needs := n - c.rawInput.Len()
+	c.rawInput.Grow(needs + bytes.MinRead)
+	_, err := c.rawInput.ReadFrom(&atLeastReader{r, int64(needs)})
+	return err
+}
+
+// sendAlertLocked 发送报警消息。调用方必须持有 c.out 锁。
+func (c *Conn) sendAlertLocked(err AlertDescription) error {
+	msg := handshaking.AlertMessage{Level: err.Level(), Description: err}
+	if c.driver != nil {
+		// 由 HandshakeConn 的调用方发送报警
+		return c.out.setErrorLocked(&net.OpError{Op: "local error", Err: AlertError{Level: msg.Level, Description: err}})
+	}
+	_, writeErr := c.writeRecordLocked(fragment.ContentTypeAlert, msg.Marshal())
+	if err == AlertCloseNotify || err == AlertNoRenegotiation {
+		// close_notify 不是错误；no_renegotiation 只是拒绝重新协商，连接继续使用原来的安全参数
+		return writeErr
+	}
+
+	return c.out.setErrorLocked(&net.OpError{Op: "local error", Err: AlertError{Level: msg.Level, Description: err}})
+}
+
+// sendAlert 发送报警消息。
+func (c *Conn) sendAlert(err AlertDescription) error {
+	c.out.Lock()
+	defer c.out.Unlock()
+	return c.sendAlertLocked(err)
+}
+
+// writeRecordLocked 把 data 分片为若干记录后写入连接。调用方必须持有 c.out 锁。
+func (c *Conn) writeRecordLocked(typ fragment.TLSFragmentContentType, data []byte) (int, error) {
+	if c.out.err != nil {
+		return 0, c.out.err
+	}
+
+	version := c.out.version
+	if version == 0 {
+		version = VersionTLCP11
+	}
+
+	var n int
+	var outBuf, compressed []byte
+	for len(data) > 0 {
+		m := len(data)
+		if m > maxPlaintext {
+			m = maxPlaintext
+		}
+
+		payload := data[:m]
+		if c.out.compressor != nil {
+			var err error
+			if compressed, err = c.out.compressor.Compress(compressed[:0], payload); err != nil {
+				return n, err
+			}
+			if len(compressed) > maxPlaintext+compressedExpansion {
+				return n, errors.New("tls: compressed record exceeds the maximum length")
+			}
+			payload = compressed
+		}
+
+		outBuf = append(outBuf[:0], byte(typ), byte(version>>8), byte(version), byte(len(payload)>>8), byte(len(payload)))
+		var err error
+		outBuf, err = c.out.encrypt(outBuf, payload, c.config.rand())
+		if err != nil {
+			return n, err
+		}
+		if _, err := c.conn.Write(outBuf); err != nil {
+			return n, err
+		}
+		n += m
+		data = data[m:]
+	}
+
+	if typ == fragment.ContentTypeChangeCipherSpec {
+		if err := c.out.changeCipherSpec(); err != nil {
+			return n, c.sendAlertLocked(err.(AlertDescription))
+		}
+	}
+
+	return n, nil
+}
+
+// writeHandshakeRecord 写入握手消息，并把它加入 transcript（如果不为 nil）。
+func (c *Conn) writeHandshakeRecord(msg handshaking.Message, transcript *finishedHash) (int, error) {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	data, err := handshaking.MarshalMessage(msg)
+	if err != nil {
+		return 0, err
+	}
+	if transcript != nil {
+		transcript.Write(data)
+	}
+
+	if c.driver != nil {
+		c.driverWriteData(data)
+		return len(data), nil
+	}
+	return c.writeRecordLocked(fragment.ContentTypeHandshake, data)
+}
+
+// writeChangeCipherSpecRecord 写入 ChangeCipherSpec 消息，并切换写入方向的密码算法。
+func (c *Conn) writeChangeCipherSpecRecord() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.driver != nil {
+		c.driverSetWriteKeys()
+		return nil
+	}
+	_, err := c.writeRecordLocked(fragment.ContentTypeChangeCipherSpec, []byte{1})
+	return err
+}
+
+// readHandshake 读取下一个握手消息，并把它加入 transcript（如果不为 nil）。调用方必须持有 c.in 锁。
+func (c *Conn) readHandshake(transcript *finishedHash) (handshaking.Message, error) {
+	for c.hand.Len() < handshaking.HeaderLength {
+		if err := c.readHandshakeBytes(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 在读取消息的其余部分之前检查长度，避免对方声明一个很长的消息让本端缓存大量数据
+	typ, n := handshaking.ParseHeader(c.hand.Bytes())
+	if err := c.advanceHandshakeState(typ); err != nil {
+		return nil, err
+	}
+	if max := c.config.maxHandshakeSize(typ); int(n) > max {
+		c.sendAlert(AlertInternalError)
+		return nil, c.in.setErrorLocked(fmt.Errorf("tls: %s message of length %d bytes exceeds maximum of %d bytes", typ, n, max))
+	}
+	for c.hand.Len() < handshaking.HeaderLength+int(n) {
+		if err := c.readHandshakeBytes(); err != nil {
+			return nil, err
+		}
+	}
+
+	data := c.hand.Next(handshaking.HeaderLength + int(n))
+	msg, err := handshaking.UnmarshalMessage(data)
+	if err != nil {
+		if errors.Is(err, handshaking.ErrMalformedMessage) {
+			return nil, c.in.setErrorLocked(c.sendAlert(AlertDecodeError))
+		}
+		return nil, c.in.setErrorLocked(c.sendAlert(AlertUnexpectedMessage))
+	}
+	if transcript != nil {
+		transcript.Write(data)
+	}
+	return msg, nil
+}
+
+func unexpectedMessageError(wanted, got any) error {
+	return fmt.Errorf("tls: received unexpected handshake message of type %T when waiting for %T", got, wanted)
+}
+
+var errShutdown = errors.New("tls: protocol is shutdown")
+
+// Write 向连接写入数据。
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.writeData(fragment.ContentTypeApplicationData, b)
+}
+
+// WriteSite2Site 把 b 作为一个 site2site 记录发送给对方。b 的长度不能超过 16384 字节。
+//
+// 只有在 Config.Site2Site 不为 nil 时才能发送。对方不支持 site2site 时会以 unsupported_site2site 报警中止连接，
+// 之后的 Read 返回包装了该报警的错误。
+func (c *Conn) WriteSite2Site(b []byte) (int, error) {
+	if c.config.Site2Site == nil {
+		return 0, errors.New("tls: site2site records are not enabled in Config")
+	}
+	if len(b) > maxPlaintext {
+		return 0, fmt.Errorf("tls: site2site record of %d bytes exceeds the maximum of %d bytes", len(b), maxPlaintext)
+	}
+	return c.writeData(fragment.ContentTypeSite2Site, b)
+}
+
+// writeData 在握手完成后把 b 作为 typ 类型的记录发送。
+func (c *Conn) writeData(typ fragment.TLSFragmentContentType, b []byte) (int, error) {
+	// 与 Close 互锁，见 activeCall
+	for {
+		x := c.activeCall.Load()
+		if x&1 != 0 {
+			return 0, net.ErrClosed
+		}
+		if c.activeCall.CompareAndSwap(x, x+2) {
+			break
+		}
+	}
+	defer c.activeCall.Add(-2)
+
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return 0, err
+	}
+	if !c.isHandshakeComplete.Load() {
+		return 0, AlertInternalError
+	}
+	if c.closeNotifySent {
+		return 0, errShutdown
+	}
+
+	n, err := c.writeRecordLocked(typ, b)
+	return n, c.out.setErrorLocked(err)
+}
+
+// handlePostHandshakeMessage 处理握手完成后收到的握手消息。调用方必须持有 c.in 锁。
+//
+// 客户端只接受 HelloRequest，根据 Config.Renegotiation 决定是否重新协商。
+// 服务端只在调用 Renegotiate 之后接受 ClientHello 并重新协商，其他握手消息都会由 readHandshake 以 unexpected_message 报警拒绝。
+func (c *Conn) handlePostHandshakeMessage() error {
+	if !c.isClient {
+		if !c.renegotiationRequested.Swap(false) {
+			_, err := c.readHandshake(nil)
+			return err
+		}
+		return c.renegotiate(c.serverHandshake)
+	}
+
+	msg, err := c.readHandshake(nil)
+	if err != nil {
+		return err
+	}
+	helloReq, ok := msg.(*handshaking.HelloRequestMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(helloReq, msg)
+	}
+
+	switch c.config.Renegotiation {
+	case RenegotiateNever:
+		return c.sendAlert(AlertNoRenegotiation)
+	case RenegotiateOnceAsClient:
+		if c.handshakes > 1 {
+			return c.sendAlert(AlertNoRenegotiation)
+		}
+	case RenegotiateFreelyAsClient:
+		// 允许
+	default:
+		c.sendAlert(AlertInternalError)
+		return errors.New("tls: unknown Renegotiation value")
+	}
+
+	// 没有协商安全重新协商时，重新协商可能受到前缀注入攻击
+	if !c.secureRenegotiation {
+		return c.sendAlert(AlertNoRenegotiation)
+	}
+
+	return c.renegotiate(c.clientHandshake)
+}
+
+// renegotiate 在已经建立的连接上执行握手 handshake。调用方必须持有 c.in 锁，加锁顺序见 Conn.handshakeMutex。
+func (c *Conn) renegotiate(handshake func() error) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	c.isHandshakeComplete.Store(false)
+	if c.handshakeErr = handshake(); c.handshakeErr == nil {
+		c.handshakes++
+	}
+	return c.handshakeErr
+}
+
+// Renegotiate 由服务端调用，向客户端发送 HelloRequest 请求重新协商，例如在连接建立之后要求客户端提供证书。
+//
+// Renegotiate 不等待重新协商完成：客户端回应的 ClientHello 在之后的 Read 中处理，Read 在重新协商完成后才继续返回应用数据。
+// 客户端可以以 no_renegotiation 警告拒绝，此时双方继续使用原来的安全参数，服务端也不再接受客户端之后发送的 ClientHello。
+// 第一次握手没有协商 RFC 5746 安全重新协商时，服务端会拒绝客户端的 ClientHello，重新协商失败。
+func (c *Conn) Renegotiate() error {
+	if c.isClient {
+		return errors.New("tls: Renegotiate called on a client connection")
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	// 先设置标志，客户端的 ClientHello 可能在 HelloRequest 写入之后立即到达
+	c.renegotiationRequested.Store(true)
+	if _, err := c.writeHandshakeRecord(&handshaking.HelloRequestMessage{}, nil); err != nil {
+		c.renegotiationRequested.Store(false)
+		return err
+	}
+	return nil
+}
+
+// Read 从连接读取数据。
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		// 即使 b 为空也要先完成握手，这样可以用 Read(nil) 触发握手
+		return 0, nil
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	for c.input.Len() == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+		for c.hand.Len() > 0 {
+			if err := c.handlePostHandshakeMessage(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, _ := c.input.Read(b)
+	return n, nil
+}
+
+// Close 关闭连接。握手已经完成时，先向对方发送 close_notify 报警。
+//
+// 发送 close_notify 最多等待 5 秒，发送失败时仍然会关闭底层连接，并返回发送的错误。
+// 如果另一个 goroutine 正在执行 Write，Close 不发送 close_notify，直接关闭底层连接，使阻塞的 Write 返回。
+func (c *Conn) Close() error {
+	// 与 Write 互锁，见 activeCall
+	var x int32
+	for {
+		x = c.activeCall.Load()
+		if x&1 != 0 {
+			return net.ErrClosed
+		}
+		if c.activeCall.CompareAndSwap(x, x|1) {
+			break
+		}
+	}
+	if x != 0 {
+		// Write 和 Close 同时调用时，把 Close 看作是为了中断 Write 并释放资源。
+		// 发送 close_notify 需要等待 c.out 锁，而 Write 可能正因为对方不读取而持有它
+		return c.conn.Close()
+	}
+
+	var alertErr error
+	if c.isHandshakeComplete.Load() {
+		if err := c.closeNotify(); err != nil {
+			alertErr = fmt.Errorf("tls: failed to send closeNotify alert (but connection was closed anyway): %w", err)
+		}
+	}
+
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+var errEarlyCloseWrite = errors.New("tls: CloseWrite called before handshake complete")
+
+// CloseWrite 关闭连接的写入方向，向对方发送 close_notify 报警，之后的 Write 都会失败。
+// 连接仍然可以读取，直到对方关闭连接。只能在握手完成后调用，它不会关闭底层连接的写入方向。
+func (c *Conn) CloseWrite() error {
+	if !c.isHandshakeComplete.Load() {
+		return errEarlyCloseWrite
+	}
+
+	return c.closeNotify()
+}
+
+func (c *Conn) closeNotify() error {
+	// 在获取 c.out 锁之前设置写入截止时间，这样持有锁并阻塞在写入中的调用最多再等待 5 秒，
+	// 对方不读取时也不会永远阻塞
+	c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if !c.closeNotifySent {
+		c.closeNotifyErr = c.sendAlertLocked(AlertCloseNotify)
+		c.closeNotifySent = true
+	}
+	// 之后的写入都会失败
+	c.SetWriteDeadline(time.Now())
+	return c.closeNotifyErr
+}
+
+// Handshake 执行客户端或服务端握手协议（如果还没有执行）。
+//
+// 大多数调用方不需要显式调用 Handshake：第一次 Read 或 Write 会自动调用它。
+//
+// 如果需要取消握手或者为握手设置超时，使用 [Conn.HandshakeContext]。
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext 执行客户端或服务端握手协议（如果还没有执行）。
+//
+// ctx 在握手完成前被取消或者超时时，握手会被中断：阻塞中的读写通过设置已经过去的截止时间被唤醒，
+// 随后向对方发送 user_canceled 报警并返回 ctx.Err()。该错误会被记录下来，之后的握手、读写都直接返回它。
+// 中断后连接原有的截止时间会被清除。握手完成后 ctx 不再对连接产生影响。
+//
+// 服务端连接的 Config.HandshakeTimeout 不为零时，握手的截止时间不晚于开始握手之后的 HandshakeTimeout。
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if err := c.handshakeErr; err != nil {
+		return err
+	}
+	if c.isHandshakeComplete.Load() {
+		return nil
+	}
+
+	if !c.isClient && c.config.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.HandshakeTimeout)
+		defer cancel()
+	}
+
+	if c.driver != nil {
+		// 由 HandshakeConn 驱动时，等待数据的地方会检查 ctx
+		var cancel context.CancelFunc
+		c.driver.ctx, cancel = context.WithCancel(ctx)
+		c.driver.cancel = cancel
+		defer cancel()
+
+		c.in.Lock()
+		c.handshakeErr = c.handshakeFn()
+		c.in.Unlock()
+	} else {
+		c.runInterruptibleHandshake(ctx)
+	}
+
+	if c.handshakeErr == nil {
+		c.handshakes++
+	}
+
+	if c.handshakeErr == nil && !c.isHandshakeComplete.Load() {
+		c.handshakeErr = errors.New("tls: internal error: handshake should have had a result")
+	}
+
+	if c.driver != nil {
+		c.driverFinish()
+	}
+
+	return c.handshakeErr
+}
+
+// runInterruptibleHandshake 在底层连接上执行握手，ctx 结束时中断阻塞的读写。调用方必须持有 c.handshakeMutex。
+func (c *Conn) runInterruptibleHandshake(ctx context.Context) {
+	// ctx 结束时设置一个已经过去的截止时间，让阻塞在底层连接上的读写立即返回
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	c.in.Lock()
+	c.handshakeErr = c.handshakeFn()
+	c.in.Unlock()
+
+	if !stop() {
+		<-interrupted
+		c.conn.SetDeadline(time.Time{})
+		if c.handshakeErr != nil || !c.isHandshakeComplete.Load() {
+			c.cancelHandshake(ctx.Err())
+		}
+	}
+}
+
+// cancelHandshake 在握手被 ctx 中断后通知对方，关闭底层连接并记录错误 err。调用方必须持有 c.handshakeMutex。
+//
+// user_canceled 是警告级别的报警，对方收到后会继续等待，因此随后发送 close_notify 并关闭连接，
+// 让对方的握手立即失败。与 crypto/tls 相同，被中断的连接不能再使用。
+func (c *Conn) cancelHandshake(err error) {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	// 对方可能已经不再读取，不能让报警的发送无限期阻塞
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	msg := handshaking.AlertMessage{Level: AlertUserCanceled.Level(), Description: AlertUserCanceled}
+	if _, writeErr := c.writeRecordLocked(fragment.ContentTypeAlert, msg.Marshal()); writeErr == nil {
+		c.sendAlertLocked(AlertCloseNotify)
+	}
+	c.conn.Close()
+
+	c.handshakeErr = err
+	c.out.setErrorLocked(err)
 }
 
 // LocalAddr 返回本地网络地址。
@@ -82,3 +1160,65 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
+
+// ConnectionState 返回连接的基本信息。
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	return c.connectionStateLocked()
+}
+
+// setSecurityParameters 在计算出主密钥后记录连接的安全参数。
+func (c *Conn) setSecurityParameters(suite *cipherSuite, masterSecret, clientRandom, serverRandom []byte) {
+	p := &c.params
+	p.Entity = fragment.ConnectionEndServer
+	if c.isClient {
+		p.Entity = fragment.ConnectionEndClient
+	}
+	p.BulkCipherAlgorithm = fragment.BulkCipherAlgorithmSM4
+	p.CipherType = fragment.CipherTypeBlock
+	p.KeyMaterialLength = uint8(suite.keyLen)
+	p.MacAlgorithm = fragment.MacAlgorithmSM3
+	p.HashSize = uint8(suite.macLen)
+	p.CompressionAlgorithm = c.compression
+	copy(p.MasterSecret[:], masterSecret)
+	copy(p.ClientRandom[:], clientRandom)
+	copy(p.ServerRandom[:], serverRandom)
+	p.RecordIVLength = uint8(suite.ivLen)
+	p.MacLength = uint8(suite.macLen)
+}
+
+// connectionStateLocked 返回连接的基本信息。调用方必须持有 handshakeMutex。
+func (c *Conn) connectionStateLocked() ConnectionState {
+	var state ConnectionState
+	state.HandshakeComplete = c.isHandshakeComplete.Load()
+	state.Version = c.version
+	state.CipherSuite = uint16(c.cipherSuite)
+	if suite := cipherSuiteByID(c.cipherSuite); suite != nil {
+		state.KeyExchangeAlgorithm = suite.kex
+	}
+	state.PeerCertificates = c.peerCertificates
+	if len(c.peerCertificates) >= 2 {
+		state.PeerSigningCertificate = c.peerCertificates[0]
+		state.PeerEncryptionCertificate = c.peerCertificates[1]
+	}
+	state.SessionID = c.sessionID
+	state.ServerName = c.serverName
+	state.VerifiedChains = c.verifiedChains
+	state.NegotiatedProtocol = c.clientProtocol
+	state.CompressionMethod = c.compression
+	state.LocalSM2UserID = c.localSM2UserID
+	state.PeerSM2UserID = c.peerSM2UserID
+	if state.HandshakeComplete {
+		if c.clientFinishedIsFirst {
+			state.TLSUnique = c.clientFinished[:]
+		} else {
+			state.TLSUnique = c.serverFinished[:]
+		}
+		p := &c.params
+		state.ekm = ekmFromMasterSecret(slices.Clone(p.MasterSecret[:]), slices.Clone(p.ClientRandom[:]), slices.Clone(p.ServerRandom[:]))
+	} else {
+		state.ekm = noEKMBecauseHandshakeNotComplete
+	}
+	return state
+}
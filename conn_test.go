@@ -0,0 +1,300 @@
+package gmtls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakePair 返回一对完成了握手的客户端和服务端连接。
+func handshakePair(t *testing.T) (client, server *Conn) {
+	t.Helper()
+	serverConfig, clientConfig := testConfigs(t)
+	c, s := localPipe(t)
+	client = Client(c, clientConfig)
+	server = Server(s, serverConfig)
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestCloseNotify(t *testing.T) {
+	client, server := handshakePair(t)
+
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got %q, want %q", data, "hello")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after close_notify: got %v, want io.EOF", err)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	client, server := handshakePair(t)
+
+	if _, err := server.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// 直接关闭底层连接，不发送 close_notify
+	if err := server.NetConn().Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(client)
+	if string(data) != "hello" {
+		t.Errorf("got %q, want %q", data, "hello")
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	_, clientConfig := testConfigs(t)
+	c, _ := localPipe(t)
+	defer c.Close()
+	if err := Client(c, clientConfig).CloseWrite(); err != errEarlyCloseWrite {
+		t.Errorf("CloseWrite before handshake: got %v, want %v", err, errEarlyCloseWrite)
+	}
+
+	client, server := handshakePair(t)
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("more")); err == nil {
+		t.Error("Write after CloseWrite succeeded")
+	}
+
+	// 服务端读到 close_notify 后仍然可以写入
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("server ReadAll: %v", err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("server got %q, want %q", data, "ping")
+	}
+	if _, err := server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client ReadAll: %v", err)
+	}
+	if string(data) != "pong" {
+		t.Errorf("client got %q, want %q", data, "pong")
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Close after CloseWrite: %v", err)
+	}
+}
+
+// TestCloseWhileWriteBlocked 验证对方不读取时，Close 能中断阻塞在 Write 中的 goroutine。
+func TestCloseWhileWriteBlocked(t *testing.T) {
+	client, _ := handshakePair(t)
+
+	// 服务端不读取，写入足够多的数据后 Write 会阻塞在 c.out 锁中
+	writeDone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1<<20)
+		for {
+			if _, err := client.Write(buf); err != nil {
+				writeDone <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-writeDone:
+		t.Fatalf("Write returned before Close: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- client.Close() }()
+	select {
+	case err := <-closeDone:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked while a Write was in flight")
+	}
+	select {
+	case err := <-writeDone:
+		if err == nil {
+			t.Error("Write succeeded after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write still blocked after Close")
+	}
+
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close: got %v, want net.ErrClosed", err)
+	}
+	if err := client.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close: got %v, want net.ErrClosed", err)
+	}
+}
+
+// TestConcurrentReadWrite 在两个 goroutine 中同时读写同一个连接，需要配合 -race 运行。
+func TestConcurrentReadWrite(t *testing.T) {
+	client, server := handshakePair(t)
+
+	const chunks = 200
+	payload := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 1+i*97%(3*maxPlaintext))
+	}
+
+	// 服务端原样回显收到的数据，读写也在不同的 goroutine 中进行
+	echo := make(chan []byte, chunks)
+	serverDone := make(chan error, 2)
+	go func() {
+		defer close(echo)
+		for {
+			buf := make([]byte, 4096)
+			n, err := server.Read(buf)
+			if n > 0 {
+				echo <- buf[:n]
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				serverDone <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for b := range echo {
+			if _, err := server.Write(b); err != nil {
+				serverDone <- err
+				return
+			}
+		}
+		serverDone <- server.CloseWrite()
+	}()
+
+	writeDone := make(chan error, 1)
+	go func() {
+		for i := 0; i < chunks; i++ {
+			if _, err := client.Write(payload(i)); err != nil {
+				writeDone <- err
+				return
+			}
+			// 读写进行中查询连接状态也是安全的
+			client.ConnectionState()
+		}
+		writeDone <- client.CloseWrite()
+	}()
+
+	var want bytes.Buffer
+	for i := 0; i < chunks; i++ {
+		want.Write(payload(i))
+	}
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("echoed %d bytes, want %d bytes", len(got), want.Len())
+	}
+
+	if err := <-writeDone; err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-serverDone; err != nil {
+			t.Fatalf("server: %v", err)
+		}
+	}
+}
+
+func TestSite2Site(t *testing.T) {
+	client, server := handshakePair(t)
+
+	var received [][]byte
+	server.config.Site2Site = func(conn *Conn, record []byte) error {
+		if conn != server {
+			t.Error("Site2Site called with the wrong connection")
+		}
+		received = append(received, append([]byte(nil), record...))
+		return nil
+	}
+	if _, err := client.WriteSite2Site([]byte("tunnel")); err == nil {
+		t.Fatal("WriteSite2Site succeeded without Config.Site2Site")
+	}
+	client.config.Site2Site = func(*Conn, []byte) error { return nil }
+
+	if _, err := client.WriteSite2Site([]byte("tunnel")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("Read returned %q, want %q", buf[:n], "hello")
+	}
+	if len(received) != 1 || string(received[0]) != "tunnel" {
+		t.Errorf("Site2Site received %q, want [tunnel]", received)
+	}
+
+	if _, err := client.WriteSite2Site(make([]byte, maxPlaintext+1)); err == nil {
+		t.Error("WriteSite2Site accepted an oversized record")
+	}
+}
+
+func TestSite2SiteUnsupported(t *testing.T) {
+	client, server := handshakePair(t)
+	client.config.Site2Site = func(*Conn, []byte) error { return nil }
+
+	if _, err := client.WriteSite2Site([]byte("tunnel")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 16)); !errors.Is(err, AlertUnsupportedSite2site) {
+		t.Errorf("server Read = %v, want unsupported_site2site", err)
+	}
+	_, err := client.Read(make([]byte, 16))
+	var alertErr AlertError
+	if !errors.As(err, &alertErr) || alertErr.Description != AlertUnsupportedSite2site || alertErr.Level != AlertLevelFatal {
+		t.Errorf("client Read = %v, want fatal unsupported_site2site alert", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Package device 定义了 TLCP 握手所需的密码设备操作。
+//
+// 通过商用密码应用安全性评估（密评）的部署要求私钥保存在密码卡（GM/T 0018 SDF）或智能密码钥匙（GM/T 0016 SKF）中，
+// 私钥不允许以明文形式离开设备。本包把握手需要的设备操作（SM2 签名、SM2 解密、SM2 密钥协商、SM4 会话密钥导入）
+// 抽象为 Go 接口，具体的厂商驱动只需要实现这些接口即可接入 gmtls。
+//
+// 子包 soft 提供了一个纯软件实现的模拟设备，用于测试。
+package device
+
+import (
+	"errors"
+
+	"github.com/tjfoc/gmsm/sm2"
+
+	"github.com/nnnewb/gmtls"
+)
+
+var (
+	// ErrKeyNotFound 表示设备中不存在指定索引的密钥。
+	ErrKeyNotFound = errors.New("device: key not found")
+
+	// ErrAccessDenied 表示未获得私钥使用权限，参考 SDR_PRKERR。
+	ErrAccessDenied = errors.New("device: private key access denied")
+
+	// ErrInvalidHandle 表示会话密钥句柄无效或已被销毁。
+	ErrInvalidHandle = errors.New("device: invalid key handle")
+
+	// ErrSessionClosed 表示会话已关闭。
+	ErrSessionClosed = errors.New("device: session closed")
+)
+
+// KeyIndex 是设备内部密钥对的索引号。
+//
+// 对 SDF 设备，KeyIndex 即 GM/T 0018 中的 uiISKIndex，同一索引下有一对签名密钥和一对加密密钥。
+// 对 SKF 设备，每个容器只包含一对签名密钥和一对加密密钥，驱动可以把 KeyIndex 映射到容器。
+type KeyIndex uint32
+
+// KeyHandle 是导入设备的会话密钥句柄，对应 GM/T 0018 中的 phKeyHandle。
+// 句柄只在创建它的 Session 内有效。
+type KeyHandle uintptr
+
+// Device 是一个已打开的密码设备。对应 GM/T 0018 SDF_OpenDevice / GM/T 0016 SKF_ConnectDev。
+type Device interface {
+	// OpenSession 创建一个与设备的会话。对应 SDF_OpenSession / SKF_OpenApplication。
+	OpenSession() (Session, error)
+
+	// Close 关闭设备。对应 SDF_CloseDevice / SKF_DisConnectDev。
+	Close() error
+}
+
+// Session 是与密码设备的会话，包含握手过程中用到的全部设备操作。
+//
+// Session 的实现必须能够安全地被多个 goroutine 同时使用。
+type Session interface {
+	// GetPrivateKeyAccessRight 获取 index 指定私钥的使用权限。
+	// 对应 SDF_GetPrivateKeyAccessRight / SKF_VerifyPIN。
+	GetPrivateKeyAccessRight(index KeyIndex, password []byte) error
+
+	// ReleasePrivateKeyAccessRight 释放 index 指定私钥的使用权限。
+	// 对应 SDF_ReleasePrivateKeyAccessRight / SKF_ClearSecureState。
+	ReleasePrivateKeyAccessRight(index KeyIndex) error
+
+	// ExportSignPublicKey 导出 index 指定的签名公钥。
+	// 对应 SDF_ExportSignPublicKey_ECC / SKF_ExportPublicKey(bSignFlag=TRUE)。
+	ExportSignPublicKey(index KeyIndex) (*sm2.PublicKey, error)
+
+	// ExportEncPublicKey 导出 index 指定的加密公钥。
+	// 对应 SDF_ExportEncPublicKey_ECC / SKF_ExportPublicKey(bSignFlag=FALSE)。
+	ExportEncPublicKey(index KeyIndex) (*sm2.PublicKey, error)
+
+	// InternalSign 使用 index 指定的签名私钥对杂凑值 digest 签名，返回 ASN.1 DER 编码的 SM2 签名值。
+	// digest 是已经包含签名者 Z 值的 SM3 杂凑值。
+	// 对应 SDF_InternalSign_ECC / SKF_ECCSignData。
+	InternalSign(index KeyIndex, digest []byte) ([]byte, error)
+
+	// InternalDecrypt 使用 index 指定的加密私钥解密 GM/T 0009 ASN.1 编码的 SM2 密文。
+	// 对应 SDF_InternalDecrypt_ECC / SKF_ECCDecrypt。
+	InternalDecrypt(index KeyIndex, ciphertext []byte) ([]byte, error)
+
+	// GenerateAgreementData 使用 index 指定的加密密钥对发起一次 SM2 密钥协商，
+	// 设备内部生成临时密钥对。sponsor 表示本方是否为协商发起方（GM/T 0003.3 中的 A 方）。
+	// 对应 SDF_GenerateAgreementDataWithECC / SDF_GenerateAgreementDataAndKeyWithECC。
+	GenerateAgreementData(index KeyIndex, sponsor bool, id []byte) (Agreement, error)
+
+	// ImportKey 导入明文会话密钥，返回会话密钥句柄。对应 SDF_ImportKey / SKF_SetSymmKey。
+	ImportKey(key []byte) (KeyHandle, error)
+
+	// ImportKeyWithISK 导入使用 index 指定的加密公钥加密的会话密钥，返回会话密钥句柄。
+	// ciphertext 是 GM/T 0009 ASN.1 编码的 SM2 密文。
+	// 对应 SDF_ImportKeyWithISK_ECC / SKF_ImportSessionKey。
+	ImportKeyWithISK(index KeyIndex, ciphertext []byte) (KeyHandle, error)
+
+	// Encrypt 使用会话密钥以 SM4-CBC 模式加密 src，src 长度必须是分组长度的整数倍。
+	// 对应 SDF_Encrypt(uiAlgID=SGD_SM4_CBC) / SKF_Encrypt。
+	Encrypt(handle KeyHandle, iv, src []byte) ([]byte, error)
+
+	// Decrypt 使用会话密钥以 SM4-CBC 模式解密 src，src 长度必须是分组长度的整数倍。
+	// 对应 SDF_Decrypt(uiAlgID=SGD_SM4_CBC) / SKF_Decrypt。
+	Decrypt(handle KeyHandle, iv, src []byte) ([]byte, error)
+
+	// DestroyKey 销毁会话密钥。对应 SDF_DestroyKey / SKF_CloseHandle。
+	DestroyKey(handle KeyHandle) error
+
+	// Close 关闭会话并销毁会话内的全部会话密钥。对应 SDF_CloseSession / SKF_CloseApplication。
+	Close() error
+}
+
+// Agreement 是一次进行中的 SM2 密钥协商，定义于 GM/T 0003.3-2012 第 6 节。
+//
+// Agreement.GenerateKey 对应 SDF_GenerateKeyWithECC / SKF_GenerateKeyWithECC。协商结果直接返回给调用方，
+// 因为 TLCP 需要用它作为 pre_master_secret 计算主密钥。
+type Agreement = gmtls.SM2Agreement
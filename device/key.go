@@ -0,0 +1,134 @@
+package device
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/pem"
+	"errors"
+	"io"
+
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/x509"
+
+	"github.com/nnnewb/gmtls"
+)
+
+// PrivateKey 是保存在密码设备内部的 SM2 私钥的引用。
+//
+// 签名私钥实现了 crypto.Signer，加密私钥实现了 crypto.Decrypter，可以直接作为 gmtls.Certificate 的 PrivateKey 使用。
+// 私钥本身不会离开设备，所有私钥运算都通过 Session 完成。
+type PrivateKey struct {
+	session Session
+	index   KeyIndex
+	sign    bool
+	pub     *sm2.PublicKey
+}
+
+// NewSignKey 返回 index 指定的签名私钥的引用。
+// 调用方需要事先通过 Session.GetPrivateKeyAccessRight 获取私钥使用权限。
+func NewSignKey(session Session, index KeyIndex) (*PrivateKey, error) {
+	pub, err := session.ExportSignPublicKey(index)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{session: session, index: index, sign: true, pub: pub}, nil
+}
+
+// NewEncKey 返回 index 指定的加密私钥的引用。
+// 调用方需要事先通过 Session.GetPrivateKeyAccessRight 获取私钥使用权限。
+func NewEncKey(session Session, index KeyIndex) (*PrivateKey, error) {
+	pub, err := session.ExportEncPublicKey(index)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{session: session, index: index, sign: false, pub: pub}, nil
+}
+
+// Index 返回私钥在设备中的索引号。
+func (k *PrivateKey) Index() KeyIndex {
+	return k.index
+}
+
+// Public 返回与私钥对应的公钥。
+func (k *PrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign 使用设备内部的签名私钥对 msg 签名，返回 ASN.1 DER 编码的签名值。
+//
+// 与 sm2.PrivateKey.Sign 相同，msg 是待签名的原始消息而不是杂凑值，Sign 会先计算 SM3(Z || msg)，
+// 再把杂凑值交给设备签名。如果 opts 是 *gmtls.SM2SignerOpts，使用其中的用户标识计算 Z 值，否则使用默认的用户标识。
+// 参数 rand 被忽略，随机数由设备产生。
+func (k *PrivateKey) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if !k.sign {
+		return nil, errors.New("device: encryption key can not be used for signing")
+	}
+	var uid []byte
+	if o, ok := opts.(*gmtls.SM2SignerOpts); ok {
+		uid = o.UID
+	}
+	digest, err := k.pub.Sm3Digest(msg, uid)
+	if err != nil {
+		return nil, err
+	}
+	return k.session.InternalSign(k.index, digest)
+}
+
+// Decrypt 使用设备内部的加密私钥解密 GM/T 0009 ASN.1 编码的 SM2 密文。
+// 参数 rand 和 opts 被忽略。
+func (k *PrivateKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if k.sign {
+		return nil, errors.New("device: signing key can not be used for decryption")
+	}
+	return k.session.InternalDecrypt(k.index, ciphertext)
+}
+
+// GenerateAgreementData 使用设备内部的加密密钥对发起一次 SM2 密钥协商。见 Session.GenerateAgreementData。
+func (k *PrivateKey) GenerateAgreementData(sponsor bool, id []byte) (Agreement, error) {
+	if k.sign {
+		return nil, errors.New("device: signing key can not be used for key agreement")
+	}
+	return k.session.GenerateAgreementData(k.index, sponsor, id)
+}
+
+// X509KeyPair 把 PEM 编码的证书链与设备内部的私钥绑定为 gmtls.Certificate。
+//
+// certPEMBlock 中的第一个证书是叶证书，它的公钥必须与 key 对应。
+func X509KeyPair(certPEMBlock []byte, key *PrivateKey) (gmtls.Certificate, error) {
+	var cert gmtls.Certificate
+	for {
+		var block *pem.Block
+		block, certPEMBlock = pem.Decode(certPEMBlock)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return gmtls.Certificate{}, errors.New("device: failed to find any PEM data in certificate input")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return gmtls.Certificate{}, err
+	}
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != sm2.P256Sm2() {
+		return gmtls.Certificate{}, errors.New("device: certificate public key is not a SM2 public key")
+	}
+	if pub.X.Cmp(key.pub.X) != 0 || pub.Y.Cmp(key.pub.Y) != 0 {
+		return gmtls.Certificate{}, errors.New("device: private key does not match public key")
+	}
+
+	cert.PrivateKey = key
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+var (
+	_ crypto.Signer         = (*PrivateKey)(nil)
+	_ crypto.Decrypter      = (*PrivateKey)(nil)
+	_ gmtls.SM2KeyAgreement = (*PrivateKey)(nil)
+)
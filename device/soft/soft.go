@@ -0,0 +1,349 @@
+// Package soft 是 device 包接口的纯软件实现。
+//
+// 模拟设备的私钥以明文形式保存在内存中，不具备任何物理防护能力，只能用于测试和开发，不能用于生产环境。
+package soft
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/sm4"
+
+	"github.com/nnnewb/gmtls/device"
+)
+
+// defaultUID 是 GM/T 0009-2012 第 10 节规定的默认用户标识。
+var defaultUID = []byte("1234567812345678")
+
+type keyPair struct {
+	sign     *sm2.PrivateKey
+	enc      *sm2.PrivateKey
+	password []byte
+}
+
+// Device 是模拟的密码设备。零值不可用，使用 New 创建。
+type Device struct {
+	mu     sync.Mutex
+	keys   map[device.KeyIndex]*keyPair
+	closed bool
+}
+
+var _ device.Device = (*Device)(nil)
+
+// New 创建一个不包含任何密钥的模拟设备。
+func New() *Device {
+	return &Device{keys: make(map[device.KeyIndex]*keyPair)}
+}
+
+// GenerateKeyPair 在 index 位置生成一对签名密钥和一对加密密钥，使用 password 保护私钥使用权限。
+func (d *Device) GenerateKeyPair(index device.KeyIndex, password []byte) error {
+	sign, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	enc, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	return d.ImportKeyPair(index, sign, enc, password)
+}
+
+// ImportKeyPair 把签名私钥 sign 和加密私钥 enc 导入到 index 位置，使用 password 保护私钥使用权限。
+func (d *Device) ImportKeyPair(index device.KeyIndex, sign, enc *sm2.PrivateKey, password []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errors.New("soft: device closed")
+	}
+	d.keys[index] = &keyPair{sign: sign, enc: enc, password: bytes.Clone(password)}
+	return nil
+}
+
+// OpenSession 实现 device.Device。
+func (d *Device) OpenSession() (device.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errors.New("soft: device closed")
+	}
+	return &session{
+		dev:     d,
+		granted: make(map[device.KeyIndex]bool),
+		keys:    make(map[device.KeyHandle]cipher.Block),
+	}, nil
+}
+
+// Close 实现 device.Device。
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	return nil
+}
+
+func (d *Device) keyPair(index device.KeyIndex) (*keyPair, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kp, ok := d.keys[index]
+	if !ok {
+		return nil, device.ErrKeyNotFound
+	}
+	return kp, nil
+}
+
+type session struct {
+	dev *Device
+
+	mu         sync.Mutex
+	closed     bool
+	granted    map[device.KeyIndex]bool
+	keys       map[device.KeyHandle]cipher.Block
+	nextHandle device.KeyHandle
+}
+
+func (s *session) GetPrivateKeyAccessRight(index device.KeyIndex, password []byte) error {
+	kp, err := s.dev.keyPair(index)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(kp.password, password) {
+		return device.ErrAccessDenied
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return device.ErrSessionClosed
+	}
+	s.granted[index] = true
+	return nil
+}
+
+func (s *session) ReleasePrivateKeyAccessRight(index device.KeyIndex) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return device.ErrSessionClosed
+	}
+	delete(s.granted, index)
+	return nil
+}
+
+func (s *session) ExportSignPublicKey(index device.KeyIndex) (*sm2.PublicKey, error) {
+	kp, err := s.dev.keyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	return &kp.sign.PublicKey, nil
+}
+
+func (s *session) ExportEncPublicKey(index device.KeyIndex) (*sm2.PublicKey, error) {
+	kp, err := s.dev.keyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	return &kp.enc.PublicKey, nil
+}
+
+// privateKeyPair 返回已获得使用权限的密钥对。
+func (s *session) privateKeyPair(index device.KeyIndex) (*keyPair, error) {
+	s.mu.Lock()
+	closed, granted := s.closed, s.granted[index]
+	s.mu.Unlock()
+	if closed {
+		return nil, device.ErrSessionClosed
+	}
+	kp, err := s.dev.keyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	if !granted {
+		return nil, device.ErrAccessDenied
+	}
+	return kp, nil
+}
+
+func (s *session) InternalSign(index device.KeyIndex, digest []byte) ([]byte, error) {
+	kp, err := s.privateKeyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	r, ss, err := signDigest(kp.sign, digest)
+	if err != nil {
+		return nil, err
+	}
+	return sm2.SignDigitToSignData(r, ss)
+}
+
+func (s *session) InternalDecrypt(index device.KeyIndex, ciphertext []byte) ([]byte, error) {
+	kp, err := s.privateKeyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	return sm2.DecryptAsn1(kp.enc, ciphertext)
+}
+
+func (s *session) GenerateAgreementData(index device.KeyIndex, sponsor bool, id []byte) (device.Agreement, error) {
+	kp, err := s.privateKeyPair(index)
+	if err != nil {
+		return nil, err
+	}
+	temp, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		id = defaultUID
+	}
+	return &agreement{key: kp.enc, temp: temp, sponsor: sponsor, id: bytes.Clone(id)}, nil
+}
+
+func (s *session) ImportKey(key []byte) (device.KeyHandle, error) {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, device.ErrSessionClosed
+	}
+	s.nextHandle++
+	s.keys[s.nextHandle] = block
+	return s.nextHandle, nil
+}
+
+func (s *session) ImportKeyWithISK(index device.KeyIndex, ciphertext []byte) (device.KeyHandle, error) {
+	key, err := s.InternalDecrypt(index, ciphertext)
+	if err != nil {
+		return 0, err
+	}
+	return s.ImportKey(key)
+}
+
+func (s *session) block(handle device.KeyHandle) (cipher.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, device.ErrSessionClosed
+	}
+	block, ok := s.keys[handle]
+	if !ok {
+		return nil, device.ErrInvalidHandle
+	}
+	return block, nil
+}
+
+func (s *session) Encrypt(handle device.KeyHandle, iv, src []byte) ([]byte, error) {
+	block, err := s.block(handle)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(src)%block.BlockSize() != 0 {
+		return nil, errors.New("soft: input not full blocks")
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(dst, src)
+	return dst, nil
+}
+
+func (s *session) Decrypt(handle device.KeyHandle, iv, src []byte) ([]byte, error) {
+	block, err := s.block(handle)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(src)%block.BlockSize() != 0 {
+		return nil, errors.New("soft: input not full blocks")
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(dst, src)
+	return dst, nil
+}
+
+func (s *session) DestroyKey(handle device.KeyHandle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return device.ErrSessionClosed
+	}
+	if _, ok := s.keys[handle]; !ok {
+		return device.ErrInvalidHandle
+	}
+	delete(s.keys, handle)
+	return nil
+}
+
+func (s *session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.granted = nil
+	s.keys = nil
+	return nil
+}
+
+type agreement struct {
+	key     *sm2.PrivateKey
+	temp    *sm2.PrivateKey
+	sponsor bool
+	id      []byte
+}
+
+func (a *agreement) TempPublicKey() *sm2.PublicKey {
+	return &a.temp.PublicKey
+}
+
+func (a *agreement) GenerateKey(peerID []byte, peerPub, peerTempPub *sm2.PublicKey, length int) ([]byte, error) {
+	if len(peerID) == 0 {
+		peerID = defaultUID
+	}
+	var k []byte
+	var err error
+	if a.sponsor {
+		k, _, _, err = sm2.KeyExchangeA(length, a.id, peerID, a.key, peerPub, a.temp, peerTempPub)
+	} else {
+		k, _, _, err = sm2.KeyExchangeB(length, peerID, a.id, a.key, peerPub, a.temp, peerTempPub)
+	}
+	return k, err
+}
+
+// signDigest 使用私钥 priv 对杂凑值 digest 做 SM2 签名，定义于 GM/T 0003.2-2012 第 6.1 节。
+//
+// sm2 包只提供对原始消息签名的函数，密码设备的签名接口输入的是杂凑值，因此在这里单独实现。
+func signDigest(priv *sm2.PrivateKey, digest []byte) (r, s *big.Int, err error) {
+	curve := priv.Curve
+	n := curve.Params().N
+	e := new(big.Int).SetBytes(digest)
+	one := big.NewInt(1)
+
+	for {
+		k, err := rand.Int(rand.Reader, new(big.Int).Sub(n, one))
+		if err != nil {
+			return nil, nil, err
+		}
+		k.Add(k, one)
+
+		x1, _ := curve.ScalarBaseMult(k.Bytes())
+		r = new(big.Int).Add(e, x1)
+		r.Mod(r, n)
+		if r.Sign() == 0 || new(big.Int).Add(r, k).Cmp(n) == 0 {
+			continue
+		}
+
+		d1Inv := new(big.Int).Add(priv.D, one)
+		d1Inv.ModInverse(d1Inv, n)
+		s = new(big.Int).Mul(r, priv.D)
+		s.Sub(k, s)
+		s.Mul(s, d1Inv)
+		s.Mod(s, n)
+		if s.Sign() != 0 {
+			return r, s, nil
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package soft_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/x509"
+
+	"github.com/nnnewb/gmtls"
+	"github.com/nnnewb/gmtls/device"
+	"github.com/nnnewb/gmtls/device/soft"
+)
+
+func openSession(t *testing.T, index device.KeyIndex) device.Session {
+	dev := soft.New()
+	require.NoError(t, dev.GenerateKeyPair(index, []byte("123456")))
+	s, err := dev.OpenSession()
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close(); dev.Close() })
+	return s
+}
+
+func TestPrivateKey_Sign(t *testing.T) {
+	s := openSession(t, 1)
+	key, err := device.NewSignKey(s, 1)
+	require.NoError(t, err)
+
+	_, err = key.Sign(rand.Reader, []byte("message"), nil)
+	assert.ErrorIs(t, err, device.ErrAccessDenied)
+
+	require.NoError(t, s.GetPrivateKeyAccessRight(1, []byte("123456")))
+	sig, err := key.Sign(rand.Reader, []byte("message"), nil)
+	require.NoError(t, err)
+	assert.True(t, key.Public().(*sm2.PublicKey).Verify([]byte("message"), sig))
+	assert.False(t, key.Public().(*sm2.PublicKey).Verify([]byte("other message"), sig))
+
+	uid := []byte("alice@example.com")
+	sig, err = key.Sign(rand.Reader, []byte("message"), &gmtls.SM2SignerOpts{UID: uid})
+	require.NoError(t, err)
+	r, ss, err := sm2.SignDataToSignDigit(sig)
+	require.NoError(t, err)
+	assert.True(t, sm2.Sm2Verify(key.Public().(*sm2.PublicKey), []byte("message"), uid, r, ss))
+	assert.False(t, key.Public().(*sm2.PublicKey).Verify([]byte("message"), sig))
+}
+
+func TestPrivateKey_Decrypt(t *testing.T) {
+	s := openSession(t, 1)
+	require.NoError(t, s.GetPrivateKeyAccessRight(1, []byte("123456")))
+	key, err := device.NewEncKey(s, 1)
+	require.NoError(t, err)
+
+	ciphertext, err := sm2.EncryptAsn1(key.Public().(*sm2.PublicKey), []byte("pre master secret"), rand.Reader)
+	require.NoError(t, err)
+	plaintext, err := key.Decrypt(rand.Reader, ciphertext, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pre master secret"), plaintext)
+
+	_, err = key.Sign(rand.Reader, []byte("message"), nil)
+	assert.Error(t, err)
+}
+
+func TestSession_Agreement(t *testing.T) {
+	sa := openSession(t, 1)
+	sb := openSession(t, 2)
+	require.NoError(t, sa.GetPrivateKeyAccessRight(1, []byte("123456")))
+	require.NoError(t, sb.GetPrivateKeyAccessRight(2, []byte("123456")))
+
+	pubA, err := sa.ExportEncPublicKey(1)
+	require.NoError(t, err)
+	pubB, err := sb.ExportEncPublicKey(2)
+	require.NoError(t, err)
+
+	a, err := sa.GenerateAgreementData(1, true, []byte("client"))
+	require.NoError(t, err)
+	b, err := sb.GenerateAgreementData(2, false, []byte("server"))
+	require.NoError(t, err)
+
+	ka, err := a.GenerateKey([]byte("server"), pubB, b.TempPublicKey(), 48)
+	require.NoError(t, err)
+	kb, err := b.GenerateKey([]byte("client"), pubA, a.TempPublicKey(), 48)
+	require.NoError(t, err)
+	assert.Len(t, ka, 48)
+	assert.Equal(t, ka, kb)
+}
+
+func TestSession_ImportKey(t *testing.T) {
+	s := openSession(t, 1)
+	require.NoError(t, s.GetPrivateKeyAccessRight(1, []byte("123456")))
+	pub, err := s.ExportEncPublicKey(1)
+	require.NoError(t, err)
+
+	key := bytes.Repeat([]byte{0x42}, 16)
+	iv := make([]byte, 16)
+	wrapped, err := sm2.EncryptAsn1(pub, key, rand.Reader)
+	require.NoError(t, err)
+
+	h1, err := s.ImportKey(key)
+	require.NoError(t, err)
+	h2, err := s.ImportKeyWithISK(1, wrapped)
+	require.NoError(t, err)
+
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	c1, err := s.Encrypt(h1, iv, plaintext)
+	require.NoError(t, err)
+	c2, err := s.Encrypt(h2, iv, plaintext)
+	require.NoError(t, err)
+	assert.Equal(t, c1, c2)
+
+	p, err := s.Decrypt(h2, iv, c1)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, p)
+
+	require.NoError(t, s.DestroyKey(h1))
+	_, err = s.Encrypt(h1, iv, plaintext)
+	assert.ErrorIs(t, err, device.ErrInvalidHandle)
+}
+
+func TestX509KeyPair(t *testing.T) {
+	s := openSession(t, 1)
+	require.NoError(t, s.GetPrivateKeyAccessRight(1, []byte("123456")))
+	key, err := device.NewSignKey(s, 1)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		SignatureAlgorithm: x509.SM2WithSM3,
+	}
+	template.Subject.CommonName = "device"
+	certPEM, err := x509.CreateCertificateToPem(template, template, key.Public().(*sm2.PublicKey), key)
+	require.NoError(t, err)
+
+	cert, err := device.X509KeyPair(certPEM, key)
+	require.NoError(t, err)
+	assert.Same(t, key, cert.PrivateKey)
+	require.NoError(t, cert.Leaf.CheckSignature(cert.Leaf.SignatureAlgorithm, cert.Leaf.RawTBSCertificate, cert.Leaf.Signature))
+
+	other, err := device.NewEncKey(s, 1)
+	require.NoError(t, err)
+	_, err = device.X509KeyPair(certPEM, other)
+	assert.Error(t, err)
+}
+
+// deviceCertificates 在设备的 index 位置生成密钥对，并用 root 签发签名证书和加密证书。
+func deviceCertificates(t *testing.T, root *x509.Certificate, rootKey *sm2.PrivateKey, index device.KeyIndex, cn string) (sign, enc gmtls.Certificate) {
+	s := openSession(t, index)
+	require.NoError(t, s.GetPrivateKeyAccessRight(index, []byte("123456")))
+
+	issue := func(key *device.PrivateKey, serial int64, usage x509.KeyUsage) gmtls.Certificate {
+		template := &x509.Certificate{
+			SerialNumber:       big.NewInt(serial),
+			DNSNames:           []string{cn},
+			NotBefore:          time.Now().Add(-time.Hour),
+			NotAfter:           time.Now().Add(time.Hour),
+			KeyUsage:           usage,
+			ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			SignatureAlgorithm: x509.SM2WithSM3,
+		}
+		template.Subject.CommonName = cn
+		certPEM, err := x509.CreateCertificateToPem(template, root, key.Public().(*sm2.PublicKey), rootKey)
+		require.NoError(t, err)
+		cert, err := device.X509KeyPair(certPEM, key)
+		require.NoError(t, err)
+		return cert
+	}
+
+	signKey, err := device.NewSignKey(s, index)
+	require.NoError(t, err)
+	encKey, err := device.NewEncKey(s, index)
+	require.NoError(t, err)
+	sign = issue(signKey, int64(index)*2, x509.KeyUsageDigitalSignature)
+	enc = issue(encKey, int64(index)*2+1, x509.KeyUsageKeyEncipherment|x509.KeyUsageKeyAgreement)
+	return sign, enc
+}
+
+// TestHandshake 使用模拟设备中的私钥完成握手，覆盖签名、ECC 解密和 ECDHE 密钥协商。
+func TestHandshake(t *testing.T) {
+	rootKey, err := sm2.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.SM2WithSM3,
+	}
+	rootTemplate.Subject.CommonName = "device root"
+	rootDER, err := x509.CreateCertificate(rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+
+	serverSign, serverEnc := deviceCertificates(t, root, rootKey, 1, "server.example")
+	clientSign, clientEnc := deviceCertificates(t, root, rootKey, 2, "client.example")
+
+	for _, suite := range []gmtls.CipherSuite{gmtls.CipherSuite_ECC_SM4_SM3, gmtls.CipherSuite_ECDHE_SM4_SM3} {
+		t.Run(suite.String(), func(t *testing.T) {
+			serverConfig := &gmtls.Config{
+				Certificates: []gmtls.Certificate{serverSign, serverEnc},
+				ClientCAs:    pool,
+				ClientAuth:   gmtls.RequireAndVerifyClientCert,
+			}
+			clientConfig := &gmtls.Config{
+				Certificates: []gmtls.Certificate{clientSign, clientEnc},
+				CipherSuites: []gmtls.CipherSuite{suite},
+				RootCAs:      pool,
+				ServerName:   "server.example",
+			}
+
+			ln, err := gmtls.Listen("tcp", "127.0.0.1:0", serverConfig)
+			require.NoError(t, err)
+			defer ln.Close()
+			errc := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					errc <- err
+					return
+				}
+				defer conn.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					errc <- err
+					return
+				}
+				_, err = conn.Write(bytes.ToUpper(buf))
+				errc <- err
+			}()
+
+			conn, err := gmtls.Dial("tcp", ln.Addr().String(), clientConfig)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "HELLO", string(buf))
+			require.NoError(t, <-errc)
+			assert.Equal(t, uint16(suite), conn.ConnectionState().CipherSuite)
+		})
+	}
+}
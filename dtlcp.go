@@ -0,0 +1,894 @@
+package gmtls
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// VersionDTLCP11 是 DTLCP 记录层使用的协议版本号。握手消息中的版本号仍然是 VersionTLCP11。
+const VersionDTLCP11 = common.VersionDTLCP11
+
+const (
+	dtlcpDefaultMTU    = 1200
+	dtlcpMinMTU        = 256          // Config.MTU 的最小值，保证握手消息的每个分片能携带足够的数据
+	dtlcpMaxOverhead   = 16 + 32 + 16 // 保护一个记录最多增加的长度：IV、MAC 和填充
+	dtlcpMaxDatagram   = 1 << 16
+	dtlcpMaxHVR        = 5  // 客户端最多接受的 HelloVerifyRequest 数量
+	dtlcpMaxReassembly = 16 // 最多缓存的尚未按顺序到达的握手消息数量
+	dtlcpMaxPending    = 16 // 最多缓存的下一个 epoch 的记录数量
+)
+
+var (
+	// dtlcpInitialTimeout 和 dtlcpMaxTimeout 是握手重传定时器的初始值和最大值，定义于 RFC 6347 第 4.2.4.1 节。
+	// 每次超时后定时器加倍，超过最大值时握手失败。
+	dtlcpInitialTimeout = time.Second
+	dtlcpMaxTimeout     = 60 * time.Second
+)
+
+var errDTLCPHandshakeTimeout = errors.New("tls: DTLCP handshake timed out waiting for the peer")
+
+// DTLCPConn 是基于数据报的 TLCP 连接（DTLCP），实现了 net.Conn。
+//
+// DTLCP 参照 DTLS 1.2（RFC 6347）在 TLCP 上增加了数据报传输需要的机制：记录头部携带 epoch 和序列号，
+// 握手消息分片发送并在接收方重组，握手消息丢失时按照加倍的定时器重传，服务端用 cookie 验证客户端地址，
+// 接收方用滑动窗口丢弃重放的记录。记录保护和密钥交换与 TLCP 相同。
+//
+// 记录和握手消息的分片格式、HelloVerifyRequest 和 ClientHello 中的 cookie 字段、ChangeCipherSpec 之后 epoch 加一，都与 DTLS 1.2 相同。
+// GM/T 0024-2014 没有定义数据报传输，DTLCP 也没有公开的标准，与 DTLS 唯一的区别是握手消息的杂凑值按照 TLCP 的格式计算：
+// 不包含 message_seq 和分片字段，也不包含 cookie 字段。因此 DTLCP 只能与本包的实现互通。
+//
+// 底层连接的每次 Read 必须返回一个完整的数据报，每次 Write 发送一个数据报，例如已连接的 *net.UDPConn。
+// Write 的数据作为一个或多个记录发送，每个记录单独占用一个数据报；Read 每次最多返回一个记录中的应用数据。
+// 与 DTLS 相同，应用数据不保证可靠和有序交付。
+type DTLCPConn struct {
+	conn     net.Conn
+	config   *Config
+	isClient bool
+	cookies  *dtlcpCookieJar // 服务端验证客户端地址使用的 cookie
+
+	// handshakeMutex 保护握手过程中的状态
+	handshakeMutex      sync.Mutex
+	handshakeErr        error
+	isHandshakeComplete atomic.Bool
+	hs                  *HandshakeConn
+	hvrCount            int    // 客户端收到的 HelloVerifyRequest 数量
+	cookie              []byte // 客户端在 ClientHello 中回送的 cookie
+	sendSeq             uint16 // 下一个发送的握手消息的 message_seq
+	recvSeq             uint16 // 下一个等待的握手消息的 message_seq
+	reassembly          map[uint16]*dtlcpMessage
+	pending             [][]byte      // 收到的下一个 epoch 的记录，读取密钥就绪后处理
+	flight              []dtlcpRecord // 最近发送的一组握手记录，超时后重传
+	newFlight           bool          // 处理收到的数据后是否发送了新的 flight
+	finalFlight         bool          // 握手以本端发送的 flight 结束，对方重传时需要再次发送
+	handshakeDone       bool          // HandshakeConn 报告握手完成
+
+	// readDeadline 是调用方设置的读取截止时间，握手期间底层连接的截止时间会被重传定时器临时覆盖
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+
+	in, out dtlcpHalfConn
+	buf     []byte   // 读取数据报的缓冲区，由 c.in 锁保护
+	input   [][]byte // 等待被 Read 读取的应用数据，由 c.in 锁保护
+
+	closeNotifySent bool // 由 c.out 锁保护
+}
+
+// dtlcpHalfConn 是 DTLCP 连接一个方向上的记录层状态。
+type dtlcpHalfConn struct {
+	sync.Mutex
+
+	err    error
+	epoch  uint16
+	states [2]dtlcpEpochState // epoch 0 和 epoch 1 的状态，DTLCP 不支持重新协商，因此只有两个 epoch
+	window dtlcpReplayWindow  // 读取方向当前 epoch 的重放窗口
+}
+
+// dtlcpEpochState 是一个 epoch 的记录保护状态和序列号。
+type dtlcpEpochState struct {
+	hc  halfConn // 密码算法和 MAC 算法，hc.seq 在处理每个记录前设置为 epoch 和序列号
+	seq uint64   // 写入方向下一个记录的序列号
+}
+
+// dtlcpRecord 是一个等待发送的记录。重传时使用新的序列号重新保护。
+type dtlcpRecord struct {
+	epoch   uint16
+	typ     fragment.TLSFragmentContentType
+	payload []byte
+}
+
+// dtlcpMessage 是正在重组的握手消息。
+type dtlcpMessage struct {
+	typ       handshaking.HandshakeType
+	level     EncryptionLevel
+	body      []byte
+	have      []bool
+	remaining int
+}
+
+// dtlcpReplayWindow 是接收方的重放窗口，定义于 RFC 6347 第 4.1.2.6 节。
+// 记录窗口内最大的序列号和它之前 64 个序列号是否已经收到。
+type dtlcpReplayWindow struct {
+	latest uint64
+	bitmap uint64
+	init   bool
+}
+
+// check 返回序列号为 seq 的记录是否可以接受：比窗口内最大的序列号大，或者在窗口内且没有收到过。
+func (w *dtlcpReplayWindow) check(seq uint64) bool {
+	if !w.init || seq > w.latest {
+		return true
+	}
+	diff := w.latest - seq
+	return diff < 64 && w.bitmap&(1<<diff) == 0
+}
+
+// update 记录已经通过校验的记录。
+func (w *dtlcpReplayWindow) update(seq uint64) {
+	switch {
+	case !w.init:
+		w.init = true
+		w.latest = seq
+		w.bitmap = 1
+	case seq > w.latest:
+		shift := seq - w.latest
+		if shift >= 64 {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.latest = seq
+	default:
+		w.bitmap |= 1 << (w.latest - seq)
+	}
+}
+
+// DTLCPClient 使用 conn 作为底层数据报传输，返回一个新的 DTLCP 客户端连接。
+// 配置 config 不能为 nil：必须设置 ServerName 或 InsecureSkipVerify 之一。
+func DTLCPClient(conn net.Conn, config *Config) *DTLCPConn {
+	return newDTLCPConn(conn, config, true, nil)
+}
+
+// DTLCPServer 使用 conn 作为底层数据报传输，返回一个新的 DTLCP 服务端连接。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+//
+// 需要在一个 net.PacketConn 上接受多个客户端时使用 ListenDTLCP 或 NewDTLCPListener。
+func DTLCPServer(conn net.Conn, config *Config) *DTLCPConn {
+	return newDTLCPConn(conn, config, false, newDTLCPCookieJar(config))
+}
+
+func newDTLCPConn(conn net.Conn, config *Config, isClient bool, cookies *dtlcpCookieJar) *DTLCPConn {
+	c := &DTLCPConn{
+		conn:       conn,
+		config:     config,
+		isClient:   isClient,
+		cookies:    cookies,
+		reassembly: make(map[uint16]*dtlcpMessage),
+		buf:        make([]byte, dtlcpMaxDatagram),
+	}
+	for _, hc := range []*dtlcpHalfConn{&c.in, &c.out} {
+		for i := range hc.states {
+			hc.states[i].hc.version = VersionDTLCP11
+		}
+	}
+	return c
+}
+
+// DialDTLCP 使用 net.Dial 连接到指定的网络地址（通常是 "udp"），然后进行 DTLCP 握手。
+// config 为 nil 时等价于零值配置。如果没有设置 ServerName，使用 addr 中的主机名。
+func DialDTLCP(network, addr string, config *Config) (*DTLCPConn, error) {
+	rawConn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := DTLCPClient(rawConn, withServerName(config, addr))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *DTLCPConn) mtu() int {
+	if c.config.MTU > 0 {
+		return c.config.MTU
+	}
+	return dtlcpDefaultMTU
+}
+
+// Handshake 执行 DTLCP 握手（如果还没有执行）。第一次 Read 或 Write 会自动调用它。
+func (c *DTLCPConn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext 执行 DTLCP 握手（如果还没有执行）。ctx 在握手完成前结束时握手失败并返回 ctx.Err()。
+//
+// 服务端连接的 Config.HandshakeTimeout 不为零时，握手的截止时间不晚于开始握手之后的 HandshakeTimeout。
+func (c *DTLCPConn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if err := c.handshakeErr; err != nil {
+		return err
+	}
+	if c.isHandshakeComplete.Load() {
+		return nil
+	}
+
+	if !c.isClient && c.config.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.HandshakeTimeout)
+		defer cancel()
+	}
+
+	// ctx 结束时设置一个已经过去的截止时间，让阻塞的读取立即返回
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		c.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+
+	c.in.Lock()
+	c.handshakeErr = c.handshake(ctx)
+	c.in.Unlock()
+
+	if !stop() {
+		<-interrupted
+	}
+	c.conn.SetReadDeadline(c.userReadDeadline())
+
+	if c.handshakeErr != nil {
+		if c.hs != nil {
+			c.hs.Close()
+		}
+		return c.handshakeErr
+	}
+	c.isHandshakeComplete.Store(true)
+	return nil
+}
+
+// handshake 驱动 HandshakeConn 完成握手，负责握手消息的收发和重传。调用方必须持有 c.handshakeMutex 和 c.in 锁。
+func (c *DTLCPConn) handshake(ctx context.Context) error {
+	if c.isClient {
+		if err := c.startHandshake(ctx, nil); err != nil {
+			return err
+		}
+	}
+
+	timeout := dtlcpInitialTimeout
+	timer := time.Now().Add(timeout)
+	for !c.handshakeDone {
+		deadline := timer
+		userDeadline := c.userReadDeadline()
+		if !userDeadline.IsZero() && userDeadline.Before(deadline) {
+			deadline = userDeadline
+		}
+		c.conn.SetReadDeadline(deadline)
+		// 必须在设置截止时间之后检查 ctx，否则可能覆盖 ctx 结束时设置的截止时间
+		if err := ctx.Err(); err != nil {
+			c.sendAlert(AlertUserCanceled)
+			return err
+		}
+
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.sendAlert(AlertUserCanceled)
+				return ctx.Err()
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() || deadline.Equal(userDeadline) {
+				return err
+			}
+			// 重传定时器超时
+			if timeout >= dtlcpMaxTimeout {
+				return errDTLCPHandshakeTimeout
+			}
+			timeout = min(2*timeout, dtlcpMaxTimeout)
+			timer = time.Now().Add(timeout)
+			if err := c.sendFlight(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		c.newFlight = false
+		if err := c.handleDatagram(ctx, c.buf[:n]); err != nil {
+			return err
+		}
+		if c.newFlight {
+			timeout = dtlcpInitialTimeout
+			timer = time.Now().Add(timeout)
+		}
+	}
+	return nil
+}
+
+// startHandshake 开始一次新的握手。客户端收到 HelloVerifyRequest 后会用 cookie 重新开始握手。
+func (c *DTLCPConn) startHandshake(ctx context.Context, cookie []byte) error {
+	if c.hs != nil {
+		c.hs.Close()
+	}
+	if c.isClient {
+		c.hs = HandshakeClient(c.config)
+		c.cookie = cookie
+	} else {
+		c.hs = HandshakeServer(c.config)
+	}
+	if err := c.hs.Start(ctx); err != nil {
+		return err
+	}
+	return c.processEvents()
+}
+
+// processEvents 处理 HandshakeConn 产生的事件，把需要发送的握手消息组成新的 flight 发送出去。
+func (c *DTLCPConn) processEvents() error {
+	var flight []dtlcpRecord
+	for {
+		e := c.hs.NextEvent()
+		switch e.Kind {
+		case HandshakeNoEvent:
+			if len(flight) > 0 {
+				c.flight = flight
+				c.newFlight = true
+				c.finalFlight = c.handshakeDone
+				return c.sendFlight()
+			}
+			return nil
+		case HandshakeWriteData:
+			var err error
+			if flight, err = c.appendHandshakeRecords(flight, e.Level, e.Data); err != nil {
+				return err
+			}
+		case HandshakeSetWriteKeys:
+			// 与 DTLS 相同，用当前 epoch 的 ChangeCipherSpec 记录通知对方之后的记录使用下一个 epoch
+			flight = append(flight, dtlcpRecord{epoch: c.out.epoch, typ: fragment.ContentTypeChangeCipherSpec, payload: []byte{1}})
+			if err := c.setKeys(&c.out, e.Keys); err != nil {
+				return err
+			}
+		case HandshakeSetReadKeys:
+			if err := c.setKeys(&c.in, e.Keys); err != nil {
+				return err
+			}
+		case HandshakeDone:
+			c.handshakeDone = true
+		}
+	}
+}
+
+// setKeys 设置下一个 epoch 使用 keys 保护记录。读取方向调用时调用方已经持有 c.in 锁。
+//
+// 写入方向立即切换到下一个 epoch；读取方向在收到对方的 ChangeCipherSpec 之后才切换，见 changeReadEpoch。
+func (c *DTLCPConn) setKeys(hc *dtlcpHalfConn, keys TrafficKeys) error {
+	suite := cipherSuiteByID(CipherSuite(keys.CipherSuite))
+	if suite == nil || hc.epoch != 0 || hc.states[1].hc.cipher != nil {
+		return errors.New("tls: internal error: unexpected DTLCP key change")
+	}
+	state := &hc.states[1]
+	if hc == &c.out {
+		hc.Lock()
+		defer hc.Unlock()
+		hc.epoch = 1
+	}
+	state.hc.cipher = suite.cipher(keys.Key)
+	state.hc.mac = suite.mac(keys.MACKey)
+	return nil
+}
+
+// changeReadEpoch 在收到 ChangeCipherSpec 后把读取方向切换到下一个 epoch。调用方必须持有 c.in 锁。
+//
+// 读取密钥还没有就绪时（对方的 ChangeCipherSpec 先于之前的握手消息到达）丢弃 ChangeCipherSpec，对方会重传整个 flight。
+func (c *DTLCPConn) changeReadEpoch(payload []byte) {
+	if len(payload) != 1 || payload[0] != 1 || c.in.epoch != 0 || c.in.states[1].hc.cipher == nil {
+		return
+	}
+	c.in.epoch = 1
+	c.in.window = dtlcpReplayWindow{}
+}
+
+// appendHandshakeRecords 把 data 中的握手消息转换为 DTLCP 的分片格式，追加到 flight 之后。
+// 客户端的 ClientHello 会加入 cookie 字段。
+func (c *DTLCPConn) appendHandshakeRecords(flight []dtlcpRecord, level EncryptionLevel, data []byte) ([]dtlcpRecord, error) {
+	var epoch uint16
+	if level == EncryptionLevelApplication {
+		epoch = 1
+	}
+
+	maxFragment := c.mtu() - fragment.DatagramHeaderLength - dtlcpMaxOverhead - handshaking.FragmentHeaderLength
+	maxFragment = max(maxFragment, 1)
+
+	for len(data) >= handshaking.HeaderLength {
+		typ, n := handshaking.ParseHeader(data)
+		body := data[handshaking.HeaderLength : handshaking.HeaderLength+int(n)]
+		data = data[handshaking.HeaderLength+int(n):]
+		if c.isClient && typ == handshaking.HandshakeTypeClientHello {
+			var err error
+			if body, err = handshaking.AddClientHelloCookie(body, c.cookie); err != nil {
+				return nil, err
+			}
+			n = handshaking.Uint24(len(body))
+		}
+
+		seq := c.sendSeq
+		c.sendSeq++
+		offset := 0
+		for {
+			m := min(len(body)-offset, maxFragment)
+			h := handshaking.FragmentHeader{
+				MessageType:    typ,
+				Length:         n,
+				MessageSeq:     seq,
+				FragmentOffset: handshaking.Uint24(offset),
+				FragmentLength: handshaking.Uint24(m),
+			}
+			payload := append(h.Marshal(nil), body[offset:offset+m]...)
+			flight = append(flight, dtlcpRecord{epoch: epoch, typ: fragment.ContentTypeHandshake, payload: payload})
+			offset += m
+			if offset >= len(body) {
+				break
+			}
+		}
+	}
+	return flight, nil
+}
+
+// sendFlight 发送最近的 flight，尽量把多个记录放进同一个数据报。
+func (c *DTLCPConn) sendFlight() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	var datagram []byte
+	for _, rec := range c.flight {
+		record, err := c.sealRecordLocked(rec.epoch, rec.typ, rec.payload)
+		if err != nil {
+			return err
+		}
+		if len(datagram) > 0 && len(datagram)+len(record) > c.mtu() {
+			if _, err := c.conn.Write(datagram); err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		datagram = append(datagram, record...)
+	}
+	if len(datagram) > 0 {
+		if _, err := c.conn.Write(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealRecordLocked 使用 epoch 的状态保护 payload，返回完整的记录。调用方必须持有 c.out 锁。
+func (c *DTLCPConn) sealRecordLocked(epoch uint16, typ fragment.TLSFragmentContentType, payload []byte) ([]byte, error) {
+	state := &c.out.states[epoch]
+	if state.seq > fragment.MaxDatagramSequence {
+		return nil, errors.New("tls: DTLCP record sequence number exhausted")
+	}
+	h := fragment.DatagramHeader{Type: typ, Version: VersionDTLCP11, Epoch: epoch, Sequence: state.seq}
+	state.seq++
+
+	// halfConn 按照 TLCP 的 5 字节头部计算 MAC，MAC 覆盖的内容与 DTLS 相同：64 位序列号、类型、版本和长度
+	binary.BigEndian.PutUint64(state.hc.seq[:], h.SequenceNumber())
+	record, err := state.hc.encrypt([]byte{byte(typ), byte(h.Version >> 8), byte(h.Version), 0, 0}, payload, c.config.rand())
+	if err != nil {
+		return nil, err
+	}
+	body := record[recordHeaderLen:]
+	h.Length = uint16(len(body))
+	return append(h.Marshal(make([]byte, 0, fragment.DatagramHeaderLength+len(body))), body...), nil
+}
+
+// openRecordLocked 验证并解密记录，返回明文。调用方必须持有 c.in 锁。
+func (c *DTLCPConn) openRecordLocked(h fragment.DatagramHeader, body []byte) ([]byte, error) {
+	state := &c.in.states[h.Epoch]
+	binary.BigEndian.PutUint64(state.hc.seq[:], h.SequenceNumber())
+	record := append([]byte{byte(h.Type), byte(h.Version >> 8), byte(h.Version), byte(h.Length >> 8), byte(h.Length)}, body...)
+	payload, _, err := state.hc.decrypt(record)
+	return payload, err
+}
+
+// sendAlert 发送报警。致命报警之后不能再写入。
+func (c *DTLCPConn) sendAlert(desc AlertDescription) error {
+	c.out.Lock()
+	defer c.out.Unlock()
+	return c.sendAlertLocked(desc)
+}
+
+func (c *DTLCPConn) sendAlertLocked(desc AlertDescription) error {
+	if c.out.err != nil {
+		return c.out.err
+	}
+	msg := handshaking.AlertMessage{Level: desc.Level(), Description: desc}
+	record, err := c.sealRecordLocked(c.out.epoch, fragment.ContentTypeAlert, msg.Marshal())
+	if err == nil {
+		_, err = c.conn.Write(record)
+	}
+	if desc == AlertCloseNotify {
+		return err
+	}
+	c.out.err = &net.OpError{Op: "local error", Err: AlertError{Level: msg.Level, Description: desc}}
+	return c.out.err
+}
+
+// handleDatagram 处理收到的一个数据报。调用方必须持有 c.in 锁。
+//
+// 与 DTLS 相同，格式错误、无法验证或者重放的记录被直接丢弃，不会中止连接。
+func (c *DTLCPConn) handleDatagram(ctx context.Context, datagram []byte) error {
+	if !c.isClient && c.hs == nil {
+		// 服务端在开始握手前验证 ClientHello 中的 cookie
+		ok, hvr := c.cookies.verifyClientHello(datagram, c.conn.RemoteAddr())
+		if !ok {
+			if hvr != nil {
+				c.conn.Write(hvr)
+			}
+			return nil
+		}
+	}
+
+	for len(datagram) > 0 {
+		h, ok := fragment.ParseDatagramHeader(datagram)
+		if !ok || h.Version != VersionDTLCP11 || len(datagram) < fragment.DatagramHeaderLength+int(h.Length) {
+			return nil
+		}
+		record := datagram[:fragment.DatagramHeaderLength+int(h.Length)]
+		datagram = datagram[len(record):]
+
+		if err := c.handleRecord(ctx, h, record); err != nil {
+			return err
+		}
+	}
+
+	// 读取密钥就绪后处理之前缓存的记录
+	for c.in.epoch == 1 && len(c.pending) > 0 {
+		record := c.pending[0]
+		c.pending = c.pending[1:]
+		h, _ := fragment.ParseDatagramHeader(record)
+		if err := c.handleRecord(ctx, h, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleRecord 处理一个记录。调用方必须持有 c.in 锁。
+func (c *DTLCPConn) handleRecord(ctx context.Context, h fragment.DatagramHeader, record []byte) error {
+	switch {
+	case h.Epoch == c.in.epoch:
+	case h.Epoch == c.in.epoch+1 && h.Epoch < uint16(len(c.in.states)):
+		// 对方切换了密钥，本端还没有处理完之前的握手消息
+		if len(c.pending) < dtlcpMaxPending {
+			c.pending = append(c.pending, append([]byte(nil), record...))
+		}
+		return nil
+	case h.Epoch < c.in.epoch && h.Type == fragment.ContentTypeHandshake:
+		// 对方重传了上一个 epoch 的握手消息，说明它没有收到本端最后的 flight
+		return c.retransmitOnPeerRetransmission()
+	default:
+		return nil
+	}
+
+	if !c.in.window.check(h.Sequence) {
+		return nil
+	}
+	payload, err := c.openRecordLocked(h, record[fragment.DatagramHeaderLength:])
+	if err != nil {
+		return nil
+	}
+	c.in.window.update(h.Sequence)
+
+	switch h.Type {
+	case fragment.ContentTypeHandshake:
+		return c.handleHandshakeRecord(ctx, payload)
+	case fragment.ContentTypeChangeCipherSpec:
+		c.changeReadEpoch(payload)
+	case fragment.ContentTypeAlert:
+		var msg handshaking.AlertMessage
+		if err := msg.Unmarshal(payload); err != nil {
+			return nil
+		}
+		if msg.Description == AlertCloseNotify {
+			return c.in.setErrorLocked(errDTLCPCloseNotify)
+		}
+		if msg.Level == AlertLevelWarning && !msg.Description.IsFatal() {
+			return nil
+		}
+		return c.in.setErrorLocked(&net.OpError{Op: "remote error", Err: AlertError{Level: msg.Level, Description: msg.Description}})
+	case fragment.ContentTypeApplicationData:
+		// 握手完成前收到的应用数据被丢弃
+		if c.isHandshakeComplete.Load() && c.in.epoch == 1 && len(payload) > 0 {
+			c.input = append(c.input, payload)
+		}
+	}
+	return nil
+}
+
+var errDTLCPCloseNotify = errors.New("tls: DTLCP peer sent close_notify")
+
+// setErrorLocked 记录读取方向的永久性错误。
+func (hc *dtlcpHalfConn) setErrorLocked(err error) error {
+	hc.err = err
+	return err
+}
+
+// retransmitOnPeerRetransmission 在握手以本端的 flight 结束、而对方重传了它的 flight 时再次发送本端的 flight。
+// 握手过程中的重传由定时器负责。
+func (c *DTLCPConn) retransmitOnPeerRetransmission() error {
+	if c.handshakeDone && c.finalFlight {
+		return c.sendFlight()
+	}
+	return nil
+}
+
+// handleHandshakeRecord 处理握手记录中的分片，重组完整的握手消息并按顺序交给 HandshakeConn。
+func (c *DTLCPConn) handleHandshakeRecord(ctx context.Context, payload []byte) error {
+	level := EncryptionLevelInitial
+	if c.in.epoch == 1 {
+		level = EncryptionLevelApplication
+	}
+
+	for len(payload) > 0 {
+		h, ok := handshaking.ParseFragmentHeader(payload)
+		if !ok || len(payload) < handshaking.FragmentHeaderLength+int(h.FragmentLength) {
+			return nil
+		}
+		data := payload[handshaking.FragmentHeaderLength : handshaking.FragmentHeaderLength+int(h.FragmentLength)]
+		payload = payload[handshaking.FragmentHeaderLength+int(h.FragmentLength):]
+
+		if !c.isClient && c.hs == nil {
+			// 通过了 cookie 验证的 ClientHello 决定了双方 message_seq 的起点
+			if h.MessageType != handshaking.HandshakeTypeClientHello {
+				continue
+			}
+			c.recvSeq = h.MessageSeq
+			c.sendSeq = h.MessageSeq
+		}
+
+		if h.MessageSeq < c.recvSeq {
+			if err := c.retransmitOnPeerRetransmission(); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.MessageSeq >= c.recvSeq+dtlcpMaxReassembly || int(h.Length) > c.config.maxHandshakeSize(h.MessageType) {
+			continue
+		}
+
+		m := c.reassembly[h.MessageSeq]
+		if m == nil {
+			m = &dtlcpMessage{
+				typ:       h.MessageType,
+				level:     level,
+				body:      make([]byte, h.Length),
+				have:      make([]bool, h.Length),
+				remaining: int(h.Length),
+			}
+			c.reassembly[h.MessageSeq] = m
+		}
+		if m.typ != h.MessageType || len(m.body) != int(h.Length) {
+			continue
+		}
+		for i, b := range data {
+			j := int(h.FragmentOffset) + i
+			if !m.have[j] {
+				m.have[j] = true
+				m.body[j] = b
+				m.remaining--
+			}
+		}
+
+		for {
+			m := c.reassembly[c.recvSeq]
+			if m == nil || m.remaining > 0 {
+				break
+			}
+			delete(c.reassembly, c.recvSeq)
+			c.recvSeq++
+			if err := c.handleMessage(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleMessage 处理一个完整的握手消息。
+func (c *DTLCPConn) handleMessage(ctx context.Context, m *dtlcpMessage) error {
+	if c.handshakeDone {
+		// 握手完成后对方不应发送新的握手消息，DTLCP 不支持重新协商
+		return nil
+	}
+
+	if c.isClient && m.typ == handshaking.HandshakeTypeHelloVerifyRequest {
+		var hvr handshaking.HelloVerifyRequestMessage
+		// HelloVerifyRequest 只能紧跟在本端的 ClientHello 之后
+		if c.recvSeq != c.sendSeq || c.hvrCount >= dtlcpMaxHVR || hvr.Unmarshal(m.body) != nil {
+			c.sendAlert(AlertUnexpectedMessage)
+			return fmt.Errorf("tls: unexpected HelloVerifyRequest: %w", AlertUnexpectedMessage)
+		}
+		c.hvrCount++
+		// HelloVerifyRequest 使用 ClientHello 的记录序列号，服务端之后的记录从自己的序列号开始，
+		// 因此重新开始记录 epoch 0 的重放窗口
+		c.in.window = dtlcpReplayWindow{}
+		return c.startHandshake(ctx, hvr.Cookie)
+	}
+
+	if c.hs == nil {
+		if err := c.startHandshake(ctx, nil); err != nil {
+			return err
+		}
+	}
+
+	body := m.body
+	if !c.isClient && m.typ == handshaking.HandshakeTypeClientHello {
+		// cookie 在开始握手之前已经验证过，HandshakeConn 处理的是 TLCP 格式的 ClientHello
+		var err error
+		if body, _, err = handshaking.RemoveClientHelloCookie(body); err != nil {
+			c.sendAlert(AlertDecodeError)
+			return fmt.Errorf("tls: invalid DTLCP ClientHello: %w", AlertDecodeError)
+		}
+	}
+	data := (&handshaking.Handshake{MessageType: m.typ, Body: body}).Marshal()
+	if err := c.hs.HandleData(m.level, data); err != nil {
+		// HandshakeConn 不发送报警，由 DTLCP 记录层发送
+		var alertErr AlertError
+		if errors.As(err, &alertErr) {
+			c.sendAlert(alertErr.Description)
+		}
+		return err
+	}
+	return c.processEvents()
+}
+
+// Read 读取应用数据。每次最多返回一个记录中的数据，b 放不下时剩余的数据在之后的 Read 中返回。
+func (c *DTLCPConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	for len(c.input) == 0 {
+		if err := c.in.err; err != nil {
+			if err == errDTLCPCloseNotify {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				c.in.setErrorLocked(err)
+			}
+			return 0, err
+		}
+		if err := c.handleDatagram(context.Background(), c.buf[:n]); err != nil && err != errDTLCPCloseNotify {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.input[0])
+	c.input[0] = c.input[0][n:]
+	if len(c.input[0]) == 0 {
+		c.input = c.input[1:]
+	}
+	return n, nil
+}
+
+// Write 把 b 作为一个或多个应用数据记录发送，每个记录单独占用一个数据报。
+func (c *DTLCPConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return 0, err
+	}
+	if c.closeNotifySent {
+		return 0, errShutdown
+	}
+
+	var n int
+	for len(b) > 0 {
+		m := min(len(b), maxPlaintext)
+		record, err := c.sealRecordLocked(c.out.epoch, fragment.ContentTypeApplicationData, b[:m])
+		if err != nil {
+			return n, err
+		}
+		if _, err := c.conn.Write(record); err != nil {
+			return n, err
+		}
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// Close 关闭连接。握手已经完成时，先向对方发送 close_notify 报警。
+func (c *DTLCPConn) Close() error {
+	var alertErr error
+	if c.isHandshakeComplete.Load() {
+		c.out.Lock()
+		if !c.closeNotifySent {
+			c.closeNotifySent = true
+			alertErr = c.sendAlertLocked(AlertCloseNotify)
+		}
+		c.out.Unlock()
+	}
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+// ConnectionState 返回连接的基本信息。Version 为 VersionDTLCP11。
+func (c *DTLCPConn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.hs == nil {
+		return ConnectionState{}
+	}
+	state := c.hs.ConnectionState()
+	state.Version = VersionDTLCP11
+	return state
+}
+
+// LocalAddr 返回本地网络地址。
+func (c *DTLCPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr 返回远程网络地址。
+func (c *DTLCPConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline 设置连接的读写截止时间。
+func (c *DTLCPConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置连接的读取截止时间。握手过程中截止时间同样限制等待对方响应的时间。
+func (c *DTLCPConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *DTLCPConn) userReadDeadline() time.Time {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	return c.readDeadline
+}
+
+// SetWriteDeadline 设置连接的写入截止时间。
+func (c *DTLCPConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// NetConn 返回底层连接。
+func (c *DTLCPConn) NetConn() net.Conn {
+	return c.conn
+}
@@ -0,0 +1,340 @@
+package gmtls
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tjfoc/gmsm/sm3"
+
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+const (
+	dtlcpCookiePeriod = 60 // cookie 有效期的计时单位，单位为秒
+	dtlcpCookieMACLen = 16
+	dtlcpAcceptQueue  = 16 // 等待 Accept 的连接数量
+	dtlcpPeerQueue    = 64 // 每个连接等待读取的数据报数量，超过时丢弃
+)
+
+// dtlcpCookieJar 生成和验证 DTLCP 服务端的 cookie。
+//
+// cookie 由时间和 HMAC-SM3(key, 时间 || 客户端地址) 组成，服务端不需要为没有通过验证的客户端保存任何状态。
+// cookie 在生成后的一到两个计时单位内有效。
+type dtlcpCookieJar struct {
+	key    [32]byte
+	config *Config
+}
+
+func newDTLCPCookieJar(config *Config) *dtlcpCookieJar {
+	j := &dtlcpCookieJar{config: config}
+	if _, err := io.ReadFull(config.rand(), j.key[:]); err != nil {
+		panic("gmtls: failed to generate DTLCP cookie key: " + err.Error())
+	}
+	return j
+}
+
+func (j *dtlcpCookieJar) mac(period uint32, addr net.Addr) []byte {
+	h := hmac.New(sm3.New, j.key[:])
+	binary.Write(h, binary.BigEndian, period)
+	io.WriteString(h, addr.String())
+	return h.Sum(nil)[:dtlcpCookieMACLen]
+}
+
+func (j *dtlcpCookieJar) period() uint32 {
+	return uint32(j.config.time().Unix() / dtlcpCookiePeriod)
+}
+
+// generate 为地址 addr 生成 cookie。
+func (j *dtlcpCookieJar) generate(addr net.Addr) []byte {
+	period := j.period()
+	return binary.BigEndian.AppendUint32(j.mac(period, addr), period)
+}
+
+// valid 返回 cookie 是否是最近为地址 addr 生成的。
+func (j *dtlcpCookieJar) valid(cookie []byte, addr net.Addr) bool {
+	if len(cookie) != dtlcpCookieMACLen+4 {
+		return false
+	}
+	period := binary.BigEndian.Uint32(cookie[dtlcpCookieMACLen:])
+	if now := j.period(); period != now && period+1 != now {
+		return false
+	}
+	return subtle.ConstantTimeCompare(cookie[:dtlcpCookieMACLen], j.mac(period, addr)) == 1
+}
+
+// verifyClientHello 检查数据报是否以携带有效 cookie 的 ClientHello 开头。
+// ClientHello 必须在第一个记录中完整发送，这样服务端在验证之前不需要缓存任何数据。
+//
+// 没有携带有效 cookie 时返回需要发送给客户端的 HelloVerifyRequest 数据报；数据报不是 ClientHello 时返回 nil。
+func (j *dtlcpCookieJar) verifyClientHello(datagram []byte, addr net.Addr) (ok bool, hvr []byte) {
+	h, ok := fragment.ParseDatagramHeader(datagram)
+	if !ok || h.Type != fragment.ContentTypeHandshake || h.Epoch != 0 || len(datagram) < fragment.DatagramHeaderLength+int(h.Length) {
+		return false, nil
+	}
+	payload := datagram[fragment.DatagramHeaderLength : fragment.DatagramHeaderLength+int(h.Length)]
+	fh, ok := handshaking.ParseFragmentHeader(payload)
+	if !ok || fh.MessageType != handshaking.HandshakeTypeClientHello || fh.FragmentOffset != 0 || fh.FragmentLength != fh.Length ||
+		len(payload) < handshaking.FragmentHeaderLength+int(fh.Length) {
+		return false, nil
+	}
+	body, cookie, err := handshaking.RemoveClientHelloCookie(payload[handshaking.FragmentHeaderLength : handshaking.FragmentHeaderLength+int(fh.Length)])
+	var clientHello handshaking.ClientHelloMessage
+	if err != nil || clientHello.Unmarshal(body) != nil {
+		return false, nil
+	}
+	if j.valid(cookie, addr) {
+		return true, nil
+	}
+
+	// 与 DTLS 相同，HelloVerifyRequest 使用 ClientHello 的记录序列号和 message_seq，服务端不需要保存状态
+	hvrBody, err := (&handshaking.HelloVerifyRequestMessage{ServerVersion: VersionTLCP11, Cookie: j.generate(addr)}).Marshal()
+	if err != nil {
+		return false, nil
+	}
+	msg := handshaking.FragmentHeader{
+		MessageType:    handshaking.HandshakeTypeHelloVerifyRequest,
+		Length:         handshaking.Uint24(len(hvrBody)),
+		MessageSeq:     fh.MessageSeq,
+		FragmentLength: handshaking.Uint24(len(hvrBody)),
+	}
+	record := append(msg.Marshal(nil), hvrBody...)
+	rh := fragment.DatagramHeader{
+		Type:     fragment.ContentTypeHandshake,
+		Version:  VersionDTLCP11,
+		Sequence: h.Sequence,
+		Length:   uint16(len(record)),
+	}
+	return false, append(rh.Marshal(nil), record...)
+}
+
+// dtlcpListener 在一个 net.PacketConn 上接受 DTLCP 连接，按照对方地址把数据报分发给各个连接。
+type dtlcpListener struct {
+	pc      net.PacketConn
+	config  *Config
+	cookies *dtlcpCookieJar
+
+	mu    sync.Mutex
+	peers map[string]*dtlcpPeerConn
+
+	acceptc   chan *DTLCPConn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // readLoop 退出的原因，done 关闭后有效
+}
+
+// ListenDTLCP 使用 net.ListenPacket 在指定的网络地址上监听 DTLCP 连接。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+func ListenDTLCP(network, laddr string, config *Config) (net.Listener, error) {
+	if config == nil || len(config.Certificates) < 2 {
+		return nil, errors.New("tls: neither Certificates[0] nor Certificates[1] set in Config")
+	}
+	pc, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewDTLCPListener(pc, config), nil
+}
+
+// NewDTLCPListener 创建一个 Listener，它从 pc 接收数据报，为每个通过 cookie 验证的客户端地址创建一个 DTLCP 服务端连接。
+// 返回的连接类型是 *DTLCPConn，握手在第一次 Read 或 Write 时进行。
+//
+// 关闭 Listener 会关闭 pc，已经接受的连接也无法继续收发数据。
+func NewDTLCPListener(pc net.PacketConn, config *Config) net.Listener {
+	l := &dtlcpListener{
+		pc:      pc,
+		config:  config,
+		cookies: newDTLCPCookieJar(config),
+		peers:   make(map[string]*dtlcpPeerConn),
+		acceptc: make(chan *DTLCPConn, dtlcpAcceptQueue),
+		done:    make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *dtlcpListener) readLoop() {
+	buf := make([]byte, dtlcpMaxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.closeWithError(err)
+			return
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+
+		l.mu.Lock()
+		peer := l.peers[addr.String()]
+		l.mu.Unlock()
+		if peer != nil {
+			peer.deliver(datagram)
+			continue
+		}
+
+		ok, hvr := l.cookies.verifyClientHello(datagram, addr)
+		if !ok {
+			if hvr != nil {
+				l.pc.WriteTo(hvr, addr)
+			}
+			continue
+		}
+
+		peer = &dtlcpPeerConn{
+			l:       l,
+			addr:    addr,
+			recv:    make(chan []byte, dtlcpPeerQueue),
+			closed:  make(chan struct{}),
+			changed: make(chan struct{}),
+		}
+		peer.deliver(datagram)
+		conn := newDTLCPConn(peer, l.config, false, l.cookies)
+		select {
+		case l.acceptc <- conn:
+			l.mu.Lock()
+			l.peers[addr.String()] = peer
+			l.mu.Unlock()
+		default:
+			// Accept 的队列已满，客户端会重传 ClientHello
+		}
+	}
+}
+
+func (l *dtlcpListener) closeWithError(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+// Accept 等待并返回下一个连接。返回的连接类型是 *DTLCPConn。
+func (l *dtlcpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptc:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close 关闭 Listener 和底层的 PacketConn。
+func (l *dtlcpListener) Close() error {
+	err := l.pc.Close()
+	l.closeWithError(net.ErrClosed)
+	return err
+}
+
+// Addr 返回监听的地址。
+func (l *dtlcpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// dtlcpPeerConn 是 dtlcpListener 上与一个客户端地址之间的数据报连接。
+type dtlcpPeerConn struct {
+	l    *dtlcpListener
+	addr net.Addr
+
+	recv      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	changed      chan struct{} // 读取截止时间改变时关闭
+}
+
+// deliver 把数据报交给连接，连接来不及读取时丢弃。
+func (p *dtlcpPeerConn) deliver(datagram []byte) {
+	select {
+	case p.recv <- datagram:
+	default:
+	}
+}
+
+func (p *dtlcpPeerConn) Read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		deadline, changed := p.readDeadline, p.changed
+		p.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		n, err, again := 0, error(nil), false
+		select {
+		case datagram := <-p.recv:
+			n = copy(b, datagram)
+		case <-p.closed:
+			err = net.ErrClosed
+		case <-p.l.done:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			again = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !again {
+			return n, err
+		}
+	}
+}
+
+func (p *dtlcpPeerConn) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.l.pc.WriteTo(b, p.addr)
+}
+
+// Close 关闭连接，之后来自同一地址的数据报被当作新的连接处理。
+func (p *dtlcpPeerConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.l.mu.Lock()
+		if p.l.peers[p.addr.String()] == p {
+			delete(p.l.peers, p.addr.String())
+		}
+		p.l.mu.Unlock()
+	})
+	return nil
+}
+
+func (p *dtlcpPeerConn) LocalAddr() net.Addr  { return p.l.pc.LocalAddr() }
+func (p *dtlcpPeerConn) RemoteAddr() net.Addr { return p.addr }
+
+func (p *dtlcpPeerConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *dtlcpPeerConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readDeadline = t
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline 没有效果：向 PacketConn 写入数据报不会长时间阻塞。
+func (p *dtlcpPeerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
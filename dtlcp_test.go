@@ -0,0 +1,378 @@
+package gmtls
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// dtlcpPair 返回一对通过本地回环 UDP 连接的 net.Conn。
+func dtlcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	c1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := net.DialUDP("udp", nil, c1.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c1, err = net.DialUDP("udp", c1.LocalAddr().(*net.UDPAddr), c2.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c2, c1
+}
+
+// lossyConn 按照 drop 的返回值丢弃写入的数据报，并记录最近一次写入的数据报。
+type lossyConn struct {
+	net.Conn
+	drop func(n int, datagram []byte) bool
+
+	mu    sync.Mutex
+	count int
+	last  []byte
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.count++
+	drop := c.drop != nil && c.drop(c.count, b)
+	c.last = append(c.last[:0], b...)
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *lossyConn) lastDatagram() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.last...)
+}
+
+func dtlcpEcho(t *testing.T, client, server net.Conn, msg []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 2*len(msg))
+		n, err := server.Read(buf)
+		if err == nil {
+			_, err = server.Write(buf[:n])
+		}
+		errc <- err
+	}()
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*len(msg))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("echo returned %q, want %q", buf[:n], msg)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDTLCPListener(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	ln, err := ListenDTLCP("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		// Accept 不进行握手，需要在客户端等待握手时读取数据
+		if err := conn.(*DTLCPConn).Handshake(); err != nil {
+			conn.Close()
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := DialDTLCP("udp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	dtlcpEcho(t, client, server, []byte("hello, DTLCP"))
+
+	cs := client.ConnectionState()
+	ss := server.(*DTLCPConn).ConnectionState()
+	if cs.Version != VersionDTLCP11 || ss.Version != VersionDTLCP11 {
+		t.Errorf("negotiated versions %x and %x, want %x", cs.Version, ss.Version, VersionDTLCP11)
+	}
+	if !bytes.Equal(cs.TLSUnique, ss.TLSUnique) {
+		t.Error("TLSUnique differs between client and server")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after close_notify = %v, want io.EOF", err)
+	}
+}
+
+func TestDTLCPRetransmission(t *testing.T) {
+	defer func(d time.Duration) { dtlcpInitialTimeout = d }(dtlcpInitialTimeout)
+	dtlcpInitialTimeout = 20 * time.Millisecond
+
+	serverConfig, clientConfig := testConfigs(t)
+	serverConfig.MTU = 300
+	clientConfig.MTU = 300
+
+	// 丢弃双方最先发送的一部分握手数据报，迫使双方重传
+	dropHandshake := func(n int, datagram []byte) bool {
+		return datagram[0] == 22 && n < 10 && n%3 == 1
+	}
+	c, s := dtlcpPair(t)
+	lossyClient := &lossyConn{Conn: c, drop: dropHandshake}
+	lossyServer := &lossyConn{Conn: s, drop: dropHandshake}
+	client := DTLCPClient(lossyClient, clientConfig)
+	server := DTLCPServer(lossyServer, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if lossyServer.count < 4 {
+		t.Errorf("server sent %d datagrams, want the certificate flight to be fragmented", lossyServer.count)
+	}
+
+	dtlcpEcho(t, client, server, bytes.Repeat([]byte("x"), 1000))
+}
+
+// dtlcpRecords 把数据报拆分为记录头部和记录内容。
+func dtlcpRecords(datagram []byte) (headers []fragment.DatagramHeader, bodies [][]byte) {
+	for len(datagram) > 0 {
+		h, ok := fragment.ParseDatagramHeader(datagram)
+		if !ok || len(datagram) < fragment.DatagramHeaderLength+int(h.Length) {
+			break
+		}
+		headers = append(headers, h)
+		bodies = append(bodies, datagram[fragment.DatagramHeaderLength:fragment.DatagramHeaderLength+int(h.Length)])
+		datagram = datagram[fragment.DatagramHeaderLength+int(h.Length):]
+	}
+	return headers, bodies
+}
+
+// TestDTLCPWireFormat 检查 DTLCP 与 DTLS 1.2 相同的报文格式：ClientHello 的 cookie 字段、
+// ChangeCipherSpec 之后 epoch 加一，以及服务端使用自己的记录序列号。
+func TestDTLCPWireFormat(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	var mu sync.Mutex
+	var clientSent, serverSent [][]byte
+	record := func(sent *[][]byte) func(int, []byte) bool {
+		return func(_ int, datagram []byte) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			*sent = append(*sent, bytes.Clone(datagram))
+			return false
+		}
+	}
+	c, s := dtlcpPair(t)
+	client := DTLCPClient(&lossyConn{Conn: c, drop: record(&clientSent)}, clientConfig)
+	server := DTLCPServer(&lossyConn{Conn: s, drop: record(&serverSent)}, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// 第一个 ClientHello 的 cookie 为空，服务端以 HelloVerifyRequest 回应，第二个 ClientHello 回送 cookie
+	var cookies [][]byte
+	for _, datagram := range clientSent {
+		headers, bodies := dtlcpRecords(datagram)
+		for i, h := range headers {
+			fh, ok := handshaking.ParseFragmentHeader(bodies[i])
+			if h.Type != fragment.ContentTypeHandshake || h.Epoch != 0 || !ok || fh.MessageType != handshaking.HandshakeTypeClientHello {
+				continue
+			}
+			_, cookie, err := handshaking.RemoveClientHelloCookie(bodies[i][handshaking.FragmentHeaderLength:])
+			if err != nil {
+				t.Fatalf("ClientHello without a cookie field: %v", err)
+			}
+			cookies = append(cookies, cookie)
+		}
+	}
+	if len(cookies) != 2 || len(cookies[0]) != 0 || len(cookies[1]) == 0 {
+		t.Fatalf("client sent ClientHello cookies %x, want an empty cookie followed by the server's cookie", cookies)
+	}
+	headers, bodies := dtlcpRecords(serverSent[0])
+	var hvr handshaking.HelloVerifyRequestMessage
+	if len(headers) != 1 || hvr.Unmarshal(bodies[0][handshaking.FragmentHeaderLength:]) != nil || !bytes.Equal(hvr.Cookie, cookies[1]) {
+		t.Fatalf("server did not answer the first ClientHello with a HelloVerifyRequest carrying the cookie")
+	}
+
+	// ServerHello 使用服务端自己的序列号，而不是 ClientHello 的序列号
+	if headers, _ := dtlcpRecords(serverSent[1]); headers[0].Sequence != 0 {
+		t.Errorf("ServerHello has record sequence number %d, want 0", headers[0].Sequence)
+	}
+
+	// 双方都在 epoch 0 发送 ChangeCipherSpec，之后的记录使用 epoch 1
+	for name, sent := range map[string][][]byte{"client": clientSent, "server": serverSent} {
+		ccs := false
+		for _, datagram := range sent {
+			headers, bodies := dtlcpRecords(datagram)
+			for i, h := range headers {
+				switch {
+				case h.Type == fragment.ContentTypeChangeCipherSpec:
+					if h.Epoch != 0 || !bytes.Equal(bodies[i], []byte{1}) {
+						t.Errorf("%s sent ChangeCipherSpec %x in epoch %d", name, bodies[i], h.Epoch)
+					}
+					ccs = true
+				case h.Epoch == 1 && !ccs:
+					t.Errorf("%s sent an epoch 1 record before ChangeCipherSpec", name)
+				}
+			}
+		}
+		if !ccs {
+			t.Errorf("%s did not send ChangeCipherSpec", name)
+		}
+	}
+}
+
+func TestDTLCPReplay(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	c, s := dtlcpPair(t)
+	recorder := &lossyConn{Conn: c}
+	client := DTLCPClient(recorder, clientConfig)
+	server := DTLCPServer(s, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(recorder.lastDatagram()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	for _, want := range []string{"one", "two"} {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("Read returned %q, want %q", buf[:n], want)
+		}
+	}
+}
+
+func TestDTLCPReplayWindow(t *testing.T) {
+	var w dtlcpReplayWindow
+	accept := func(seq uint64) bool {
+		if !w.check(seq) {
+			return false
+		}
+		w.update(seq)
+		return true
+	}
+
+	tests := []struct {
+		seq  uint64
+		want bool
+	}{
+		{5, true},
+		{5, false},
+		{3, true},
+		{3, false},
+		{100, true},
+		{36, false}, // 在窗口之外
+		{37, true},
+		{99, true},
+		{100, false},
+		{200, true},
+		{137, true},
+		{136, false},
+	}
+	for _, tt := range tests {
+		if got := accept(tt.seq); got != tt.want {
+			t.Errorf("accept(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestDTLCPCookie(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+	jar := newDTLCPCookieJar(serverConfig)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4433}
+
+	cookie := jar.generate(addr)
+	if !jar.valid(cookie, addr) {
+		t.Error("fresh cookie rejected")
+	}
+	if jar.valid(cookie, other) {
+		t.Error("cookie accepted for a different address")
+	}
+	cookie[0] ^= 1
+	if jar.valid(cookie, addr) {
+		t.Error("modified cookie accepted")
+	}
+
+	// 两个计时单位之前生成的 cookie 已经过期
+	past := time.Now().Add(-2 * dtlcpCookiePeriod * time.Second)
+	serverConfig.Time = func() time.Time { return past }
+	cookie = jar.generate(addr)
+	serverConfig.Time = nil
+	if jar.valid(cookie, addr) {
+		t.Error("expired cookie accepted")
+	}
+}
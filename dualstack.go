@@ -0,0 +1,270 @@
+package gmtls
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// Protocol 表示 DualStackConn 实际使用的安全传输协议。
+type Protocol int
+
+const (
+	// ProtocolUnknown 表示还没有收到 ClientHello，协议尚未确定。
+	ProtocolUnknown Protocol = iota
+	// ProtocolTLCP 表示连接使用 GM/T 0024-2014 / GB/T 38636-2020 定义的 TLCP 协议。
+	ProtocolTLCP
+	// ProtocolTLS 表示连接使用 crypto/tls 实现的标准 TLS 协议。
+	ProtocolTLS
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTLCP:
+		return "TLCP"
+	case ProtocolTLS:
+		return "TLS"
+	default:
+		return "unknown"
+	}
+}
+
+// clientHelloPeekLen 是判断协议需要预读的长度：记录头部、握手消息头部和 client_version。
+const clientHelloPeekLen = recordHeaderLen + handshaking.HeaderLength + 2
+
+// dualStackListener 在同一个端口上同时提供 TLCP 和标准 TLS 服务。
+type dualStackListener struct {
+	net.Listener
+	config    *Config
+	tlsConfig *tls.Config
+}
+
+// NewDualStackListener 创建一个 Listener，它根据客户端的第一个 ClientHello 选择协议：
+// client_version 的主版本号为 1 的连接使用 TLCP 和 config 处理，其余连接交给 crypto/tls 和 tlsConfig 处理。
+//
+// 浏览器等标准 TLS 客户端和国密客户端因此可以连接同一个端口。
+// Accept 返回的连接类型是 *DualStackConn，协议在第一次 Read、Write 或 Handshake 时确定，
+// 因此 Accept 不会被慢速客户端阻塞。config.HandshakeTimeout 同时限制等待 ClientHello 的时间。
+func NewDualStackListener(inner net.Listener, config *Config, tlsConfig *tls.Config) net.Listener {
+	return &dualStackListener{
+		Listener:  inner,
+		config:    config,
+		tlsConfig: tlsConfig,
+	}
+}
+
+// ListenDualStack 使用 net.Listen 在指定的网络地址上同时监听 TLCP 和标准 TLS 连接，见 NewDualStackListener。
+func ListenDualStack(network, laddr string, config *Config, tlsConfig *tls.Config) (net.Listener, error) {
+	if config == nil || len(config.Certificates) < 2 {
+		return nil, errors.New("tls: neither Certificates[0] nor Certificates[1] set in Config")
+	}
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil) {
+		return nil, errors.New("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in tls.Config")
+	}
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewDualStackListener(l, config, tlsConfig), nil
+}
+
+// Accept 等待并返回下一个连接。返回的连接类型是 *DualStackConn。
+func (l *dualStackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &DualStackConn{
+		Conn:      c,
+		config:    l.config,
+		tlsConfig: l.tlsConfig,
+	}, nil
+}
+
+// DualStackConn 是 dual-stack listener 接受的服务端连接，根据客户端的 ClientHello 使用 TLCP 或标准 TLS。
+//
+// 地址和截止时间相关的方法直接作用于底层连接。
+type DualStackConn struct {
+	net.Conn
+
+	config    *Config
+	tlsConfig *tls.Config
+
+	// detectOnce 保证只预读一次 ClientHello。预读可能长时间阻塞，不能持有 mu
+	detectOnce sync.Once
+
+	// mu 保护以下字段，它们在预读结束后设置
+	mu       sync.Mutex
+	protocol Protocol
+	tlcpConn *Conn
+	tlsConn  *tls.Conn
+	err      error
+}
+
+// detect 预读 ClientHello 并创建对应协议的服务端连接。
+func (c *DualStackConn) detect() error {
+	c.detectOnce.Do(func() {
+		r := bufio.NewReader(c.Conn)
+		hdr, err := c.peekClientHello(r)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err != nil && len(hdr) < recordHeaderLen {
+			c.err = err
+			return
+		}
+		conn := &peekedConn{Conn: c.Conn, r: r}
+		if isTLCPClientHello(hdr) {
+			c.protocol = ProtocolTLCP
+			c.tlcpConn = Server(conn, c.config)
+		} else {
+			c.protocol = ProtocolTLS
+			c.tlsConn = tls.Server(conn, c.tlsConfig)
+		}
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// peekClientHello 从 r 预读 ClientHello 的开头。设置了 Config.HandshakeTimeout 时，
+// 超时后中断预读并返回 context.DeadlineExceeded，避免不发送数据的客户端一直占用连接。
+func (c *DualStackConn) peekClientHello(r *bufio.Reader) ([]byte, error) {
+	if c.config == nil || c.config.HandshakeTimeout <= 0 {
+		return r.Peek(clientHelloPeekLen)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.HandshakeTimeout)
+	defer cancel()
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+	})
+
+	hdr, err := r.Peek(clientHelloPeekLen)
+	if !stop() {
+		<-interrupted
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	return hdr, err
+}
+
+// isTLCPClientHello 报告 hdr 是否是 TLCP 的 ClientHello。
+// TLCP 的 client_version 主版本号为 1，标准 TLS 和 SSL 为 3。
+// 如果 ClientHello 被分片到很小的记录中，退而使用记录层的版本号判断。
+func isTLCPClientHello(hdr []byte) bool {
+	if fragment.TLSFragmentContentType(hdr[0]) != fragment.ContentTypeHandshake {
+		return false
+	}
+	recordLen := int(hdr[3])<<8 | int(hdr[4])
+	if len(hdr) < clientHelloPeekLen || recordLen < handshaking.HeaderLength+2 {
+		return ProtocolVersion(hdr[1])<<8|ProtocolVersion(hdr[2]) == VersionTLCP11
+	}
+	if handshaking.HandshakeType(hdr[recordHeaderLen]) != handshaking.HandshakeTypeClientHello {
+		return false
+	}
+	clientVersion := ProtocolVersion(hdr[clientHelloPeekLen-2])<<8 | ProtocolVersion(hdr[clientHelloPeekLen-1])
+	return clientVersion.Major() == VersionTLCP11.Major()
+}
+
+// Protocol 返回连接使用的协议。在第一次 Read、Write 或 Handshake 之前返回 ProtocolUnknown。
+func (c *DualStackConn) Protocol() Protocol {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+// TLCPConn 返回 TLCP 连接。如果连接使用的不是 TLCP，返回 nil。
+func (c *DualStackConn) TLCPConn() *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tlcpConn
+}
+
+// TLSConn 返回标准 TLS 连接。如果连接使用的不是标准 TLS，返回 nil。
+func (c *DualStackConn) TLSConn() *tls.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tlsConn
+}
+
+// active 返回确定协议后的连接。
+func (c *DualStackConn) active() (net.Conn, error) {
+	if err := c.detect(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tlcpConn != nil {
+		return c.tlcpConn, nil
+	}
+	return c.tlsConn, nil
+}
+
+// Handshake 确定协议并执行握手（如果还没有执行）。
+func (c *DualStackConn) Handshake() error {
+	conn, err := c.active()
+	if err != nil {
+		return err
+	}
+	if tlcpConn, ok := conn.(*Conn); ok {
+		return tlcpConn.Handshake()
+	}
+	return conn.(*tls.Conn).Handshake()
+}
+
+// Read 从连接读取数据，必要时先确定协议并完成握手。
+func (c *DualStackConn) Read(b []byte) (int, error) {
+	conn, err := c.active()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
+
+// Write 向连接写入数据，必要时先确定协议并完成握手。
+func (c *DualStackConn) Write(b []byte) (int, error) {
+	conn, err := c.active()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(b)
+}
+
+// Close 关闭连接。如果还在等待客户端的 ClientHello，直接关闭底层连接，让阻塞的预读立即返回。
+func (c *DualStackConn) Close() error {
+	c.mu.Lock()
+	tlcpConn, tlsConn := c.tlcpConn, c.tlsConn
+	c.mu.Unlock()
+
+	switch {
+	case tlcpConn != nil:
+		return tlcpConn.Close()
+	case tlsConn != nil:
+		return tlsConn.Close()
+	default:
+		return c.Conn.Close()
+	}
+}
+
+// peekedConn 先返回预读的数据，再从底层连接读取。
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,171 @@
+package gmtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfigs 返回一对使用 ECDSA 自签名证书的标准 TLS 配置。
+func testTLSConfigs(t testing.TB) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server.example"},
+		DNSNames:     []string{"server.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "server.example"}
+	return server, client
+}
+
+func TestDualStackListener(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	tlsServerConfig, tlsClientConfig := testTLSConfigs(t)
+
+	ln, err := ListenDualStack("tcp", "127.0.0.1:0", serverConfig, tlsServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	protocols := make(chan Protocol, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					t.Error(err)
+					protocols <- ProtocolUnknown
+					return
+				}
+				conn.Write(bytes.ToUpper(buf))
+				protocols <- conn.(*DualStackConn).Protocol()
+			}()
+		}
+	}()
+
+	echo := func(conn net.Conn) {
+		t.Helper()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "HELLO" {
+			t.Errorf("got %q, want %q", buf, "HELLO")
+		}
+	}
+
+	tlcpConn, err := Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(tlcpConn)
+	tlcpConn.Close()
+	if p := <-protocols; p != ProtocolTLCP {
+		t.Errorf("TLCP client: got protocol %s, want %s", p, ProtocolTLCP)
+	}
+
+	tlsConn, err := tls.Dial("tcp", ln.Addr().String(), tlsClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(tlsConn)
+	tlsConn.Close()
+	if p := <-protocols; p != ProtocolTLS {
+		t.Errorf("TLS client: got protocol %s, want %s", p, ProtocolTLS)
+	}
+}
+
+// TestDualStackConnSilentClient 检查客户端不发送 ClientHello 时，Close 和查询方法不会被阻塞，
+// 并且 HandshakeTimeout 会中断预读。
+func TestDualStackConnSilentClient(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+	tlsServerConfig, _ := testTLSConfigs(t)
+
+	t.Run("Close", func(t *testing.T) {
+		c, s := localPipe(t)
+		defer c.Close()
+		conn := &DualStackConn{Conn: s, config: serverConfig, tlsConfig: tlsServerConfig}
+
+		errc := make(chan error, 1)
+		go func() { errc <- conn.Handshake() }()
+		time.Sleep(50 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			if conn.Protocol() != ProtocolUnknown {
+				t.Error("protocol detected without a ClientHello")
+			}
+			conn.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close blocked while waiting for the ClientHello")
+		}
+		select {
+		case err := <-errc:
+			if err == nil {
+				t.Error("Handshake succeeded on a closed connection")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Handshake did not return after Close")
+		}
+	})
+
+	t.Run("HandshakeTimeout", func(t *testing.T) {
+		c, s := localPipe(t)
+		defer c.Close()
+		config := serverConfig.Clone()
+		config.HandshakeTimeout = 100 * time.Millisecond
+		conn := &DualStackConn{Conn: s, config: config, tlsConfig: tlsServerConfig}
+		defer conn.Close()
+
+		start := time.Now()
+		if err := conn.Handshake(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Handshake = %v, want context.DeadlineExceeded", err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Handshake took %v", d)
+		}
+	})
+}
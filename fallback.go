@@ -0,0 +1,192 @@
+package gmtls
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/nnnewb/gmtls/internal/fragment"
+)
+
+// FallbackDialer 先尝试一种协议建立连接，如果服务端不支持，则改用另一种协议。
+//
+// 默认先尝试 TLCP，服务端返回 protocol_version 报警或者选择了非 TLCP 的版本时改用 crypto/tls；
+// PreferTLS 为 true 时顺序相反。每个地址成功使用的协议会被缓存，之后的连接直接使用该协议，
+// 只有当缓存的协议再次因为版本不匹配失败时才会重新尝试另一种协议。
+//
+// FallbackDialer 可以被多个 goroutine 同时使用。
+type FallbackDialer struct {
+	// NetDialer 是建立底层连接使用的 Dialer。为 nil 时使用零值 net.Dialer。
+	NetDialer *net.Dialer
+
+	// Config 是 TLCP 连接使用的配置。为 nil 时等价于零值配置。
+	Config *Config
+
+	// TLSConfig 是标准 TLS 连接使用的配置。为 nil 时等价于零值配置。
+	TLSConfig *tls.Config
+
+	// PreferTLS 为 true 时先尝试标准 TLS。
+	PreferTLS bool
+
+	// cache 记录每个地址上次成功使用的协议
+	cache sync.Map // map[string]Protocol
+}
+
+// Dial 连接到指定的网络地址并完成握手。返回的连接是 *Conn 或 *tls.Conn，可以用 ConnProtocol 获取使用的协议。
+func (d *FallbackDialer) Dial(network, addr string) (net.Conn, error) {
+	first, second := ProtocolTLCP, ProtocolTLS
+	if d.PreferTLS {
+		first, second = second, first
+	}
+	if p, ok := d.CachedProtocol(addr); ok && p != first {
+		first, second = second, first
+	}
+
+	conn, err := d.dialProtocol(first, network, addr)
+	if err == nil {
+		d.cache.Store(addr, first)
+		return conn, nil
+	}
+	if !isProtocolMismatch(first, err) {
+		return nil, err
+	}
+
+	conn, err = d.dialProtocol(second, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.Store(addr, second)
+	return conn, nil
+}
+
+// CachedProtocol 返回地址 addr 上次成功使用的协议。
+func (d *FallbackDialer) CachedProtocol(addr string) (Protocol, bool) {
+	p, ok := d.cache.Load(addr)
+	if !ok {
+		return ProtocolUnknown, false
+	}
+	return p.(Protocol), true
+}
+
+func (d *FallbackDialer) netDialer() *net.Dialer {
+	if d.NetDialer != nil {
+		return d.NetDialer
+	}
+	return new(net.Dialer)
+}
+
+func (d *FallbackDialer) dialProtocol(p Protocol, network, addr string) (net.Conn, error) {
+	if p == ProtocolTLCP {
+		return DialWithDialer(d.netDialer(), network, addr, d.Config)
+	}
+	return d.dialTLS(network, addr)
+}
+
+// dialTLS 建立标准 TLS 连接，与 tls.DialWithDialer 相同。
+//
+// crypto/tls 不导出收到的报警，也不区分版本不匹配和其他握手错误，因此记录服务端回应的第一条记录。
+// 握手失败并且这条记录表明服务端只支持 TLCP 时，返回的错误包装为 *tlcpResponseError。
+func (d *FallbackDialer) dialTLS(network, addr string) (*tls.Conn, error) {
+	netDialer := d.netDialer()
+	ctx := context.Background()
+	if netDialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, netDialer.Timeout)
+		defer cancel()
+	}
+	if !netDialer.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, netDialer.Deadline)
+		defer cancel()
+	}
+
+	rawConn, err := netDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.TLSConfig
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	recorder := &firstRecordConn{Conn: rawConn}
+	conn := tls.Client(recorder, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		if recorder.isTLCPResponse() {
+			return nil, &tlcpResponseError{err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tlcpResponseError 表示标准 TLS 握手失败，并且服务端以 TLCP 回应。
+type tlcpResponseError struct {
+	err error
+}
+
+func (e *tlcpResponseError) Error() string { return e.err.Error() }
+func (e *tlcpResponseError) Unwrap() error { return e.err }
+
+// firstRecordConn 记录从服务端读到的第一条记录的头部和随后的两个字节。
+type firstRecordConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *firstRecordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if need := recordHeaderLen + 2 - len(c.head); need > 0 {
+		c.head = append(c.head, b[:min(n, need)]...)
+	}
+	return n, err
+}
+
+// isTLCPResponse 报告服务端的第一条记录是否表明它只支持 TLCP：记录的主版本号是 TLCP 的主版本号，
+// 或者这条记录是 protocol_version 报警。
+func (c *firstRecordConn) isTLCPResponse() bool {
+	if len(c.head) < recordHeaderLen {
+		return false
+	}
+	if c.head[1] == VersionTLCP11.Major() {
+		return true
+	}
+	return fragment.TLSFragmentContentType(c.head[0]) == fragment.ContentTypeAlert &&
+		len(c.head) == recordHeaderLen+2 && AlertDescription(c.head[recordHeaderLen+1]) == AlertProtocolVersion
+}
+
+// isProtocolMismatch 报告使用协议 p 握手失败的原因是否是服务端不支持该协议。
+func isProtocolMismatch(p Protocol, err error) bool {
+	if p == ProtocolTLCP {
+		// 服务端发送了 protocol_version 报警，或者选择了非 TLCP 的版本
+		return errors.Is(err, AlertProtocolVersion)
+	}
+	var tlcpErr *tlcpResponseError
+	return errors.As(err, &tlcpErr)
+}
+
+// ConnProtocol 返回连接使用的协议，用于 FallbackDialer.Dial 或 dual-stack listener 返回的连接。
+func ConnProtocol(conn net.Conn) Protocol {
+	switch conn := conn.(type) {
+	case *Conn:
+		return ProtocolTLCP
+	case *tls.Conn:
+		return ProtocolTLS
+	case *DualStackConn:
+		return conn.Protocol()
+	default:
+		return ProtocolUnknown
+	}
+}
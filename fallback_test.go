@@ -0,0 +1,100 @@
+package gmtls
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countingListener 统计 Accept 返回的连接数量，即客户端尝试连接的次数。
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// serveHandshakes 接受连接并完成握手，直到 ln 被关闭。
+func serveHandshakes(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.(interface{ Handshake() error }).Handshake()
+			conn.Read(make([]byte, 1))
+		}()
+	}
+}
+
+func TestFallbackDialer(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	tlsServerConfig, tlsClientConfig := testTLSConfigs(t)
+
+	tlcpInner, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlcpListener := &countingListener{Listener: tlcpInner}
+	defer tlcpListener.Close()
+	go serveHandshakes(tlcpListener)
+
+	tlsInner, err := tls.Listen("tcp", "127.0.0.1:0", tlsServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener := &countingListener{Listener: tlsInner}
+	defer tlsListener.Close()
+	go serveHandshakes(tlsListener)
+
+	tests := []struct {
+		name      string
+		ln        *countingListener
+		preferTLS bool
+		want      Protocol
+		// attempts 是第一次连接的尝试次数，先尝试的协议不被支持时为 2
+		attempts int32
+	}{
+		{"TLCPServer", tlcpListener, false, ProtocolTLCP, 1},
+		{"TLSServer", tlsListener, false, ProtocolTLS, 2},
+		{"TLCPServer/PreferTLS", tlcpListener, true, ProtocolTLCP, 2},
+		{"TLSServer/PreferTLS", tlsListener, true, ProtocolTLS, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &FallbackDialer{Config: clientConfig, TLSConfig: tlsClientConfig, PreferTLS: tt.preferTLS}
+			addr := tt.ln.Addr().String()
+			for i := 0; i < 2; i++ {
+				tt.ln.accepted.Store(0)
+				conn, err := d.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				if p := ConnProtocol(conn); p != tt.want {
+					t.Errorf("dial %d: got protocol %s, want %s", i, p, tt.want)
+				}
+				if p, ok := d.CachedProtocol(addr); !ok || p != tt.want {
+					t.Errorf("dial %d: cached protocol %s, want %s", i, p, tt.want)
+				}
+				// 第二次连接直接使用缓存的协议，只尝试一次
+				want := tt.attempts
+				if i > 0 {
+					want = 1
+				}
+				if n := tt.ln.accepted.Load(); n != want {
+					t.Errorf("dial %d: made %d attempts, want %d", i, n, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package gmcredentials 提供基于 TLCP 的 gRPC 传输凭证。
+//
+// gmcredentials 是单独的模块，只有使用它的程序才会依赖 gRPC。
+package gmcredentials
+
+import (
+	"context"
+	"net"
+
+	"github.com/nnnewb/gmtls"
+	"github.com/tjfoc/gmsm/x509"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLCPInfo 包含 TLCP 连接的认证信息，可以通过 peer.FromContext 获取。
+type TLCPInfo struct {
+	State gmtls.ConnectionState
+	credentials.CommonAuthInfo
+}
+
+// AuthType 返回认证类型 "tlcp"。
+func (TLCPInfo) AuthType() string {
+	return "tlcp"
+}
+
+// tlcpCreds 是使用 TLCP 的 credentials.TransportCredentials 实现。
+type tlcpCreds struct {
+	config *gmtls.Config
+}
+
+// NewTLS 使用 config 创建 TLCP 传输凭证。客户端和服务端的双向认证由 config.ClientAuth 控制。
+//
+// 客户端的 config 没有设置 ServerName 时，使用 gRPC 连接的 authority 中的主机名。
+func NewTLS(config *gmtls.Config) credentials.TransportCredentials {
+	if config == nil {
+		return &tlcpCreds{config: &gmtls.Config{}}
+	}
+	return &tlcpCreds{config: config.Clone()}
+}
+
+// NewClientTLSFromCert 创建客户端使用的 TLCP 传输凭证，使用 roots 验证服务端证书。
+// serverNameOverride 不为空时用于验证服务端证书中的主机名。
+func NewClientTLSFromCert(roots *x509.CertPool, serverNameOverride string) credentials.TransportCredentials {
+	return NewTLS(&gmtls.Config{RootCAs: roots, ServerName: serverNameOverride})
+}
+
+// NewServerTLSFromCert 创建服务端使用的 TLCP 传输凭证，signCert 和 encCert 分别是签名证书和加密证书。
+func NewServerTLSFromCert(signCert, encCert *gmtls.Certificate) credentials.TransportCredentials {
+	return NewTLS(&gmtls.Config{Certificates: []gmtls.Certificate{*signCert, *encCert}})
+}
+
+func (c *tlcpCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tlcp",
+		SecurityVersion:  "1.1",
+		ServerName:       c.config.ServerName,
+	}
+}
+
+func (c *tlcpCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cfg := c.config
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(authority)
+		if err != nil {
+			host = authority
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	conn := gmtls.Client(rawConn, cfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, newInfo(conn), nil
+}
+
+func (c *tlcpCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn := gmtls.Server(rawConn, c.config)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, newInfo(conn), nil
+}
+
+func (c *tlcpCreds) Clone() credentials.TransportCredentials {
+	return NewTLS(c.config)
+}
+
+func (c *tlcpCreds) OverrideServerName(serverNameOverride string) error {
+	c.config.ServerName = serverNameOverride
+	return nil
+}
+
+func newInfo(conn *gmtls.Conn) TLCPInfo {
+	return TLCPInfo{
+		State:          conn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}
+}
@@ -0,0 +1,165 @@
+package gmcredentials_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nnnewb/gmtls"
+	"github.com/nnnewb/gmtls/gmcredentials"
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/x509"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testPKI 是测试使用的证书：一个根 CA，以及服务端和客户端的签名证书、加密证书。
+type testPKI struct {
+	pool *x509.CertPool
+
+	serverSign, serverEnc gmtls.Certificate
+	clientSign, clientEnc gmtls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	rootKey, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gmcredentials test root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.SM2WithSM3,
+	}
+	rootDER, err := x509.CreateCertificate(rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, cn string, usage x509.KeyUsage, extUsage x509.ExtKeyUsage) gmtls.Certificate {
+		key, err := sm2.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:       big.NewInt(serial),
+			Subject:            pkix.Name{CommonName: cn},
+			DNSNames:           []string{cn},
+			NotBefore:          time.Now().Add(-time.Hour),
+			NotAfter:           time.Now().Add(24 * time.Hour),
+			KeyUsage:           usage,
+			ExtKeyUsage:        []x509.ExtKeyUsage{extUsage},
+			SignatureAlgorithm: x509.SM2WithSM3,
+		}
+		der, err := x509.CreateCertificate(template, root, &key.PublicKey, rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gmtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	}
+
+	const signUsage = x509.KeyUsageDigitalSignature
+	const encUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyAgreement
+
+	pki := &testPKI{pool: x509.NewCertPool()}
+	pki.pool.AddCert(root)
+	pki.serverSign = issue(2, "server.example", signUsage, x509.ExtKeyUsageServerAuth)
+	pki.serverEnc = issue(3, "server.example", encUsage, x509.ExtKeyUsageServerAuth)
+	pki.clientSign = issue(4, "client.example", signUsage, x509.ExtKeyUsageClientAuth)
+	pki.clientEnc = issue(5, "client.example", encUsage, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func TestMutualAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	serverCreds := gmcredentials.NewTLS(&gmtls.Config{
+		Certificates: []gmtls.Certificate{pki.serverSign, pki.serverEnc},
+		ClientCAs:    pki.pool,
+		ClientAuth:   gmtls.RequireAndVerifyClientCert,
+	})
+	clientCreds := gmcredentials.NewTLS(&gmtls.Config{
+		Certificates: []gmtls.Certificate{pki.clientSign, pki.clientEnc},
+		RootCAs:      pki.pool,
+	})
+
+	// 服务端记录客户端的认证信息
+	clientInfo := make(chan gmcredentials.TLCPInfo, 1)
+	srv := grpc.NewServer(grpc.Creds(serverCreds), grpc.UnaryInterceptor(
+		func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if p, ok := peer.FromContext(ctx); ok {
+				if ai, ok := p.AuthInfo.(gmcredentials.TLCPInfo); ok {
+					clientInfo <- ai
+				}
+			}
+			return handler(ctx, req)
+		}))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	cc, err := grpc.NewClient("passthrough:///server.example",
+		grpc.WithTransportCredentials(clientCreds),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var p peer.Peer
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got status %s, want SERVING", resp.Status)
+	}
+
+	serverInfo, ok := p.AuthInfo.(gmcredentials.TLCPInfo)
+	if !ok {
+		t.Fatalf("got AuthInfo %T, want TLCPInfo", p.AuthInfo)
+	}
+	if serverInfo.State.CipherSuite == 0 {
+		t.Error("client: cipher suite not set")
+	}
+	if certs := serverInfo.State.PeerCertificates; len(certs) == 0 || certs[0].Subject.CommonName != "server.example" {
+		t.Errorf("client: unexpected server certificates %v", certs)
+	}
+
+	select {
+	case ai := <-clientInfo:
+		if certs := ai.State.PeerCertificates; len(certs) == 0 || certs[0].Subject.CommonName != "client.example" {
+			t.Errorf("server: unexpected client certificates %v", certs)
+		}
+		if len(ai.State.VerifiedChains) == 0 {
+			t.Error("server: client certificate was not verified")
+		}
+	default:
+		t.Error("server: no TLCP auth info")
+	}
+}
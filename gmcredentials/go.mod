@@ -0,0 +1,24 @@
+// 本地开发时在仓库根目录创建工作区，使用工作区中的 gmtls 而不是下面固定的版本：
+//
+//	go work init . ./gmcredentials
+//	go work edit -replace google.golang.org/genproto=google.golang.org/genproto@v0.0.0-20240814211410-ddb44dafa142
+//
+// 第二条命令让 gmsm 间接依赖的旧版 genproto 不再与 googleapis/rpc 提供同一个包。
+module github.com/nnnewb/gmtls/gmcredentials
+
+go 1.23.4
+
+require (
+	github.com/nnnewb/gmtls v0.0.0-20261019050823-18d4802274b2
+	github.com/tjfoc/gmsm v1.4.1
+	google.golang.org/grpc v1.67.1
+)
+
+require (
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
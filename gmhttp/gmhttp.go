@@ -0,0 +1,200 @@
+// Package gmhttp 把 gmtls 接入 net/http。
+//
+// net/http 只认识 *tls.Conn，使用 gmtls 时 http.Request.TLS 和 http.Response.TLS 总是 nil。
+// 服务端的处理函数可以使用 ConnectionState 获取 TLCP 连接的信息。
+//
+// 出于同样的原因，net/http 不会在 TLCP 连接上启用 HTTP/2。ServeGMTLS 通过 ALPN 协商 h2，
+// 并使用 golang.org/x/net/http2 处理协商出 h2 的连接；客户端可以使用 NewHTTP2Transport。
+package gmhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/nnnewb/gmtls"
+	"golang.org/x/net/http2"
+)
+
+// handshakeTimeout 是 NewTransport 和 NewHTTP2Transport 的 TLCP 握手超时，与 http.DefaultTransport 的 TLSHandshakeTimeout 相同。
+const handshakeTimeout = 10 * time.Second
+
+// NewTransport 返回一个使用 TLCP 连接 https 地址的 http.Transport，其余设置与 http.DefaultTransport 相同。
+//
+// 如果 config 没有设置 ServerName，使用请求地址中的主机名。config 为 nil 时等价于零值配置。
+// http.Transport 只能在 TLCP 连接上使用 HTTP/1.1，因此 config.NextProtos 会被替换为 http/1.1。
+//
+// 设置了 DialTLSContext 时 http.Transport 忽略 TLSHandshakeTimeout，因此 TLCP 握手的 10 秒超时由拨号函数自己实现。
+func NewTransport(config *gmtls.Config) *http.Transport {
+	dialer := newDialer()
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		DialTLSContext:        dialTLSContext(dialer, withNextProtos(config, "http/1.1"), handshakeTimeout),
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewHTTP2Transport 返回一个使用 TLCP 和 HTTP/2 连接 https 地址的 http2.Transport。
+//
+// 如果 config 没有设置 ServerName，使用请求地址中的主机名。config 为 nil 时等价于零值配置。
+// config.NextProtos 会被替换为 h2，服务端没有协商出 h2 时连接失败。
+func NewHTTP2Transport(config *gmtls.Config) *http2.Transport {
+	dial := dialTLSContext(newDialer(), withNextProtos(config, http2.NextProtoTLS), handshakeTimeout)
+	return &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if p := conn.(*gmtls.Conn).ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("gmhttp: server negotiated protocol %q instead of %q", p, http2.NextProtoTLS)
+			}
+			return conn, nil
+		},
+	}
+}
+
+func newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// withNextProtos 返回 config 的副本，其中 NextProtos 被替换为 protos。
+func withNextProtos(config *gmtls.Config, protos ...string) *gmtls.Config {
+	c := config.Clone()
+	if c == nil {
+		c = new(gmtls.Config)
+	}
+	c.NextProtos = protos
+	return c
+}
+
+// DialTLSContextFunc 返回可以用作 http.Transport.DialTLSContext 的函数，它使用 dialer 建立连接，然后进行 TLCP 握手。
+func DialTLSContextFunc(dialer *net.Dialer, config *gmtls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialTLSContext(dialer, config, 0)
+}
+
+// dialTLSContext 与 DialTLSContextFunc 相同，timeout 不为零时握手最多进行 timeout，不包括建立底层连接的时间。
+func dialTLSContext(dialer *net.Dialer, config *gmtls.Config, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout == 0 {
+		d := &gmtls.Dialer{NetDialer: dialer, Config: config}
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		rawConn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := config
+		if cfg == nil {
+			cfg = new(gmtls.Config)
+		}
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn := gmtls.Client(rawConn, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+type connContextKey struct{}
+
+// ServeGMTLS 在 l 上接受 TLCP 连接并使用 srv 处理 HTTP 请求。
+//
+// ServeGMTLS 会设置 srv.ConnContext 以便处理函数使用 ConnectionState，原有的 ConnContext 仍然会被调用。
+//
+// 与 http.Server.ServeTLS 相同，config.NextProtos 为空时使用 h2 和 http/1.1，并通过 ALPN 协商是否使用 HTTP/2；
+// srv.TLSNextProto 为非 nil 的空 map 时不启用 HTTP/2。启用 HTTP/2 时 ServeGMTLS 会调用 http2.ConfigureServer。
+func ServeGMTLS(srv *http.Server, l net.Listener, config *gmtls.Config) error {
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+
+	cfg := config.Clone()
+	if cfg == nil {
+		cfg = new(gmtls.Config)
+	}
+	if len(cfg.NextProtos) == 0 {
+		if srv.TLSNextProto == nil || len(srv.TLSNextProto) > 0 {
+			cfg.NextProtos = []string{http2.NextProtoTLS}
+		}
+	}
+	if !slices.Contains(cfg.NextProtos, "http/1.1") {
+		cfg.NextProtos = append(slices.Clip(cfg.NextProtos), "http/1.1")
+	}
+
+	tl := gmtls.NewListener(l, cfg)
+	if !slices.Contains(cfg.NextProtos, http2.NextProtoTLS) {
+		return srv.Serve(tl)
+	}
+	h2srv := new(http2.Server)
+	if err := http2.ConfigureServer(srv, h2srv); err != nil {
+		return err
+	}
+	return srv.Serve(newH2Listener(tl, srv, h2srv))
+}
+
+// ListenAndServeGMTLS 在 addr 上监听 TCP 连接，使用 TLCP 协议和 handler 处理 HTTP 请求。
+//
+// signCertFile 和 signKeyFile 是服务端签名证书和私钥，encCertFile 和 encKeyFile 是加密证书和私钥，均为 PEM 编码。
+// 证书文件可以在服务端证书之后包含中间证书。handler 为 nil 时使用 http.DefaultServeMux。
+func ListenAndServeGMTLS(addr, signCertFile, signKeyFile, encCertFile, encKeyFile string, handler http.Handler) error {
+	signCert, err := gmtls.LoadX509KeyPair(signCertFile, signKeyFile)
+	if err != nil {
+		return err
+	}
+	encCert, err := gmtls.LoadX509KeyPair(encCertFile, encKeyFile)
+	if err != nil {
+		return err
+	}
+	config := &gmtls.Config{Certificates: []gmtls.Certificate{signCert, encCert}}
+
+	if addr == "" {
+		addr = ":https"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	srv := &http.Server{Addr: addr, Handler: handler}
+	return ServeGMTLS(srv, l, config)
+}
+
+// ConnectionState 返回处理请求 r 的 TLCP 连接的信息。
+// 如果请求不是通过 ServeGMTLS 接受的 TLCP 连接到达的，返回 false。
+func ConnectionState(r *http.Request) (gmtls.ConnectionState, bool) {
+	conn, ok := r.Context().Value(connContextKey{}).(*gmtls.Conn)
+	if !ok {
+		return gmtls.ConnectionState{}, false
+	}
+	return conn.ConnectionState(), true
+}
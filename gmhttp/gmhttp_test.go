@@ -0,0 +1,139 @@
+package gmhttp_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nnnewb/gmtls"
+	"github.com/nnnewb/gmtls/gmhttp"
+	"github.com/nnnewb/gmtls/internal/testcert"
+)
+
+func TestServeGMTLS(t *testing.T) {
+	pki, err := testcert.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 通过文件加载证书，与 ListenAndServeGMTLS 的用法一致
+	dir := t.TempDir()
+	loadKeyPair := func(name string, kp testcert.KeyPair) gmtls.Certificate {
+		certPEM, keyPEM := kp.PEM()
+		certFile := filepath.Join(dir, name+".crt")
+		keyFile := filepath.Join(dir, name+".key")
+		if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := gmtls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	serverConfig := &gmtls.Config{
+		Certificates: []gmtls.Certificate{
+			loadKeyPair("sign", pki.ServerSign),
+			loadKeyPair("enc", pki.ServerEnc),
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, ok := gmhttp.ConnectionState(r)
+		if !ok {
+			http.Error(w, "not a TLCP connection", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", state.Version, gmtls.CipherSuite(state.CipherSuite))
+	})}
+	go gmhttp.ServeGMTLS(srv, l, serverConfig)
+	defer srv.Close()
+
+	client := &http.Client{Transport: gmhttp.NewTransport(&gmtls.Config{
+		RootCAs:    pki.Pool,
+		ServerName: "server.example",
+	})}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d: %s", resp.StatusCode, body)
+		}
+		if want := "TLCP 1.1 ECC_SM4_SM3"; string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestServeGMTLSHTTP2(t *testing.T) {
+	pki, err := testcert.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func(kp testcert.KeyPair) gmtls.Certificate {
+		return gmtls.Certificate{Certificate: [][]byte{kp.DER}, PrivateKey: kp.Key, Leaf: kp.Leaf}
+	}
+	serverConfig := &gmtls.Config{
+		Certificates: []gmtls.Certificate{certificate(pki.ServerSign), certificate(pki.ServerEnc)},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, ok := gmhttp.ConnectionState(r)
+		if !ok {
+			http.Error(w, "not a TLCP connection", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s %q", r.Proto, state.NegotiatedProtocol)
+	})}
+	go gmhttp.ServeGMTLS(srv, l, serverConfig)
+	defer srv.Close()
+
+	clientConfig := &gmtls.Config{RootCAs: pki.Pool, ServerName: "server.example"}
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+		want      string
+	}{
+		{"HTTP2", gmhttp.NewHTTP2Transport(clientConfig), `HTTP/2.0 "h2"`},
+		{"HTTP1", gmhttp.NewTransport(clientConfig), `HTTP/1.1 "http/1.1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: tt.transport}
+			resp, err := client.Get("https://" + l.Addr().String() + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package gmhttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nnnewb/gmtls"
+	"golang.org/x/net/http2"
+)
+
+// h2Listener 在后台完成 TLCP 握手。协商出 h2 的连接直接交给 HTTP/2 服务端处理，其余连接由 Accept 返回给 http.Server。
+//
+// net/http 只对 *tls.Conn 使用 TLSNextProto，所以需要在 Accept 之前完成握手和分流。
+type h2Listener struct {
+	net.Listener
+	srv   *http.Server
+	h2srv *http2.Server
+
+	startOnce sync.Once
+	conns     chan net.Conn
+	errs      chan error
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newH2Listener(inner net.Listener, srv *http.Server, h2srv *http2.Server) *h2Listener {
+	return &h2Listener{
+		Listener: inner,
+		srv:      srv,
+		h2srv:    h2srv,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *h2Listener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *h2Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *h2Listener) acceptLoop() {
+	var tempDelay time.Duration
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// 与 http.Server.Serve 相同，以 5 毫秒开始、最多 1 秒的指数退避重试。
+			// 错误不可恢复时 http.Server 会返回并关闭监听，done 随之关闭。
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 1 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			select {
+			case <-time.After(tempDelay):
+			case <-l.done:
+				return
+			}
+			continue
+		}
+		tempDelay = 0
+		go l.handshake(c.(*gmtls.Conn))
+	}
+}
+
+// handshake 完成握手并根据协商的应用层协议分发连接。
+func (l *h2Listener) handshake(conn *gmtls.Conn) {
+	if d := l.handshakeTimeout(); d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if l.srv.BaseContext != nil {
+		ctx = l.srv.BaseContext(l)
+	}
+	if l.srv.ConnContext != nil {
+		ctx = l.srv.ConnContext(ctx, conn)
+	}
+	l.h2srv.ServeConn(conn, &http2.ServeConnOpts{
+		Context:    ctx,
+		BaseConfig: l.srv,
+		Handler:    l.srv.Handler,
+	})
+}
+
+// handshakeTimeout 与 net/http 相同，取 ReadTimeout、WriteTimeout 和 ReadHeaderTimeout 中最小的非零值。
+func (l *h2Listener) handshakeTimeout() time.Duration {
+	var d time.Duration
+	for _, v := range []time.Duration{l.srv.ReadTimeout, l.srv.WriteTimeout, l.srv.ReadHeaderTimeout} {
+		if v > 0 && (d == 0 || v < d) {
+			d = v
+		}
+	}
+	return d
+}
@@ -0,0 +1,514 @@
+package gmtls
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	x509 "github.com/tjfoc/gmsm/x509"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// clientHandshakeState 保存客户端握手过程中的状态。
+type clientHandshakeState struct {
+	c            *Conn
+	hello        *handshaking.ClientHelloMessage
+	serverHello  *handshaking.ServerHelloMessage
+	suite        *cipherSuite
+	ka           keyAgreement
+	finishedHash finishedHash
+	masterSecret []byte
+}
+
+// makeClientHello 根据配置生成 ClientHello 消息。
+func (c *Conn) makeClientHello() (*handshaking.ClientHelloMessage, error) {
+	config := c.config
+	version, ok := config.maxSupportedVersion()
+	if !ok {
+		return nil, errors.New("tls: no supported versions satisfy MinVersion and MaxVersion")
+	}
+
+	hello := &handshaking.ClientHelloMessage{
+		ClientVersion: version,
+	}
+	// HandshakeConn 导出的工作密钥不包括压缩状态，由它驱动的握手不提供压缩
+	if c.driver == nil {
+		hello.CompressionMethods = config.compressionMethods()
+	}
+	hello.CompressionMethods = append(hello.CompressionMethods, common.CompressionMethodNull)
+
+	// ECDHE 密钥交换需要客户端的加密证书，没有证书时不提供 ECDHE 密码套件
+	for _, id := range config.cipherSuites() {
+		suite := cipherSuiteByID(id)
+		if suite == nil {
+			continue
+		}
+		if suite.kex == KeyExchangeAlgorithmECDHE && len(config.Certificates) < 2 {
+			continue
+		}
+		hello.CipherSuites = append(hello.CipherSuites, id)
+	}
+	if len(hello.CipherSuites) == 0 {
+		return nil, errors.New("tls: no cipher suites available for the client configuration")
+	}
+
+	if c.handshakes > 0 {
+		// 重新协商时携带上一次握手中客户端的 verify_data，定义于 RFC 5746 第 3.5 节
+		hello.Extensions = append(hello.Extensions, handshaking.Extension{
+			Type: handshaking.ExtensionTypeRenegotiationInfo,
+			Data: handshaking.MarshalRenegotiationInfo(c.clientFinished[:]),
+		})
+	} else if config.Renegotiation != RenegotiateNever {
+		hello.CipherSuites = append(hello.CipherSuites, scsvRenegotiation)
+	}
+
+	if serverName := hostnameInSNI(config.ServerName); serverName != "" {
+		hello.Extensions = append(hello.Extensions, handshaking.Extension{
+			Type: handshaking.ExtensionTypeServerName,
+			Data: handshaking.MarshalServerName(serverName),
+		})
+	}
+	if len(config.NextProtos) > 0 {
+		for _, proto := range config.NextProtos {
+			if l := len(proto); l == 0 || l > 255 {
+				return nil, errors.New("tls: invalid NextProtos value")
+			}
+		}
+		hello.Extensions = append(hello.Extensions, handshaking.Extension{
+			Type: handshaking.ExtensionTypeALPN,
+			Data: handshaking.MarshalALPN(config.NextProtos),
+		})
+	}
+
+	random := make([]byte, common.RandomLength)
+	if _, err := io.ReadFull(config.rand(), random[4:]); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	hello.Random = common.RandomFromBytes(random)
+	hello.Random.GMTUnixTime = uint32(config.time().Unix())
+
+	return hello, nil
+}
+
+// clientHandshake 执行客户端握手，定义于 GM/T 0024-2014 第 6.4.4 节。
+func (c *Conn) clientHandshake() error {
+	if c.config == nil {
+		c.config = defaultConfig()
+	}
+	if err := c.config.validate(true); err != nil {
+		return err
+	}
+
+	hello, err := c.makeClientHello()
+	if err != nil {
+		return err
+	}
+
+	hs := &clientHandshakeState{
+		c:            c,
+		hello:        hello,
+		finishedHash: newFinishedHash(),
+	}
+	c.hsState = stateClientWaitServerHello
+	if _, err := c.writeHandshakeRecord(hello, &hs.finishedHash); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	serverHello, ok := msg.(*handshaking.ServerHelloMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(serverHello, msg)
+	}
+	hs.serverHello = serverHello
+
+	if err := c.pickProtocolVersion(serverHello); err != nil {
+		return err
+	}
+
+	return hs.handshake()
+}
+
+// pickProtocolVersion 检查服务端选择的协议版本。
+func (c *Conn) pickProtocolVersion(serverHello *handshaking.ServerHelloMessage) error {
+	if c.handshakes > 0 && serverHello.ServerVersion != c.version {
+		c.sendAlert(AlertProtocolVersion)
+		return fmt.Errorf("tls: server changed protocol version to %s during renegotiation: %w", serverHello.ServerVersion, AlertProtocolVersion)
+	}
+	if !c.config.isSupportedVersion(serverHello.ServerVersion) {
+		c.sendAlert(AlertProtocolVersion)
+		return fmt.Errorf("tls: server selected unsupported protocol version %s: %w", serverHello.ServerVersion, AlertProtocolVersion)
+	}
+
+	c.setVersion(serverHello.ServerVersion)
+	return nil
+}
+
+func (hs *clientHandshakeState) handshake() error {
+	c := hs.c
+
+	if err := hs.pickCipherSuite(); err != nil {
+		return err
+	}
+	if !slices.Contains(hs.hello.CompressionMethods, hs.serverHello.CompressionMethod) {
+		c.sendAlert(AlertUnexpectedMessage)
+		return errors.New("tls: server selected unsupported compression format")
+	}
+	c.compression = hs.serverHello.CompressionMethod
+	c.sessionID = hs.serverHello.SessionID
+	c.serverName = c.config.ServerName
+	if err := hs.checkRenegotiationInfo(); err != nil {
+		return err
+	}
+	if err := hs.checkALPN(); err != nil {
+		return err
+	}
+
+	if err := hs.doFullHandshake(); err != nil {
+		return err
+	}
+	if err := hs.establishKeys(); err != nil {
+		return err
+	}
+	if err := hs.sendFinished(c.clientFinished[:]); err != nil {
+		return err
+	}
+	c.clientFinishedIsFirst = true
+	if err := hs.readFinished(c.serverFinished[:]); err != nil {
+		return err
+	}
+
+	c.isHandshakeComplete.Store(true)
+	return nil
+}
+
+// hostnameInSNI 返回 server_name 扩展中的主机名。IP 地址不能作为主机名，末尾的点会被去掉，定义于 RFC 6066 第 3 节。
+func hostnameInSNI(name string) string {
+	host := name
+	if len(host) > 0 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		host = host[:i]
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	for len(name) > 0 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+func (hs *clientHandshakeState) pickCipherSuite() error {
+	c := hs.c
+
+	if hs.suite = mutualCipherSuite(hs.hello.CipherSuites, hs.serverHello.CipherSuite); hs.suite == nil {
+		c.sendAlert(AlertHandshakeFailure)
+		return errors.New("tls: server chose an unconfigured cipher suite")
+	}
+	c.cipherSuite = hs.suite.id
+	hs.ka = hs.suite.ka()
+	return nil
+}
+
+// checkRenegotiationInfo 检查 ServerHello 中的 renegotiation_info 扩展，定义于 RFC 5746 第 3.4 节和第 3.5 节。
+func (hs *clientHandshakeState) checkRenegotiationInfo() error {
+	c := hs.c
+
+	data, found := handshaking.FindExtension(hs.serverHello.Extensions, handshaking.ExtensionTypeRenegotiationInfo)
+	var renegotiatedConnection []byte
+	if found {
+		var ok bool
+		if renegotiatedConnection, ok = handshaking.UnmarshalRenegotiationInfo(data); !ok {
+			c.sendAlert(AlertDecodeError)
+			return errors.New("tls: server sent an invalid renegotiation_info extension")
+		}
+	}
+
+	if c.handshakes == 0 {
+		if !found {
+			return nil
+		}
+		if len(renegotiatedConnection) != 0 {
+			c.sendAlert(AlertHandshakeFailure)
+			return errors.New("tls: initial handshake had non-empty renegotiation extension")
+		}
+		c.secureRenegotiation = true
+		return nil
+	}
+
+	expected := slices.Concat(c.clientFinished[:], c.serverFinished[:])
+	if !found || !hmac.Equal(renegotiatedConnection, expected) {
+		c.sendAlert(AlertHandshakeFailure)
+		return errors.New("tls: incorrect renegotiation extension contents")
+	}
+	return nil
+}
+
+// checkALPN 检查服务端在 ALPN 扩展中选择的应用层协议。
+func (hs *clientHandshakeState) checkALPN() error {
+	c := hs.c
+
+	data, ok := handshaking.FindExtension(hs.serverHello.Extensions, handshaking.ExtensionTypeALPN)
+	if !ok {
+		return nil
+	}
+	protocols, ok := handshaking.UnmarshalALPN(data)
+	if !ok || len(protocols) != 1 {
+		c.sendAlert(AlertDecodeError)
+		return errors.New("tls: server sent an invalid ALPN extension")
+	}
+	if len(c.config.NextProtos) == 0 {
+		c.sendAlert(AlertUnsupportedExtension)
+		return errors.New("tls: server advertised unrequested ALPN extension")
+	}
+	if !slices.Contains(c.config.NextProtos, protocols[0]) {
+		c.sendAlert(AlertUnsupportedExtension)
+		return errors.New("tls: server selected unadvertised ALPN protocol")
+	}
+	c.clientProtocol = protocols[0]
+	return nil
+}
+
+func (hs *clientHandshakeState) doFullHandshake() error {
+	c := hs.c
+
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	certMsg, ok := msg.(*handshaking.CertificateMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(certMsg, msg)
+	}
+	if err := c.verifyServerCertificate(certMsg.Certificates); err != nil {
+		return err
+	}
+
+	msg, err = c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	skx, ok := msg.(*handshaking.ServerKeyExchangeMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(skx, msg)
+	}
+	c.peerSM2UserID = c.config.peerSM2UserID()
+	err = hs.ka.processServerKeyExchange(c.config, hs.hello, hs.serverHello, c.peerCertificates[0], c.peerCertificates[1], skx)
+	if err != nil {
+		c.sendAlert(AlertDecryptError)
+		return err
+	}
+
+	msg, err = c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+
+	certRequested := false
+	if _, ok := msg.(*handshaking.CertificateRequestMessage); ok {
+		certRequested = true
+		msg, err = c.readHandshake(&hs.finishedHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	shd, ok := msg.(*handshaking.ServerHelloDoneMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(shd, msg)
+	}
+
+	// 如果服务端请求了证书，发送签名证书、加密证书和签名证书的 CA 证书；没有证书时发送空的 Certificate 消息
+	var signCert, encCert *Certificate
+	if len(c.config.Certificates) >= 2 {
+		signCert = &c.config.Certificates[0]
+		encCert = &c.config.Certificates[1]
+	}
+	if certRequested {
+		certMsg := new(handshaking.CertificateMessage)
+		if signCert != nil {
+			certMsg.Certificates = append(certMsg.Certificates, signCert.Certificate[0], encCert.Certificate[0])
+			certMsg.Certificates = append(certMsg.Certificates, signCert.Certificate[1:]...)
+		}
+		if _, err := c.writeHandshakeRecord(certMsg, &hs.finishedHash); err != nil {
+			return err
+		}
+	}
+
+	preMasterSecret, ckx, err := hs.ka.generateClientKeyExchange(c.config, hs.hello, encCert, c.peerCertificates[1])
+	if err != nil {
+		c.sendAlert(AlertInternalError)
+		return err
+	}
+	if _, err := c.writeHandshakeRecord(ckx, &hs.finishedHash); err != nil {
+		return err
+	}
+	clientRandom, serverRandom := hs.hello.Random.Bytes(), hs.serverHello.Random.Bytes()
+	hs.masterSecret = masterFromPreMasterSecret(preMasterSecret, clientRandom, serverRandom)
+	if err := c.config.writeKeyLog(keyLogLabelTLS12, clientRandom, hs.masterSecret); err != nil {
+		c.sendAlert(AlertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+	c.setSecurityParameters(hs.suite, hs.masterSecret, clientRandom, serverRandom)
+
+	if certRequested && signCert != nil {
+		signer, err := signerFromCertificate(signCert)
+		if err != nil {
+			c.sendAlert(AlertInternalError)
+			return err
+		}
+		c.localSM2UserID = signCert.sm2UserID()
+		sig, err := common.SignSM2(signer, hs.finishedHash.Sum(), c.localSM2UserID, c.config.rand())
+		if err != nil {
+			c.sendAlert(AlertInternalError)
+			return err
+		}
+		certVerify := &handshaking.CertificateVerifyMessage{Signature: sig}
+		if _, err := c.writeHandshakeRecord(certVerify, &hs.finishedHash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyServerCertificate 解析并验证服务端的签名证书和加密证书。
+func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
+	certs := make([]*x509.Certificate, len(certificates))
+	for i, asn1Data := range certificates {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: failed to parse certificate from server: " + err.Error())
+		}
+		certs[i] = cert
+	}
+
+	if len(certs) < 2 {
+		c.sendAlert(AlertBadCertificate)
+		return errors.New("tls: server must provide a signing certificate and an encryption certificate")
+	}
+	for _, cert := range certs[:2] {
+		if _, ok := sm2PublicKey(cert.PublicKey); !ok {
+			c.sendAlert(AlertUnsupportedCertificate)
+			return fmt.Errorf("tls: server's certificate contains an unsupported type of public key: %T", cert.PublicKey)
+		}
+	}
+
+	if c.handshakes > 0 {
+		// 重新协商时不重新验证证书，只要求服务端的身份没有变化
+		if !certs[0].Equal(c.peerCertificates[0]) || !certs[1].Equal(c.peerCertificates[1]) {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: server's identity changed during renegotiation")
+		}
+	} else {
+		if !c.config.InsecureSkipVerify {
+			opts := x509.VerifyOptions{
+				Roots:         c.config.RootCAs,
+				CurrentTime:   c.config.time(),
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range certs[2:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			// 加密证书不一定包含主机名，只验证它的证书链
+			if _, err := certs[1].Verify(opts); err != nil {
+				c.sendAlert(AlertBadCertificate)
+				return errors.New("tls: failed to verify encryption certificate: " + err.Error())
+			}
+			opts.DNSName = c.config.ServerName
+			chains, err := certs[0].Verify(opts)
+			if err != nil {
+				c.sendAlert(AlertBadCertificate)
+				return errors.New("tls: failed to verify certificate: " + err.Error())
+			}
+			c.verifiedChains = chains
+		}
+
+		c.peerCertificates = certs
+
+		if c.config.VerifyPeerCertificate != nil {
+			if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+				c.sendAlert(AlertBadCertificate)
+				return err
+			}
+		}
+	}
+
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// establishKeys 计算工作密钥，并为 ChangeCipherSpec 之后的记录准备密码算法。
+func (hs *clientHandshakeState) establishKeys() error {
+	c := hs.c
+
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV := keysFromMasterSecret(hs.masterSecret,
+		hs.hello.Random.Bytes(), hs.serverHello.Random.Bytes(), hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
+
+	c.prepareCipherSpec(hs.suite,
+		TrafficKeys{MACKey: serverMAC, Key: serverKey, IV: serverIV},
+		TrafficKeys{MACKey: clientMAC, Key: clientKey, IV: clientIV})
+	return nil
+}
+
+func (hs *clientHandshakeState) sendFinished(out []byte) error {
+	c := hs.c
+
+	if err := c.writeChangeCipherSpecRecord(); err != nil {
+		return err
+	}
+
+	finished := &handshaking.FinishedMessage{VerifyData: hs.finishedHash.clientSum(hs.masterSecret)}
+	if _, err := c.writeHandshakeRecord(finished, &hs.finishedHash); err != nil {
+		return err
+	}
+	copy(out, finished.VerifyData)
+	return nil
+}
+
+func (hs *clientHandshakeState) readFinished(out []byte) error {
+	c := hs.c
+
+	if err := c.readChangeCipherSpec(); err != nil {
+		return err
+	}
+
+	verify := hs.finishedHash.serverSum(hs.masterSecret)
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	serverFinished, ok := msg.(*handshaking.FinishedMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(serverFinished, msg)
+	}
+	if !hmac.Equal(verify, serverFinished.VerifyData) {
+		c.sendAlert(AlertDecryptError)
+		return errors.New("tls: server's Finished message is incorrect")
+	}
+	copy(out, serverFinished.VerifyData)
+	return nil
+}
@@ -0,0 +1,308 @@
+package gmtls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// EncryptionLevel 表示握手消息所处的保护级别。
+//
+// TLCP 通过 ChangeCipherSpec 消息切换记录的保护方式，HandshakeConn 不产生也不接收 ChangeCipherSpec 消息，
+// 而是用保护级别表示切换：ChangeCipherSpec 之前的握手消息属于 EncryptionLevelInitial，
+// 之后的 Finished 消息属于 EncryptionLevelApplication。
+type EncryptionLevel int
+
+const (
+	// EncryptionLevelInitial 表示明文传输的握手消息。
+	EncryptionLevelInitial EncryptionLevel = iota
+	// EncryptionLevelApplication 表示使用工作密钥保护的握手消息和应用数据。
+	EncryptionLevelApplication
+)
+
+func (l EncryptionLevel) String() string {
+	switch l {
+	case EncryptionLevelInitial:
+		return "Initial"
+	case EncryptionLevelApplication:
+		return "Application"
+	default:
+		return fmt.Sprintf("EncryptionLevel(%d)", int(l))
+	}
+}
+
+// TrafficKeys 是一个方向上保护记录使用的工作密钥，由主密钥计算得到，定义于 GM/T 0024-2014 第 6.5.2 节。
+type TrafficKeys struct {
+	// CipherSuite 是协商的密码套件。
+	CipherSuite uint16
+
+	// MACKey 是校验算法使用的密钥。
+	MACKey []byte
+
+	// Key 是加密算法使用的密钥。
+	Key []byte
+
+	// IV 是加密算法使用的初始向量。
+	IV []byte
+}
+
+// HandshakeEventKind 是 HandshakeEvent 的类型。
+type HandshakeEventKind int
+
+const (
+	// HandshakeNoEvent 表示当前没有更多的事件。
+	HandshakeNoEvent HandshakeEventKind = iota
+
+	// HandshakeWriteData 表示需要把 Data 中的握手消息以 Level 级别发送给对方。
+	HandshakeWriteData
+
+	// HandshakeSetReadKeys 表示之后从对方收到的 Level 级别的数据使用 Keys 解密。
+	HandshakeSetReadKeys
+
+	// HandshakeSetWriteKeys 表示之后发送给对方的 Level 级别的数据使用 Keys 加密。
+	// 对方从该事件之后收到的数据切换保护级别，相当于 ChangeCipherSpec 消息。
+	HandshakeSetWriteKeys
+
+	// HandshakeDone 表示握手已经完成。
+	HandshakeDone
+)
+
+// HandshakeEvent 是 HandshakeConn 产生的事件。
+type HandshakeEvent struct {
+	Kind HandshakeEventKind
+
+	// Level 是 HandshakeWriteData、HandshakeSetReadKeys 和 HandshakeSetWriteKeys 事件的保护级别。
+	Level EncryptionLevel
+
+	// Data 是 HandshakeWriteData 事件需要发送的数据。
+	Data []byte
+
+	// Keys 是 HandshakeSetReadKeys 和 HandshakeSetWriteKeys 事件的工作密钥。
+	Keys TrafficKeys
+}
+
+// HandshakeConn 在不依赖 net.Conn 的情况下执行 TLCP 握手，接口参考了 crypto/tls 的 QUICConn。
+//
+// 调用方负责在自己的传输（串口、消息队列、WebSocket 等）上收发握手消息：
+// 用 HandleData 交给 HandshakeConn 对方发送的握手消息，再用 NextEvent 取出需要发送的数据、
+// 密钥切换和握手完成等事件。握手完成后，调用方使用事件中的工作密钥保护应用数据。
+//
+// HandshakeConn 的方法不能被多个 goroutine 同时调用。
+type HandshakeConn struct {
+	conn *Conn
+}
+
+// HandshakeClient 返回一个使用 config 作为客户端进行握手的 HandshakeConn。
+// 配置 config 不能为 nil：必须设置 ServerName 或 InsecureSkipVerify 之一。
+func HandshakeClient(config *Config) *HandshakeConn {
+	return newHandshakeConn(Client(nil, config))
+}
+
+// HandshakeServer 返回一个使用 config 作为服务端进行握手的 HandshakeConn。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+func HandshakeServer(config *Config) *HandshakeConn {
+	return newHandshakeConn(Server(nil, config))
+}
+
+func newHandshakeConn(conn *Conn) *HandshakeConn {
+	conn.driver = &handshakeDriver{
+		signalc:  make(chan struct{}),
+		blockedc: make(chan struct{}),
+	}
+	return &HandshakeConn{conn: conn}
+}
+
+// Start 开始握手。客户端在 Start 返回后即可通过 NextEvent 取得 ClientHello。
+//
+// ctx 在握手完成前结束时握手失败。Start 返回之后 ctx 仍然有效，直到握手结束。
+func (q *HandshakeConn) Start(ctx context.Context) error {
+	d := q.conn.driver
+	if d.started {
+		return errors.New("tls: Start called more than once")
+	}
+	d.started = true
+	go q.conn.HandshakeContext(ctx)
+	if _, ok := <-d.blockedc; !ok {
+		return q.conn.handshakeErr
+	}
+	return nil
+}
+
+// NextEvent 返回下一个事件，没有更多事件时返回 Kind 为 HandshakeNoEvent 的事件。
+func (q *HandshakeConn) NextEvent() HandshakeEvent {
+	d := q.conn.driver
+	if d.nextEvent >= len(d.events) {
+		d.events = d.events[:0]
+		d.nextEvent = 0
+		return HandshakeEvent{Kind: HandshakeNoEvent}
+	}
+	e := d.events[d.nextEvent]
+	d.events[d.nextEvent] = HandshakeEvent{}
+	d.nextEvent++
+	return e
+}
+
+// HandleData 处理从对方收到的 level 级别的握手数据。data 不需要包含完整的握手消息。
+//
+// 对方可能在本端切换读取密钥之前就发送了 EncryptionLevelApplication 级别的 Finished 消息，
+// 这些数据会被保存下来，在 HandshakeSetReadKeys 事件之后处理。
+//
+// 握手失败时返回的错误可以用 errors.As 取得 AlertError，调用方应当通过自己的传输把报警通知对方。
+func (q *HandshakeConn) HandleData(level EncryptionLevel, data []byte) error {
+	c := q.conn
+	d := c.driver
+	if !d.started {
+		return errors.New("tls: HandleData called before Start")
+	}
+	if level < d.readLevel || level > EncryptionLevelApplication {
+		return fmt.Errorf("tls: handshake data received at level %s when expecting level %s", level, d.readLevel)
+	}
+	if level > d.readLevel {
+		d.pending = append(d.pending, data...)
+		return nil
+	}
+
+	d.readbuf = data
+	<-d.signalc
+	if _, ok := <-d.blockedc; ok {
+		// 握手 goroutine 在等待更多数据
+		return nil
+	}
+
+	// 握手已经结束
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	if len(d.readbuf) > 0 || c.hand.Len() > 0 {
+		d.readbuf = nil
+		return errors.New("tls: received handshake data after the handshake completed")
+	}
+	return nil
+}
+
+// ConnectionState 返回连接的基本信息。
+func (q *HandshakeConn) ConnectionState() ConnectionState {
+	return q.conn.ConnectionState()
+}
+
+// Close 中止尚未完成的握手，并返回握手的错误。
+func (q *HandshakeConn) Close() error {
+	d := q.conn.driver
+	if d.cancel == nil {
+		return nil
+	}
+	d.cancel()
+	for range d.blockedc {
+		// 等待握手 goroutine 退出
+	}
+	return q.conn.handshakeErr
+}
+
+// handshakeDriver 保存由 HandshakeConn 驱动握手时的状态。
+//
+// 握手在单独的 goroutine 中执行，需要更多数据时通过 blockedc 把控制权交还给调用 HandshakeConn 方法的 goroutine，
+// 调用方提供数据后通过 signalc 让握手继续执行。握手结束时关闭这两个 channel。
+type handshakeDriver struct {
+	events    []HandshakeEvent
+	nextEvent int
+	started   bool
+
+	signalc  chan struct{} // 握手 goroutine 可以继续执行
+	blockedc chan struct{} // 握手 goroutine 在等待数据
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	readLevel  EncryptionLevel
+	writeLevel EncryptionLevel
+	readKeys   TrafficKeys
+	writeKeys  TrafficKeys
+
+	readbuf []byte // HandleData 交给握手 goroutine 的数据
+	pending []byte // 提前收到的更高级别的数据
+}
+
+// driverWaitForSignal 等待调用方通过 HandleData 提供更多的握手数据。调用方必须持有 c.handshakeMutex 和 c.in 锁。
+func (c *Conn) driverWaitForSignal() error {
+	// 等待期间释放 handshakeMutex，调用方可以在握手完成前调用 ConnectionState
+	c.handshakeMutex.Unlock()
+	defer c.handshakeMutex.Lock()
+
+	d := c.driver
+	select {
+	case d.blockedc <- struct{}{}:
+	case <-d.ctx.Done():
+		c.sendAlert(AlertUserCanceled)
+		return d.ctx.Err()
+	}
+	select {
+	case d.signalc <- struct{}{}:
+		c.hand.Write(d.readbuf)
+		d.readbuf = nil
+	case <-d.ctx.Done():
+		c.sendAlert(AlertUserCanceled)
+		return d.ctx.Err()
+	}
+	return nil
+}
+
+// driverSetReadKeys 代替读取 ChangeCipherSpec 消息，切换读取方向的保护级别。调用方必须持有 c.in 锁。
+func (c *Conn) driverSetReadKeys() error {
+	if c.hand.Len() > 0 {
+		c.sendAlert(AlertUnexpectedMessage)
+		return c.in.setErrorLocked(errors.New("tls: unexpected handshake data before ChangeCipherSpec"))
+	}
+
+	d := c.driver
+	d.readLevel = EncryptionLevelApplication
+	d.events = append(d.events, HandshakeEvent{Kind: HandshakeSetReadKeys, Level: d.readLevel, Keys: d.readKeys})
+	c.hand.Write(d.pending)
+	d.pending = nil
+	return nil
+}
+
+// driverSetWriteKeys 代替发送 ChangeCipherSpec 消息，切换写入方向的保护级别。调用方必须持有 c.out 锁。
+func (c *Conn) driverSetWriteKeys() {
+	d := c.driver
+	d.writeLevel = EncryptionLevelApplication
+	d.events = append(d.events, HandshakeEvent{Kind: HandshakeSetWriteKeys, Level: d.writeLevel, Keys: d.writeKeys})
+}
+
+// driverWriteData 代替写入握手记录，产生 HandshakeWriteData 事件。调用方必须持有 c.out 锁。
+func (c *Conn) driverWriteData(data []byte) {
+	d := c.driver
+	if n := len(d.events); n > d.nextEvent {
+		// 与上一个同级别的写入事件合并
+		if last := &d.events[n-1]; last.Kind == HandshakeWriteData && last.Level == d.writeLevel {
+			last.Data = append(last.Data, data...)
+			return
+		}
+	}
+	d.events = append(d.events, HandshakeEvent{
+		Kind:  HandshakeWriteData,
+		Level: d.writeLevel,
+		Data:  append([]byte(nil), data...),
+	})
+}
+
+// driverFinish 在握手结束后通知 HandshakeConn。调用方必须持有 c.handshakeMutex。
+func (c *Conn) driverFinish() {
+	d := c.driver
+	if c.handshakeErr == nil {
+		d.events = append(d.events, HandshakeEvent{Kind: HandshakeDone})
+	} else {
+		// 报警没有被发送，调用方需要从错误中取得报警并发送给对方。没有发送报警的错误按 internal_error 处理。
+		var alertErr AlertError
+		if !errors.As(c.handshakeErr, &alertErr) {
+			c.out.Lock()
+			if !errors.As(c.out.err, &alertErr) {
+				alertErr = AlertError{Level: AlertLevelFatal, Description: AlertInternalError}
+			}
+			c.out.Unlock()
+			c.handshakeErr = fmt.Errorf("%w%.0w", c.handshakeErr, alertErr)
+		}
+	}
+	close(d.blockedc)
+	close(d.signalc)
+}
@@ -0,0 +1,163 @@
+package gmtls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// runHandshakeConns 在内存中交换两个 HandshakeConn 产生的握手数据，直到双方都完成握手或者出错。
+// 返回双方产生的除 HandshakeWriteData 以外的事件。
+func runHandshakeConns(t *testing.T, client, server *HandshakeConn) (clientEvents, serverEvents []HandshakeEvent, err error) {
+	t.Helper()
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	drain := func(from, to *HandshakeConn, events *[]HandshakeEvent) (bool, error) {
+		progress := false
+		for {
+			e := from.NextEvent()
+			switch e.Kind {
+			case HandshakeNoEvent:
+				return progress, nil
+			case HandshakeWriteData:
+				if err := to.HandleData(e.Level, e.Data); err != nil {
+					return true, err
+				}
+			default:
+				*events = append(*events, e)
+			}
+			progress = true
+		}
+	}
+
+	for {
+		p1, err := drain(client, server, &clientEvents)
+		if err != nil {
+			return clientEvents, serverEvents, err
+		}
+		p2, err := drain(server, client, &serverEvents)
+		if err != nil {
+			return clientEvents, serverEvents, err
+		}
+		if !p1 && !p2 {
+			return clientEvents, serverEvents, nil
+		}
+	}
+}
+
+func findEvent(events []HandshakeEvent, kind HandshakeEventKind) (HandshakeEvent, bool) {
+	for _, e := range events {
+		if e.Kind == kind {
+			return e, true
+		}
+	}
+	return HandshakeEvent{}, false
+}
+
+func TestHandshakeConn(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	client := HandshakeClient(clientConfig)
+	server := HandshakeServer(serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	clientEvents, serverEvents, err := runHandshakeConns(t, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, events := range [][]HandshakeEvent{clientEvents, serverEvents} {
+		if len(events) == 0 || events[len(events)-1].Kind != HandshakeDone {
+			t.Fatalf("handshake did not complete, events %v", events)
+		}
+	}
+
+	clientRead, _ := findEvent(clientEvents, HandshakeSetReadKeys)
+	clientWrite, _ := findEvent(clientEvents, HandshakeSetWriteKeys)
+	serverRead, _ := findEvent(serverEvents, HandshakeSetReadKeys)
+	serverWrite, _ := findEvent(serverEvents, HandshakeSetWriteKeys)
+	for _, e := range []HandshakeEvent{clientRead, clientWrite, serverRead, serverWrite} {
+		if e.Level != EncryptionLevelApplication {
+			t.Errorf("%v event at level %s, want Application", e.Kind, e.Level)
+		}
+		if e.Keys.CipherSuite != CipherSuite_ECC_SM4_SM3 || len(e.Keys.MACKey) != 32 || len(e.Keys.Key) != 16 || len(e.Keys.IV) != 16 {
+			t.Errorf("%v event has unexpected keys %+v", e.Kind, e.Keys)
+		}
+	}
+	if !equalTrafficKeys(clientWrite.Keys, serverRead.Keys) || !equalTrafficKeys(serverWrite.Keys, clientRead.Keys) {
+		t.Error("client and server derived different traffic keys")
+	}
+	if bytes.Equal(clientWrite.Keys.Key, serverWrite.Keys.Key) {
+		t.Error("client and server write keys are equal")
+	}
+
+	cs, ss := client.ConnectionState(), server.ConnectionState()
+	if !cs.HandshakeComplete || !ss.HandshakeComplete {
+		t.Fatal("ConnectionState reports an incomplete handshake")
+	}
+	if !bytes.Equal(cs.TLSUnique, ss.TLSUnique) {
+		t.Error("TLSUnique differs between client and server")
+	}
+	ckm, err := cs.ExportKeyingMaterial("EXPORTER-test", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skm, err := ss.ExportKeyingMaterial("EXPORTER-test", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ckm, skm) {
+		t.Error("exported keying material differs between client and server")
+	}
+}
+
+func equalTrafficKeys(a, b TrafficKeys) bool {
+	return a.CipherSuite == b.CipherSuite && bytes.Equal(a.MACKey, b.MACKey) && bytes.Equal(a.Key, b.Key) && bytes.Equal(a.IV, b.IV)
+}
+
+func TestHandshakeConnAlert(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+	server := HandshakeServer(serverConfig)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未知类型的握手消息
+	err := server.HandleData(EncryptionLevelInitial, []byte{99, 0, 0, 0})
+	var alertErr AlertError
+	if !errors.As(err, &alertErr) || alertErr.Description != AlertUnexpectedMessage {
+		t.Fatalf("HandleData = %v, want unexpected_message alert", err)
+	}
+	if err := server.Close(); err == nil {
+		t.Error("Close after a failed handshake returned nil")
+	}
+}
+
+func TestHandshakeConnClose(t *testing.T) {
+	_, clientConfig := testConfigs(t)
+	client := HandshakeClient(clientConfig)
+	if err := client.HandleData(EncryptionLevelInitial, nil); err == nil {
+		t.Error("HandleData before Start succeeded")
+	}
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e := client.NextEvent(); e.Kind != HandshakeWriteData || e.Level != EncryptionLevelInitial {
+		t.Fatalf("first event is %v at level %s, want ClientHello", e.Kind, e.Level)
+	}
+
+	err := client.Close()
+	var alertErr AlertError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &alertErr) || alertErr.Description != AlertUserCanceled {
+		t.Fatalf("Close = %v, want context.Canceled with user_canceled alert", err)
+	}
+	if err := client.HandleData(EncryptionLevelInitial, []byte{2, 0, 0, 0}); !errors.Is(err, context.Canceled) {
+		t.Errorf("HandleData after Close = %v, want context.Canceled", err)
+	}
+}
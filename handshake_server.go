@@ -0,0 +1,522 @@
+package gmtls
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	x509 "github.com/tjfoc/gmsm/x509"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// serverHandshakeState 保存服务端握手过程中的状态。
+type serverHandshakeState struct {
+	c            *Conn
+	clientHello  *handshaking.ClientHelloMessage
+	hello        *handshaking.ServerHelloMessage
+	suite        *cipherSuite
+	ka           keyAgreement
+	signCert     *Certificate
+	encCert      *Certificate
+	finishedHash finishedHash
+	masterSecret []byte
+
+	// peerEncCert 是客户端的加密证书，客户端没有发送证书时为 nil
+	peerEncCert *x509.Certificate
+}
+
+// serverHandshake 执行服务端握手，定义于 GM/T 0024-2014 第 6.4.4 节。
+func (c *Conn) serverHandshake() error {
+	if err := c.config.validate(false); err != nil {
+		c.sendAlert(AlertInternalError)
+		return err
+	}
+	hs := serverHandshakeState{
+		c:            c,
+		finishedHash: newFinishedHash(),
+	}
+	c.hsState = stateServerWaitClientHello
+	return hs.handshake()
+}
+
+func (hs *serverHandshakeState) handshake() error {
+	c := hs.c
+
+	if err := hs.readClientHello(); err != nil {
+		return err
+	}
+	if err := hs.processClientHello(); err != nil {
+		return err
+	}
+	if err := hs.doFullHandshake(); err != nil {
+		return err
+	}
+	if err := hs.establishKeys(); err != nil {
+		return err
+	}
+	if err := hs.readFinished(c.clientFinished[:]); err != nil {
+		return err
+	}
+	c.clientFinishedIsFirst = true
+	if err := hs.sendFinished(c.serverFinished[:]); err != nil {
+		return err
+	}
+
+	c.isHandshakeComplete.Store(true)
+	return nil
+}
+
+// readClientHello 读取 ClientHello 消息并协商协议版本。
+func (hs *serverHandshakeState) readClientHello() error {
+	c := hs.c
+
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	clientHello, ok := msg.(*handshaking.ClientHelloMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(clientHello, msg)
+	}
+	hs.clientHello = clientHello
+
+	version, ok := c.config.mutualVersion(clientHello.ClientVersion)
+	if !ok {
+		c.sendAlert(AlertProtocolVersion)
+		return fmt.Errorf("tls: client offered only unsupported versions: %s", clientHello.ClientVersion)
+	}
+	c.setVersion(version)
+	return nil
+}
+
+func (hs *serverHandshakeState) processClientHello() error {
+	c := hs.c
+
+	hs.signCert = &c.config.Certificates[0]
+	hs.encCert = &c.config.Certificates[1]
+
+	hs.hello = &handshaking.ServerHelloMessage{
+		ServerVersion:     c.version,
+		CompressionMethod: common.CompressionMethodNull,
+	}
+
+	foundCompression := slices.Contains(hs.clientHello.CompressionMethods, common.CompressionMethodNull)
+	if c.driver == nil {
+		// 选择服务端优先的、双方都支持的压缩算法
+		for _, method := range c.config.compressionMethods() {
+			if slices.Contains(hs.clientHello.CompressionMethods, method) {
+				hs.hello.CompressionMethod = method
+				foundCompression = true
+				break
+			}
+		}
+	}
+	if !foundCompression {
+		c.sendAlert(AlertHandshakeFailure)
+		return errors.New("tls: client does not support uncompressed connections")
+	}
+	c.compression = hs.hello.CompressionMethod
+
+	if err := hs.checkRenegotiationInfo(); err != nil {
+		return err
+	}
+
+	if data, ok := handshaking.FindExtension(hs.clientHello.Extensions, handshaking.ExtensionTypeServerName); ok {
+		serverName, ok := handshaking.UnmarshalServerName(data)
+		if !ok {
+			c.sendAlert(AlertDecodeError)
+			return errors.New("tls: client sent an invalid server_name extension")
+		}
+		c.serverName = serverName
+	}
+
+	if data, ok := handshaking.FindExtension(hs.clientHello.Extensions, handshaking.ExtensionTypeALPN); ok {
+		clientProtos, ok := handshaking.UnmarshalALPN(data)
+		if !ok {
+			c.sendAlert(AlertDecodeError)
+			return errors.New("tls: client sent an invalid ALPN extension")
+		}
+		selectedProto, err := negotiateALPN(c.config.NextProtos, clientProtos)
+		if err != nil {
+			c.sendAlert(AlertNoApplicationProtocol)
+			return err
+		}
+		if selectedProto != "" {
+			hs.hello.Extensions = append(hs.hello.Extensions, handshaking.Extension{
+				Type: handshaking.ExtensionTypeALPN,
+				Data: handshaking.MarshalALPN([]string{selectedProto}),
+			})
+			c.clientProtocol = selectedProto
+		}
+	}
+
+	random := make([]byte, common.RandomLength)
+	if _, err := io.ReadFull(c.config.rand(), random[4:]); err != nil {
+		c.sendAlert(AlertInternalError)
+		return err
+	}
+	hs.hello.Random = common.RandomFromBytes(random)
+	hs.hello.Random.GMTUnixTime = uint32(c.config.time().Unix())
+
+	// 没有会话缓存，会话不能恢复。按 RFC 5246 第 7.4.1.3 节发送空的 session_id，表示会话不会被缓存。
+	hs.hello.SessionID = nil
+
+	// 按照服务端的优先级选择双方都支持的密码套件
+	for _, id := range c.config.cipherSuites() {
+		if hs.suite = mutualCipherSuite(hs.clientHello.CipherSuites, id); hs.suite != nil {
+			break
+		}
+	}
+	if hs.suite == nil {
+		c.sendAlert(AlertHandshakeFailure)
+		return errors.New("tls: no cipher suite supported by both client and server")
+	}
+	c.cipherSuite = hs.suite.id
+	hs.hello.CipherSuite = hs.suite.id
+	hs.ka = hs.suite.ka()
+	return nil
+}
+
+// checkRenegotiationInfo 检查客户端的安全重新协商信息并设置 ServerHello 中的 renegotiation_info 扩展，
+// 定义于 RFC 5746 第 3.6 节和第 3.7 节。
+func (hs *serverHandshakeState) checkRenegotiationInfo() error {
+	c := hs.c
+
+	data, found := handshaking.FindExtension(hs.clientHello.Extensions, handshaking.ExtensionTypeRenegotiationInfo)
+	var renegotiatedConnection []byte
+	if found {
+		var ok bool
+		if renegotiatedConnection, ok = handshaking.UnmarshalRenegotiationInfo(data); !ok {
+			c.sendAlert(AlertDecodeError)
+			return errors.New("tls: client sent an invalid renegotiation_info extension")
+		}
+	}
+	scsv := slices.Contains(hs.clientHello.CipherSuites, scsvRenegotiation)
+
+	var reply []byte
+	if c.handshakes == 0 {
+		if len(renegotiatedConnection) != 0 {
+			c.sendAlert(AlertHandshakeFailure)
+			return errors.New("tls: initial handshake had non-empty renegotiation extension")
+		}
+		if !found && !scsv {
+			return nil
+		}
+		c.secureRenegotiation = true
+	} else {
+		// 重新协商时客户端必须在扩展中携带上一次握手的 verify_data，不能使用 SCSV
+		if !c.secureRenegotiation || scsv || !found || !hmac.Equal(renegotiatedConnection, c.clientFinished[:]) {
+			c.sendAlert(AlertHandshakeFailure)
+			return errors.New("tls: incorrect renegotiation extension contents")
+		}
+		reply = slices.Concat(c.clientFinished[:], c.serverFinished[:])
+	}
+
+	hs.hello.Extensions = append(hs.hello.Extensions, handshaking.Extension{
+		Type: handshaking.ExtensionTypeRenegotiationInfo,
+		Data: handshaking.MarshalRenegotiationInfo(reply),
+	})
+	return nil
+}
+
+// negotiateALPN 按服务端的优先级选择双方都支持的应用层协议。任何一方没有配置协议时返回空字符串。
+//
+// 与 crypto/tls 相同，服务端只支持 h2 而客户端提供了 http/1.1 时也返回空字符串，
+// 使 HTTP/2 服务端可以继续处理 HTTP/1.1 客户端。
+func negotiateALPN(serverProtos, clientProtos []string) (string, error) {
+	if len(serverProtos) == 0 || len(clientProtos) == 0 {
+		return "", nil
+	}
+	var http11fallback bool
+	for _, s := range serverProtos {
+		for _, c := range clientProtos {
+			if s == c {
+				return s, nil
+			}
+			if s == "h2" && c == "http/1.1" {
+				http11fallback = true
+			}
+		}
+	}
+	if http11fallback {
+		return "", nil
+	}
+	return "", fmt.Errorf("tls: client requested unsupported application protocols (%q)", clientProtos)
+}
+
+func (hs *serverHandshakeState) doFullHandshake() error {
+	c := hs.c
+
+	if _, err := c.writeHandshakeRecord(hs.hello, &hs.finishedHash); err != nil {
+		return err
+	}
+
+	// 签名证书在前，加密证书在后，其余是签名证书的 CA 证书
+	certMsg := new(handshaking.CertificateMessage)
+	certMsg.Certificates = append(certMsg.Certificates, hs.signCert.Certificate[0], hs.encCert.Certificate[0])
+	certMsg.Certificates = append(certMsg.Certificates, hs.signCert.Certificate[1:]...)
+	if _, err := c.writeHandshakeRecord(certMsg, &hs.finishedHash); err != nil {
+		return err
+	}
+
+	skx, err := hs.ka.generateServerKeyExchange(c.config, hs.signCert, hs.encCert, hs.clientHello, hs.hello)
+	if err != nil {
+		c.sendAlert(AlertHandshakeFailure)
+		return err
+	}
+	c.localSM2UserID = hs.signCert.sm2UserID()
+	if _, err := c.writeHandshakeRecord(skx, &hs.finishedHash); err != nil {
+		return err
+	}
+
+	// ECDHE 密钥交换需要客户端的加密证书，因此总是请求客户端证书
+	certRequested := c.config.ClientAuth >= RequestClientCert || requiresClientCertificate(hs.ka)
+	if certRequested {
+		if err := c.branchHandshakeState(stateServerWaitCertificate); err != nil {
+			return err
+		}
+		certReq := new(handshaking.CertificateRequestMessage)
+		certReq.CertificateTypes = []handshaking.CertificateType{handshaking.ClientCertificateTypeECDSASign}
+		if c.config.ClientCAs != nil {
+			for _, subject := range c.config.ClientCAs.Subjects() {
+				certReq.CertificateAuthorities = append(certReq.CertificateAuthorities, subject)
+			}
+		}
+		if _, err := c.writeHandshakeRecord(certReq, &hs.finishedHash); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.writeHandshakeRecord(new(handshaking.ServerHelloDoneMessage), &hs.finishedHash); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+
+	// 如果请求了客户端证书，客户端必须发送 Certificate 消息，即使其中没有证书
+	var peerCerts [][]byte
+	if certRequested {
+		certMsg, ok := msg.(*handshaking.CertificateMessage)
+		if !ok {
+			c.sendAlert(AlertUnexpectedMessage)
+			return unexpectedMessageError(certMsg, msg)
+		}
+		peerCerts = certMsg.Certificates
+		if err := hs.processCertsFromClient(peerCerts); err != nil {
+			return err
+		}
+
+		msg, err = c.readHandshake(&hs.finishedHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	ckx, ok := msg.(*handshaking.ClientKeyExchangeMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(ckx, msg)
+	}
+	if len(peerCerts) > 0 {
+		if err := c.branchHandshakeState(stateServerWaitCertificateVerify); err != nil {
+			return err
+		}
+	}
+	preMasterSecret, err := hs.ka.processClientKeyExchange(c.config, hs.encCert, hs.peerEncCert, hs.clientHello, ckx)
+	if err != nil {
+		c.sendAlert(AlertIllegalParameter)
+		return err
+	}
+	clientRandom, serverRandom := hs.clientHello.Random.Bytes(), hs.hello.Random.Bytes()
+	hs.masterSecret = masterFromPreMasterSecret(preMasterSecret, clientRandom, serverRandom)
+	if err := c.config.writeKeyLog(keyLogLabelTLS12, clientRandom, hs.masterSecret); err != nil {
+		c.sendAlert(AlertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+	c.setSecurityParameters(hs.suite, hs.masterSecret, clientRandom, serverRandom)
+
+	// 客户端发送了证书时，必须用 CertificateVerify 证明持有签名私钥。
+	// 签名的内容是 CertificateVerify 之前所有握手消息的杂凑值。
+	if len(peerCerts) > 0 {
+		digest := hs.finishedHash.Sum()
+		msg, err = c.readHandshake(&hs.finishedHash)
+		if err != nil {
+			return err
+		}
+		certVerify, ok := msg.(*handshaking.CertificateVerifyMessage)
+		if !ok {
+			c.sendAlert(AlertUnexpectedMessage)
+			return unexpectedMessageError(certVerify, msg)
+		}
+
+		c.peerSM2UserID = c.config.peerSM2UserID()
+		if !common.VerifySM2(c.peerCertificates[0].PublicKey, digest, c.peerSM2UserID, certVerify.Signature) {
+			c.sendAlert(AlertDecryptError)
+			return errors.New("tls: invalid signature by the client certificate")
+		}
+	}
+
+	if c.config.VerifyConnection != nil {
+		if err := c.config.VerifyConnection(c.connectionStateLocked()); err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// processCertsFromClient 解析并根据 Config.ClientAuth 验证客户端的证书。
+func (hs *serverHandshakeState) processCertsFromClient(certificates [][]byte) error {
+	c := hs.c
+
+	certs := make([]*x509.Certificate, len(certificates))
+	for i, asn1Data := range certificates {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: failed to parse client certificate: " + err.Error())
+		}
+		certs[i] = cert
+	}
+
+	if len(certs) == 0 {
+		if requiresClientCertificate(hs.ka) {
+			c.sendAlert(AlertHandshakeFailure)
+			return errors.New("tls: client didn't provide an encryption certificate for ECDHE key exchange")
+		}
+		if requiresClientCert(c.config.ClientAuth) {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: client didn't provide a certificate")
+		}
+		return nil
+	}
+
+	if len(certs) < 2 {
+		c.sendAlert(AlertBadCertificate)
+		return errors.New("tls: client must provide a signing certificate and an encryption certificate")
+	}
+	for _, cert := range certs[:2] {
+		if _, ok := sm2PublicKey(cert.PublicKey); !ok {
+			c.sendAlert(AlertUnsupportedCertificate)
+			return fmt.Errorf("tls: client certificate contains an unsupported public key of type %T", cert.PublicKey)
+		}
+	}
+
+	if c.config.ClientAuth >= VerifyClientCertIfGiven {
+		opts := x509.VerifyOptions{
+			Roots:         c.config.ClientCAs,
+			CurrentTime:   c.config.time(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[2:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		chains, err := certs[0].Verify(opts)
+		if err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: failed to verify client certificate: " + err.Error())
+		}
+		if _, err := certs[1].Verify(opts); err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return errors.New("tls: failed to verify client encryption certificate: " + err.Error())
+		}
+		c.verifiedChains = chains
+	}
+
+	c.peerCertificates = certs
+	hs.peerEncCert = certs[1]
+
+	if c.config.VerifyPeerCertificate != nil {
+		if err := c.config.VerifyPeerCertificate(certificates, c.verifiedChains); err != nil {
+			c.sendAlert(AlertBadCertificate)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// establishKeys 计算工作密钥，并为 ChangeCipherSpec 之后的记录准备密码算法。
+func (hs *serverHandshakeState) establishKeys() error {
+	c := hs.c
+
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV := keysFromMasterSecret(hs.masterSecret,
+		hs.clientHello.Random.Bytes(), hs.hello.Random.Bytes(), hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
+
+	c.prepareCipherSpec(hs.suite,
+		TrafficKeys{MACKey: clientMAC, Key: clientKey, IV: clientIV},
+		TrafficKeys{MACKey: serverMAC, Key: serverKey, IV: serverIV})
+	return nil
+}
+
+func (hs *serverHandshakeState) readFinished(out []byte) error {
+	c := hs.c
+
+	if err := c.readChangeCipherSpec(); err != nil {
+		return err
+	}
+
+	// 在 Finished 消息加入 transcript 之前计算期望的 verify_data
+	verify := hs.finishedHash.clientSum(hs.masterSecret)
+	msg, err := c.readHandshake(&hs.finishedHash)
+	if err != nil {
+		return err
+	}
+	clientFinished, ok := msg.(*handshaking.FinishedMessage)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return unexpectedMessageError(clientFinished, msg)
+	}
+	if !hmac.Equal(verify, clientFinished.VerifyData) {
+		c.sendAlert(AlertDecryptError)
+		return errors.New("tls: client's Finished message is incorrect")
+	}
+	copy(out, clientFinished.VerifyData)
+	return nil
+}
+
+func (hs *serverHandshakeState) sendFinished(out []byte) error {
+	c := hs.c
+
+	if err := c.writeChangeCipherSpecRecord(); err != nil {
+		return err
+	}
+
+	finished := &handshaking.FinishedMessage{VerifyData: hs.finishedHash.serverSum(hs.masterSecret)}
+	if _, err := c.writeHandshakeRecord(finished, &hs.finishedHash); err != nil {
+		return err
+	}
+	copy(out, finished.VerifyData)
+	return nil
+}
+
+// requiresClientCert 报告 ClientAuthType 是否要求客户端提供证书。
+func requiresClientCert(c ClientAuthType) bool {
+	switch c {
+	case RequireAnyClientCert, RequireAndVerifyClientCert:
+		return true
+	default:
+		return false
+	}
+}
+
+// signerFromCertificate 返回证书私钥的 crypto.Signer 实现。
+func signerFromCertificate(cert *Certificate) (crypto.Signer, error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tls: certificate private key does not implement crypto.Signer")
+	}
+	return signer, nil
+}
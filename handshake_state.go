@@ -0,0 +1,165 @@
+package gmtls
+
+import (
+	"fmt"
+
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+// handshakeState 是握手状态机的状态，表示本端正在等待的握手消息，握手流程定义于 GM/T 0024-2014 第 6.4.4 节。
+//
+// 每个状态只允许收到 handshakeTransitions 中列出的消息，其他消息（包括重复的和顺序错误的消息）
+// 都会以 unexpected_message 报警中止握手。ChangeCipherSpec 不是握手消息，由记录层检查。
+type handshakeState uint8
+
+const (
+	// stateIdle 表示不在握手中，也不接受任何握手消息
+	stateIdle handshakeState = iota
+
+	stateClientWaitServerHello
+	stateClientWaitCertificate
+	stateClientWaitServerKeyExchange
+	stateClientWaitCertificateRequest // 可选的 CertificateRequest，或者 ServerHelloDone
+	stateClientWaitServerHelloDone
+	stateClientWaitFinished
+	stateClientWaitResumeFinished // 简化握手中服务端的 Finished，服务端在 ServerHello 之后直接发送
+	stateClientWaitHelloRequest   // 握手完成，只接受服务端的 HelloRequest
+
+	stateServerWaitClientHello
+	stateServerWaitCertificate // 服务端请求了客户端证书
+	stateServerWaitClientKeyExchange
+	stateServerWaitCertificateVerify // 客户端发送了证书
+	stateServerWaitFinished
+	stateServerWaitResumeFinished // 简化握手中客户端的 Finished
+)
+
+func (s handshakeState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case stateClientWaitServerHello:
+		return "client waiting for server_hello"
+	case stateClientWaitCertificate:
+		return "client waiting for certificate"
+	case stateClientWaitServerKeyExchange:
+		return "client waiting for server_key_exchange"
+	case stateClientWaitCertificateRequest:
+		return "client waiting for certificate_request or server_hello_done"
+	case stateClientWaitServerHelloDone:
+		return "client waiting for server_hello_done"
+	case stateClientWaitFinished:
+		return "client waiting for finished"
+	case stateClientWaitResumeFinished:
+		return "client waiting for finished of an abbreviated handshake"
+	case stateClientWaitHelloRequest:
+		return "client waiting for hello_request"
+	case stateServerWaitClientHello:
+		return "server waiting for client_hello"
+	case stateServerWaitCertificate:
+		return "server waiting for certificate"
+	case stateServerWaitClientKeyExchange:
+		return "server waiting for client_key_exchange"
+	case stateServerWaitCertificateVerify:
+		return "server waiting for certificate_verify"
+	case stateServerWaitFinished:
+		return "server waiting for finished"
+	case stateServerWaitResumeFinished:
+		return "server waiting for finished of an abbreviated handshake"
+	default:
+		return fmt.Sprintf("handshakeState(%d)", uint8(s))
+	}
+}
+
+// handshakeTransition 表示收到类型为 typ 的消息后可以进入的状态。
+// next 的第一个元素是默认的下一个状态，其余的是可选消息或简化握手对应的分支，由握手代码通过 Conn.branchHandshakeState 选择。
+type handshakeTransition struct {
+	typ  handshaking.HandshakeType
+	next []handshakeState
+}
+
+// handshakeTransitions 列出了每个状态下允许收到的握手消息。没有列出的状态不接受任何消息。
+//
+// 会话恢复的简化握手中，ServerHello 之后双方直接交换 ChangeCipherSpec 和 Finished。
+// 目前的实现不会恢复会话，不会进入 stateClientWaitResumeFinished 和 stateServerWaitResumeFinished。
+var handshakeTransitions = map[handshakeState][]handshakeTransition{
+	stateClientWaitServerHello: {
+		{handshaking.HandshakeTypeServerHello, []handshakeState{stateClientWaitCertificate, stateClientWaitResumeFinished}},
+	},
+	stateClientWaitCertificate: {
+		{handshaking.HandshakeTypeCertificate, []handshakeState{stateClientWaitServerKeyExchange}},
+	},
+	stateClientWaitServerKeyExchange: {
+		{handshaking.HandshakeTypeServerKeyExchange, []handshakeState{stateClientWaitCertificateRequest}},
+	},
+	stateClientWaitCertificateRequest: {
+		{handshaking.HandshakeTypeCertificateRequest, []handshakeState{stateClientWaitServerHelloDone}},
+		{handshaking.HandshakeTypeServerHelloDone, []handshakeState{stateClientWaitFinished}},
+	},
+	stateClientWaitServerHelloDone: {
+		{handshaking.HandshakeTypeServerHelloDone, []handshakeState{stateClientWaitFinished}},
+	},
+	stateClientWaitFinished: {
+		{handshaking.HandshakeTypeFinished, []handshakeState{stateClientWaitHelloRequest}},
+	},
+	stateClientWaitResumeFinished: {
+		{handshaking.HandshakeTypeFinished, []handshakeState{stateClientWaitHelloRequest}},
+	},
+	stateClientWaitHelloRequest: {
+		{handshaking.HandshakeTypeHelloRequest, []handshakeState{stateClientWaitHelloRequest}},
+	},
+
+	stateServerWaitClientHello: {
+		{handshaking.HandshakeTypeClientHello, []handshakeState{stateServerWaitClientKeyExchange, stateServerWaitCertificate, stateServerWaitResumeFinished}},
+	},
+	stateServerWaitCertificate: {
+		{handshaking.HandshakeTypeCertificate, []handshakeState{stateServerWaitClientKeyExchange}},
+	},
+	stateServerWaitClientKeyExchange: {
+		{handshaking.HandshakeTypeClientKeyExchange, []handshakeState{stateServerWaitFinished, stateServerWaitCertificateVerify}},
+	},
+	stateServerWaitCertificateVerify: {
+		{handshaking.HandshakeTypeCertificateVerify, []handshakeState{stateServerWaitFinished}},
+	},
+	stateServerWaitFinished: {
+		{handshaking.HandshakeTypeFinished, []handshakeState{stateIdle}},
+	},
+	stateServerWaitResumeFinished: {
+		{handshaking.HandshakeTypeFinished, []handshakeState{stateIdle}},
+	},
+}
+
+// transition 返回状态 s 下收到类型为 typ 的消息时的转换，消息不被允许时返回 false。
+func (s handshakeState) transition(typ handshaking.HandshakeType) (handshakeTransition, bool) {
+	for _, t := range handshakeTransitions[s] {
+		if t.typ == typ {
+			return t, true
+		}
+	}
+	return handshakeTransition{}, false
+}
+
+// advanceHandshakeState 检查类型为 typ 的消息在当前状态下是否被允许，并进入默认的下一个状态。
+// 调用方必须持有 c.in 锁。
+func (c *Conn) advanceHandshakeState(typ handshaking.HandshakeType) error {
+	t, ok := c.hsState.transition(typ)
+	if !ok {
+		c.sendAlert(AlertUnexpectedMessage)
+		return c.in.setErrorLocked(fmt.Errorf("tls: received unexpected %s message (%s): %w", typ, c.hsState, AlertUnexpectedMessage))
+	}
+	c.hsBranches = t.next
+	c.hsState = t.next[0]
+	return nil
+}
+
+// branchHandshakeState 在收到最近一条消息后进入 next 而不是默认的下一个状态，用于可选消息和简化握手。
+// next 必须是 handshakeTransitions 中为最近一条消息列出的状态。
+func (c *Conn) branchHandshakeState(next handshakeState) error {
+	for _, s := range c.hsBranches {
+		if s == next {
+			c.hsState = next
+			return nil
+		}
+	}
+	c.sendAlert(AlertInternalError)
+	return fmt.Errorf("tls: internal error: invalid handshake state transition to %s", next)
+}
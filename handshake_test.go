@@ -0,0 +1,1139 @@
+package gmtls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	tjtls "github.com/tjfoc/gmsm/gmtls"
+	x509 "github.com/tjfoc/gmsm/x509"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/fragment"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+	"github.com/nnnewb/gmtls/internal/testcert"
+)
+
+// testPKI 是测试使用的证书：一个根 CA，以及服务端和客户端的签名证书、加密证书。
+type testPKI struct {
+	pool *x509.CertPool
+
+	serverSign, serverEnc Certificate
+	clientSign, clientEnc Certificate
+}
+
+func getTestPKI(t testing.TB) *testPKI {
+	pki, err := testcert.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func(kp testcert.KeyPair) Certificate {
+		return Certificate{Certificate: [][]byte{kp.DER}, PrivateKey: kp.Key, Leaf: kp.Leaf}
+	}
+	return &testPKI{
+		pool:       pki.Pool,
+		serverSign: certificate(pki.ServerSign),
+		serverEnc:  certificate(pki.ServerEnc),
+		clientSign: certificate(pki.ClientSign),
+		clientEnc:  certificate(pki.ClientEnc),
+	}
+}
+
+func testConfigs(t testing.TB) (server, client *Config) {
+	pki := getTestPKI(t)
+	server = &Config{
+		Certificates: []Certificate{pki.serverSign, pki.serverEnc},
+		ClientCAs:    pki.pool,
+	}
+	client = &Config{
+		RootCAs:    pki.pool,
+		ServerName: "server.example",
+	}
+	return server, client
+}
+
+// localPipe 返回一对通过本地回环 TCP 连接的 net.Conn。
+// 与 net.Pipe 不同，写入不需要等待对方读取，握手失败时双方发送报警消息不会死锁。
+func localPipe(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		accepted <- result{conn, err}
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-accepted
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return c1, r.conn
+}
+
+// runHandshake 在本地连接上进行一次握手，并交换一条应用数据。
+func runHandshake(t *testing.T, serverConfig, clientConfig *Config) (serverState, clientState ConnectionState, serverErr, clientErr error) {
+	t.Helper()
+
+	c, s := localPipe(t)
+	server := Server(s, serverConfig)
+	client := Client(c, clientConfig)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer s.Close()
+		if serverErr = server.Handshake(); serverErr != nil {
+			return
+		}
+		buf := make([]byte, 5)
+		if _, serverErr = io.ReadFull(server, buf); serverErr != nil {
+			return
+		}
+		_, serverErr = server.Write(bytes.ToUpper(buf))
+	}()
+
+	clientErr = client.Handshake()
+	if clientErr == nil {
+		if _, clientErr = client.Write([]byte("hello")); clientErr == nil {
+			buf := make([]byte, 5)
+			if _, clientErr = io.ReadFull(client, buf); clientErr == nil && string(buf) != "HELLO" {
+				clientErr = errors.New("unexpected echo " + string(buf))
+			}
+		}
+	}
+	c.Close()
+	<-done
+
+	return server.ConnectionState(), client.ConnectionState(), serverErr, clientErr
+}
+
+func TestHandshake(t *testing.T) {
+	pki := getTestPKI(t)
+
+	tests := []struct {
+		name       string
+		suite      common.CipherSuite
+		clientAuth ClientAuthType
+		clientCert bool
+	}{
+		{"ECC", CipherSuite_ECC_SM4_SM3, NoClientCert, false},
+		{"ECC/ClientAuth", CipherSuite_ECC_SM4_SM3, RequireAndVerifyClientCert, true},
+		{"ECC/RequestNoCert", CipherSuite_ECC_SM4_SM3, RequestClientCert, false},
+		{"ECDHE", CipherSuite_ECDHE_SM4_SM3, NoClientCert, true},
+		{"ECDHE/ClientAuth", CipherSuite_ECDHE_SM4_SM3, RequireAndVerifyClientCert, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, clientConfig := testConfigs(t)
+			serverConfig.ClientAuth = tt.clientAuth
+			clientConfig.CipherSuites = []common.CipherSuite{tt.suite}
+			if tt.clientCert {
+				clientConfig.Certificates = []Certificate{pki.clientSign, pki.clientEnc}
+			}
+
+			serverState, clientState, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+			}
+			for _, state := range []ConnectionState{serverState, clientState} {
+				if !state.HandshakeComplete {
+					t.Error("handshake not complete")
+				}
+				if state.Version != VersionTLCP11 {
+					t.Errorf("got version %s, want %s", state.Version, VersionTLCP11)
+				}
+				if state.CipherSuite != uint16(tt.suite) {
+					t.Errorf("got cipher suite %#04x, want %#04x", state.CipherSuite, tt.suite)
+				}
+				if want := cipherSuiteByID(tt.suite).kex; state.KeyExchangeAlgorithm != want {
+					t.Errorf("got key exchange algorithm %s, want %s", state.KeyExchangeAlgorithm, want)
+				}
+				if state.DidResume {
+					t.Error("DidResume is set")
+				}
+				if state.ServerName != "server.example" {
+					t.Errorf("got server name %q, want %q", state.ServerName, "server.example")
+				}
+			}
+			if len(clientState.SessionID) != 0 || len(serverState.SessionID) != 0 {
+				t.Errorf("non-resumable session has a session ID: client %x, server %x", clientState.SessionID, serverState.SessionID)
+			}
+			if clientState.PeerSigningCertificate != clientState.PeerCertificates[0] ||
+				clientState.PeerEncryptionCertificate != clientState.PeerCertificates[1] {
+				t.Error("client: peer signing and encryption certificates do not match PeerCertificates")
+			}
+			if !bytes.Equal(clientState.PeerEncryptionCertificate.Raw, pki.serverEnc.Certificate[0]) {
+				t.Error("client: PeerEncryptionCertificate is not the server encryption certificate")
+			}
+			if tt.clientCert != (serverState.PeerEncryptionCertificate != nil) {
+				t.Errorf("server: PeerEncryptionCertificate = %v, want client certificate %v", serverState.PeerEncryptionCertificate != nil, tt.clientCert)
+			}
+			if len(clientState.PeerCertificates) != 2 || len(clientState.VerifiedChains) == 0 {
+				t.Errorf("client: unexpected peer certificates %d, verified chains %d", len(clientState.PeerCertificates), len(clientState.VerifiedChains))
+			}
+			if tt.clientAuth == RequireAndVerifyClientCert && len(serverState.VerifiedChains) == 0 {
+				t.Error("server: client certificate was not verified")
+			}
+		})
+	}
+}
+
+func TestHandshakeServerName(t *testing.T) {
+	tests := []struct {
+		serverName, want string
+	}{
+		{"server.example", "server.example"},
+		{"server.example.", "server.example"},
+		{"127.0.0.1", ""},
+		{"::1", ""},
+		{"[fe80::1%eth0]", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			serverConfig, clientConfig := testConfigs(t)
+			clientConfig.ServerName = tt.serverName
+			clientConfig.InsecureSkipVerify = true
+			serverState, clientState, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+			}
+			if serverState.ServerName != tt.want {
+				t.Errorf("server got server name %q, want %q", serverState.ServerName, tt.want)
+			}
+			if clientState.ServerName != tt.serverName {
+				t.Errorf("client reports server name %q, want %q", clientState.ServerName, tt.serverName)
+			}
+		})
+	}
+}
+
+// TestHandshakeSM2UserID 验证双方使用非默认 SM2 用户标识签名、验证签名和协商密钥。
+func TestHandshakeSM2UserID(t *testing.T) {
+	pki := getTestPKI(t)
+	serverID := []byte("server@example")
+	clientID := []byte("client@example")
+
+	withID := func(cert Certificate, id []byte) Certificate {
+		cert.SM2UserID = id
+		return cert
+	}
+
+	tests := []struct {
+		name string
+		// peerOfClient 和 peerOfServer 是客户端和服务端配置的 PeerSM2UserID
+		peerOfClient, peerOfServer []byte
+		// clientFails 和 serverFails 表示哪一方在验证对方的签名时失败
+		clientFails, serverFails bool
+	}{
+		{"Match", serverID, clientID, false, false},
+		{"ServerIDMismatch", nil, clientID, true, false},
+		{"ClientIDMismatch", serverID, []byte("someone else"), false, true},
+	}
+	for _, suite := range []common.CipherSuite{CipherSuite_ECC_SM4_SM3, CipherSuite_ECDHE_SM4_SM3} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/%s", suite, tt.name), func(t *testing.T) {
+				serverConfig, clientConfig := testConfigs(t)
+				serverConfig.Certificates = []Certificate{withID(pki.serverSign, serverID), withID(pki.serverEnc, serverID)}
+				serverConfig.ClientAuth = RequireAndVerifyClientCert
+				serverConfig.PeerSM2UserID = tt.peerOfServer
+				clientConfig.Certificates = []Certificate{withID(pki.clientSign, clientID), withID(pki.clientEnc, clientID)}
+				clientConfig.CipherSuites = []common.CipherSuite{suite}
+				clientConfig.PeerSM2UserID = tt.peerOfClient
+
+				serverState, clientState, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+				if tt.clientFails || tt.serverFails {
+					if tt.clientFails && clientErr == nil || tt.serverFails && serverErr == nil {
+						t.Fatalf("handshake with mismatched SM2 user IDs: server: %v, client: %v", serverErr, clientErr)
+					}
+					return
+				}
+				if serverErr != nil || clientErr != nil {
+					t.Fatalf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+				}
+				if !bytes.Equal(serverState.LocalSM2UserID, serverID) || !bytes.Equal(serverState.PeerSM2UserID, clientID) {
+					t.Errorf("server: local SM2 user ID %q, peer %q", serverState.LocalSM2UserID, serverState.PeerSM2UserID)
+				}
+				if !bytes.Equal(clientState.LocalSM2UserID, clientID) || !bytes.Equal(clientState.PeerSM2UserID, serverID) {
+					t.Errorf("client: local SM2 user ID %q, peer %q", clientState.LocalSM2UserID, clientState.PeerSM2UserID)
+				}
+			})
+		}
+	}
+}
+
+func TestHandshakeRequireClientCert(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	serverConfig.ClientAuth = RequireAndVerifyClientCert
+
+	_, _, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+	if serverErr == nil || !strings.Contains(serverErr.Error(), "didn't provide a certificate") {
+		t.Errorf("server: got %v, want missing certificate error", serverErr)
+	}
+	if clientErr == nil {
+		t.Error("client: handshake succeeded unexpectedly")
+	}
+}
+
+func TestHandshakeBadServerName(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	clientConfig.ServerName = "other.example"
+
+	_, _, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "failed to verify certificate") {
+		t.Errorf("client: got %v, want certificate verification error", clientErr)
+	}
+	if serverErr == nil {
+		t.Error("server: handshake succeeded unexpectedly")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+
+	tests := []struct {
+		name    string
+		version common.ProtocolVersion
+		want    common.ProtocolVersion
+		ok      bool
+	}{
+		{"TLCP", VersionTLCP11, VersionTLCP11, true},
+		{"FutureTLCP", 0x0102, VersionTLCP11, true},
+		{"TLS12", 0x0303, 0, false},
+		{"Old", 0x0100, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := serverConfig.mutualVersion(tt.version)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("mutualVersion(%s) = %s, %v; want %s, %v", tt.version, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	// MinVersion 高于已实现的版本时，没有可用的版本
+	config := &Config{MinVersion: 0x0102}
+	if _, ok := config.maxSupportedVersion(); ok {
+		t.Error("maxSupportedVersion succeeded with MinVersion above all supported versions")
+	}
+}
+
+func TestServerRejectsUnsupportedVersion(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+
+	c, s := localPipe(t)
+	defer c.Close()
+	server := Server(s, serverConfig)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Handshake()
+		s.Close()
+	}()
+
+	hello := &handshaking.ClientHelloMessage{
+		ClientVersion:      0x0303,
+		CipherSuites:       []common.CipherSuite{CipherSuite_ECC_SM4_SM3},
+		CompressionMethods: []common.CompressionMethod{common.CompressionMethodNull},
+	}
+	data, err := handshaking.MarshalMessage(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := append([]byte{byte(fragment.ContentTypeHandshake), 0x03, 0x03, byte(len(data) >> 8), byte(len(data))}, data...)
+	if _, err := c.Write(record); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, recordHeaderLen+2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if fragment.TLSFragmentContentType(reply[0]) != fragment.ContentTypeAlert {
+		t.Fatalf("got record type %d, want alert", reply[0])
+	}
+	var msg handshaking.AlertMessage
+	if err := msg.Unmarshal(reply[recordHeaderLen:]); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Level != AlertLevelFatal || msg.Description != AlertProtocolVersion {
+		t.Errorf("got %s alert %q, want fatal protocol_version", msg.Level, msg.Description)
+	}
+	if err := <-errc; err == nil {
+		t.Error("server handshake succeeded unexpectedly")
+	}
+}
+
+func TestReceivedAlerts(t *testing.T) {
+	tests := []struct {
+		name  string
+		level AlertLevel
+		desc  AlertDescription
+		// fatal 表示服务端是否应当中止握手，否则忽略报警并继续等待 ClientHello
+		fatal bool
+	}{
+		{"Fatal", AlertLevelFatal, AlertBadCertificate, true},
+		{"Warning", AlertLevelWarning, AlertUserCanceled, false},
+		{"WarningButFatal", AlertLevelWarning, AlertHandshakeFailure, true},
+		{"GMFatal", AlertLevelFatal, AlertUnsupportedSite2site, true},
+		{"GMWarning", AlertLevelWarning, AlertNoArea, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, _ := testConfigs(t)
+			c, s := localPipe(t)
+			defer c.Close()
+			server := Server(s, serverConfig)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- server.Handshake()
+				s.Close()
+			}()
+
+			msg := handshaking.AlertMessage{Level: tt.level, Description: tt.desc}
+			record := append([]byte{byte(fragment.ContentTypeAlert), 0x01, 0x01, 0, handshaking.AlertMessageLength}, msg.Marshal()...)
+			if _, err := c.Write(record); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.fatal {
+				// 被忽略的报警之后关闭连接，握手以 EOF 结束
+				c.Close()
+			}
+
+			err := <-errc
+			var alertErr AlertError
+			isAlert := errors.As(err, &alertErr)
+			if tt.fatal != isAlert {
+				t.Fatalf("got error %v, want fatal alert: %v", err, tt.fatal)
+			}
+			if isAlert && (alertErr.Level != tt.level || alertErr.Description != tt.desc) {
+				t.Errorf("got %s alert %q, want %s alert %q", alertErr.Level, alertErr.Description, tt.level, tt.desc)
+			}
+			if tt.fatal && !errors.Is(err, tt.desc) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tt.desc)
+			}
+		})
+	}
+}
+
+func TestALPN(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverProtos []string
+		clientProtos []string
+		want         string
+		ok           bool
+	}{
+		{"Match", []string{"h2", "http/1.1"}, []string{"http/1.1", "h2"}, "h2", true},
+		{"ServerNone", nil, []string{"h2"}, "", true},
+		{"ClientNone", []string{"h2"}, nil, "", true},
+		{"HTTP11Fallback", []string{"h2"}, []string{"http/1.1"}, "", true},
+		{"NoOverlap", []string{"foo"}, []string{"bar"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, clientConfig := testConfigs(t)
+			serverConfig.NextProtos = tt.serverProtos
+			clientConfig.NextProtos = tt.clientProtos
+
+			serverState, clientState, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+			if !tt.ok {
+				if serverErr == nil || clientErr == nil {
+					t.Fatalf("handshake succeeded unexpectedly: server %v, client %v", serverErr, clientErr)
+				}
+				var alertErr AlertError
+				if !errors.As(clientErr, &alertErr) || alertErr.Description != AlertNoApplicationProtocol {
+					t.Errorf("client error %v, want no_application_protocol alert", clientErr)
+				}
+				return
+			}
+			if serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+			}
+			if serverState.NegotiatedProtocol != tt.want || clientState.NegotiatedProtocol != tt.want {
+				t.Errorf("negotiated %q (server), %q (client); want %q", serverState.NegotiatedProtocol, clientState.NegotiatedProtocol, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	var clientLog, serverLog bytes.Buffer
+	clientConfig.KeyLogWriter = &clientLog
+	serverConfig.KeyLogWriter = &serverLog
+
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	client := Client(c, clientConfig)
+	server := Server(s, serverConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	params := client.params
+	want := fmt.Sprintf("CLIENT_RANDOM %x %x\n", params.ClientRandom, params.MasterSecret)
+	if got := clientLog.String(); got != want {
+		t.Errorf("client key log %q, want %q", got, want)
+	}
+	if got := serverLog.String(); got != want {
+		t.Errorf("server key log %q, want %q", got, want)
+	}
+	if server.params.MasterSecret != params.MasterSecret {
+		t.Error("client and server master secrets differ")
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	client := Client(c, clientConfig)
+	server := Server(s, serverConfig)
+
+	state := client.ConnectionState()
+	if _, err := state.ExportKeyingMaterial("EXPORTER-test", nil, 32); err == nil {
+		t.Error("ExportKeyingMaterial succeeded before the handshake")
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	clientState, serverState := client.ConnectionState(), server.ConnectionState()
+	for _, context := range [][]byte{nil, {}, []byte("context")} {
+		clientEKM, err := clientState.ExportKeyingMaterial("EXPORTER-test", context, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverEKM, err := serverState.ExportKeyingMaterial("EXPORTER-test", context, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(clientEKM, serverEKM) || len(clientEKM) != 32 {
+			t.Errorf("context %q: client %x, server %x", context, clientEKM, serverEKM)
+		}
+	}
+
+	// nil 与空的 context 计算方式不同
+	noContext, _ := clientState.ExportKeyingMaterial("EXPORTER-test", nil, 32)
+	emptyContext, _ := clientState.ExportKeyingMaterial("EXPORTER-test", []byte{}, 32)
+	if bytes.Equal(noContext, emptyContext) {
+		t.Error("nil and empty context produced the same keying material")
+	}
+
+	if _, err := clientState.ExportKeyingMaterial("master secret", nil, 32); err == nil {
+		t.Error("ExportKeyingMaterial accepted a reserved label")
+	}
+}
+
+func TestTLSUnique(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	serverState, clientState, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+	if len(clientState.TLSUnique) != finishedVerifyLength {
+		t.Fatalf("got TLSUnique of length %d, want %d", len(clientState.TLSUnique), finishedVerifyLength)
+	}
+	if !bytes.Equal(clientState.TLSUnique, serverState.TLSUnique) {
+		t.Errorf("client TLSUnique %x, server TLSUnique %x", clientState.TLSUnique, serverState.TLSUnique)
+	}
+}
+
+func TestRenegotiation(t *testing.T) {
+	pki := getTestPKI(t)
+
+	tests := []struct {
+		name          string
+		renegotiation RenegotiationSupport
+		// renegotiations 是服务端请求重新协商的次数，accepted 是客户端应当接受的次数
+		renegotiations int
+		accepted       int
+	}{
+		{"Never", RenegotiateNever, 1, 0},
+		{"Once", RenegotiateOnceAsClient, 2, 1},
+		{"Freely", RenegotiateFreelyAsClient, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, clientConfig := testConfigs(t)
+			clientConfig.Certificates = []Certificate{pki.clientSign, pki.clientEnc}
+			clientConfig.Renegotiation = tt.renegotiation
+
+			// 服务端每次握手验证证书时通知测试，此时服务端的 Read 正在执行握手。
+			// 配置在传给 Server 之后不能再修改，因此从第一次握手开始就要求客户端证书
+			serverConfig.ClientAuth = RequireAndVerifyClientCert
+			verified := make(chan ConnectionState, 1)
+			serverConfig.VerifyConnection = func(state ConnectionState) error {
+				verified <- state
+				return nil
+			}
+
+			c, s := localPipe(t)
+			defer c.Close()
+			defer s.Close()
+			client := Client(c, clientConfig)
+			server := Server(s, serverConfig)
+
+			errc := make(chan error, 1)
+			go func() { errc <- server.Handshake() }()
+			if err := client.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			<-verified
+			firstUnique := bytes.Clone(client.ConnectionState().TLSUnique)
+
+			// 服务端在 Read 中处理客户端回应的 ClientHello
+			serverReadc := make(chan error, 1)
+			go func() {
+				_, err := server.Read(make([]byte, 1))
+				serverReadc <- err
+			}()
+
+			for i := 0; i < tt.renegotiations; i++ {
+				// 客户端在 Read 中处理 HelloRequest
+				readc := make(chan error, 1)
+				go func() {
+					buf := make([]byte, 5)
+					_, err := io.ReadFull(client, buf)
+					if err == nil && string(buf) != "hello" {
+						err = errors.New("unexpected data " + string(buf))
+					}
+					readc <- err
+				}()
+
+				if err := server.Renegotiate(); err != nil {
+					t.Fatalf("renegotiation %d: %v", i, err)
+				}
+
+				if i >= tt.accepted {
+					// 客户端以 no_renegotiation 警告拒绝，双方继续使用原来的安全参数交换数据
+					if _, err := server.Write([]byte("hello")); err != nil {
+						t.Fatalf("renegotiation %d: server Write: %v", i, err)
+					}
+					if err := <-readc; err != nil {
+						t.Fatalf("renegotiation %d: client Read: %v", i, err)
+					}
+					if _, err := client.Write([]byte("x")); err != nil {
+						t.Fatalf("renegotiation %d: client Write: %v", i, err)
+					}
+					if err := <-serverReadc; err != nil {
+						t.Fatalf("renegotiation %d: server Read: %v", i, err)
+					}
+					if client.handshakes != tt.accepted+1 {
+						t.Errorf("client completed %d handshakes, want %d", client.handshakes, tt.accepted+1)
+					}
+
+					// 服务端收到警告后不再把客户端发起的握手当作重新协商
+					client.out.Lock()
+					client.writeRecordLocked(fragment.ContentTypeHandshake, []byte{byte(handshaking.HandshakeTypeClientHello), 0, 0, 0})
+					client.out.Unlock()
+					if _, err := server.Read(make([]byte, 1)); !errors.Is(err, AlertUnexpectedMessage) {
+						t.Errorf("server Read after refusal = %v, want unexpected_message", err)
+					}
+					return
+				}
+
+				// 重新协商进行中时 Write 会等待握手完成，数据使用新的密钥发送
+				select {
+				case state := <-verified:
+					if len(state.PeerCertificates) == 0 {
+						t.Errorf("renegotiation %d: server did not receive client certificates", i)
+					}
+				case err := <-serverReadc:
+					t.Fatalf("renegotiation %d: server Read returned %v", i, err)
+				}
+				if _, err := server.Write([]byte("hello")); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-readc; err != nil {
+					t.Fatalf("renegotiation %d: %v", i, err)
+				}
+			}
+
+			if client.handshakes != tt.renegotiations+1 {
+				t.Errorf("client completed %d handshakes, want %d", client.handshakes, tt.renegotiations+1)
+			}
+			if bytes.Equal(client.ConnectionState().TLSUnique, firstUnique) {
+				t.Error("TLSUnique did not change after renegotiation")
+			}
+		})
+	}
+}
+
+func TestRenegotiateErrors(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	client := Client(c, clientConfig)
+	server := Server(s, serverConfig)
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Renegotiate(); err == nil {
+		t.Error("Renegotiate on a client connection succeeded")
+	}
+
+	// 没有请求重新协商时，服务端拒绝客户端发起的握手
+	client.out.Lock()
+	client.writeRecordLocked(fragment.ContentTypeHandshake, []byte{byte(handshaking.HandshakeTypeClientHello), 0, 0, 0})
+	client.out.Unlock()
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, AlertUnexpectedMessage) {
+		t.Errorf("server Read = %v, want unexpected_message", err)
+	}
+}
+
+// TestInteropTjfoc 验证与 github.com/tjfoc/gmsm/gmtls 实现的 ECC 握手互通。
+func TestInteropTjfoc(t *testing.T) {
+	pki := getTestPKI(t)
+	serverConfig, _ := testConfigs(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		server := Server(conn, serverConfig)
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			errc <- err
+			return
+		}
+		_, err = server.Write(bytes.ToUpper(buf))
+		errc <- err
+	}()
+
+	clientConfig := &tjtls.Config{
+		GMSupport:  tjtls.NewGMSupport(),
+		RootCAs:    pki.pool,
+		ServerName: "server.example",
+	}
+	client, err := tjtls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "HELLO" {
+		t.Errorf("got %q, want %q", buf, "HELLO")
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("server: %v", err)
+	}
+}
+
+// readRawRecord 从未加密的连接中读取一个记录，返回记录类型和内容。
+func readRawRecord(t *testing.T, conn io.Reader) (byte, []byte) {
+	t.Helper()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0], body
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+	_, clientConfig := testConfigs(t)
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := Client(c, clientConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- client.HandshakeContext(ctx) }()
+
+	// 服务端收到 ClientHello 之后不再响应，客户端阻塞在读取 ServerHello 上
+	if typ, _ := readRawRecord(t, s); typ != byte(fragment.ContentTypeHandshake) {
+		t.Fatalf("got record type %d, want handshake", typ)
+	}
+	cancel()
+
+	err := <-errc
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("HandshakeContext = %v, want context.Canceled", err)
+	}
+
+	typ, body := readRawRecord(t, s)
+	var alert handshaking.AlertMessage
+	if typ != byte(fragment.ContentTypeAlert) || alert.Unmarshal(body) != nil || alert.Description != AlertUserCanceled {
+		t.Fatalf("got record type %d %x, want user_canceled alert", typ, body)
+	}
+	typ, body = readRawRecord(t, s)
+	if typ != byte(fragment.ContentTypeAlert) || alert.Unmarshal(body) != nil || alert.Description != AlertCloseNotify {
+		t.Fatalf("got record type %d %x, want close_notify alert", typ, body)
+	}
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after close_notify = %v, want EOF", err)
+	}
+
+	// 错误被记录下来，之后的调用直接失败
+	if err := client.Handshake(); !errors.Is(err, context.Canceled) {
+		t.Errorf("second Handshake = %v, want context.Canceled", err)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write = %v, want context.Canceled", err)
+	}
+}
+
+// TestHandshakeContextCancelPeer 检查中断握手之后，对方的握手不会一直等待。
+func TestHandshakeContextCancelPeer(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	c, cPeer := localPipe(t)
+	sPeer, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+	defer cPeer.Close()
+	defer sPeer.Close()
+
+	// 只转发客户端发送的数据，不关闭服务端的连接；服务端的回复被丢弃，客户端阻塞在读取 ServerHello 上
+	go io.Copy(sPeer, cPeer)
+	replied := make(chan struct{})
+	go func() {
+		if _, err := sPeer.Read(make([]byte, 1)); err == nil {
+			close(replied)
+		}
+		io.Copy(io.Discard, sPeer)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- Server(s, serverConfig).Handshake() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clientErr := make(chan error, 1)
+	go func() { clientErr <- Client(c, clientConfig).HandshakeContext(ctx) }()
+
+	<-replied
+	cancel()
+	if err := <-clientErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("client HandshakeContext = %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-serverErr:
+		if err == nil {
+			t.Error("server handshake succeeded after the client cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake did not return after the client cancelled")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	serverConfig, _ := testConfigs(t)
+	serverConfig.HandshakeTimeout = 100 * time.Millisecond
+	c, s := localPipe(t)
+	defer c.Close()
+	defer s.Close()
+
+	// 客户端连接后什么都不发送
+	server := Server(s, serverConfig)
+	start := time.Now()
+	err := server.Handshake()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Handshake = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Handshake took %v", d)
+	}
+}
+
+func TestDialerDialContext(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	ln, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*Conn).Handshake()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	d := &Dialer{Config: clientConfig}
+	conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.(*Conn).ConnectionState().HandshakeComplete {
+		t.Error("handshake not complete")
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", ln.Addr().String()); err == nil {
+		t.Error("DialContext with a cancelled context succeeded")
+	}
+}
+
+func TestHandshakeMessageLimits(t *testing.T) {
+	record := func(typ fragment.TLSFragmentContentType, data ...byte) []byte {
+		return append([]byte{byte(typ), 0x01, 0x01, byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	var fragmented []byte
+	fragmented = append(fragmented, record(fragment.ContentTypeHandshake, 1, 0, 0x10, 0)...)
+	for range maxUselessRecord + 1 {
+		fragmented = append(fragmented, record(fragment.ContentTypeHandshake, 0)...)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    AlertDescription
+		wantErr string
+	}{
+		// 声明了 16MB 长度的 ClientHello，服务端不会等待消息的其余部分
+		{"Oversized", record(fragment.ContentTypeHandshake, 1, 0xff, 0xff, 0xff), AlertInternalError, "exceeds maximum"},
+		{"OversizedSmallMessage", record(fragment.ContentTypeHandshake, 1, 0, 0x40, 1), AlertInternalError, "exceeds maximum"},
+		{"Interleaved", append(record(fragment.ContentTypeHandshake, 1, 0, 0, 10, 1, 1),
+			record(fragment.ContentTypeAlert, 1, byte(AlertUserCanceled))...), AlertUnexpectedMessage, "unexpected message"},
+		{"Fragmented", fragmented, AlertUnexpectedMessage, "too many fragmented handshake records"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, _ := testConfigs(t)
+			c, s := localPipe(t)
+			defer c.Close()
+			defer s.Close()
+			server := Server(s, serverConfig)
+			errc := make(chan error, 1)
+			go func() { errc <- server.Handshake() }()
+
+			if _, err := c.Write(tt.input); err != nil {
+				t.Fatal(err)
+			}
+			typ, body := readRawRecord(t, c)
+			var msg handshaking.AlertMessage
+			if typ != byte(fragment.ContentTypeAlert) || msg.Unmarshal(body) != nil {
+				t.Fatalf("got record type %d, want alert", typ)
+			}
+			if msg.Description != tt.want {
+				t.Errorf("got alert %q, want %q", msg.Description, tt.want)
+			}
+			if err := <-errc; err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("server handshake error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxHandshakeSize(t *testing.T) {
+	serverConfig, clientConfig := testConfigs(t)
+	clientConfig.MaxHandshakeSize = 256
+	_, _, _, clientErr := runHandshake(t, serverConfig, clientConfig)
+	if clientErr == nil || !strings.Contains(clientErr.Error(), "exceeds maximum of 256 bytes") {
+		t.Errorf("client error = %v, want Certificate message size error", clientErr)
+	}
+
+	clientConfig.MaxHandshakeSize = 1 << 20
+	if _, _, serverErr, clientErr := runHandshake(t, serverConfig, clientConfig); serverErr != nil || clientErr != nil {
+		t.Errorf("handshake with a large MaxHandshakeSize failed: server %v, client %v", serverErr, clientErr)
+	}
+}
+
+// recordingConn 记录写入的数据，用于检查本端发送的报警。
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+
+func TestHandshakeStateTransitions(t *testing.T) {
+	states := []handshakeState{stateIdle}
+	for s := stateClientWaitServerHello; s <= stateServerWaitResumeFinished; s++ {
+		states = append(states, s)
+	}
+	types := []handshaking.HandshakeType{
+		handshaking.HandshakeTypeHelloRequest,
+		handshaking.HandshakeTypeClientHello,
+		handshaking.HandshakeTypeServerHello,
+		handshaking.HandshakeTypeHelloVerifyRequest,
+		handshaking.HandshakeTypeCertificate,
+		handshaking.HandshakeTypeServerKeyExchange,
+		handshaking.HandshakeTypeCertificateRequest,
+		handshaking.HandshakeTypeServerHelloDone,
+		handshaking.HandshakeTypeCertificateVerify,
+		handshaking.HandshakeTypeClientKeyExchange,
+		handshaking.HandshakeTypeFinished,
+		99, // 未定义的消息类型
+	}
+
+	for _, state := range states {
+		for _, typ := range types {
+			t.Run(fmt.Sprintf("%s/%s(%d)", state, typ, typ), func(t *testing.T) {
+				rc := new(recordingConn)
+				c := &Conn{conn: rc, config: new(Config), hsState: state}
+				c.hand.Write([]byte{byte(typ), 0, 0, 0})
+				_, err := c.readHandshake(nil)
+
+				transition, valid := state.transition(typ)
+				if valid {
+					if c.hsState != transition.next[0] {
+						t.Errorf("state after %s is %s, want %s", typ, c.hsState, transition.next[0])
+					}
+					return
+				}
+				if !errors.Is(err, AlertUnexpectedMessage) {
+					t.Fatalf("readHandshake error = %v, want unexpected_message", err)
+				}
+				if c.hsState != state {
+					t.Errorf("state changed to %s after a rejected message", c.hsState)
+				}
+				recordType, body := readRawRecord(t, &rc.written)
+				var msg handshaking.AlertMessage
+				if recordType != byte(fragment.ContentTypeAlert) || msg.Unmarshal(body) != nil || msg.Description != AlertUnexpectedMessage {
+					t.Errorf("sent record type %d %x, want unexpected_message alert", recordType, body)
+				}
+			})
+		}
+	}
+
+	// 会话恢复的简化握手：hello 之后转入等待 Finished 的分支，收到 Finished 后握手完成
+	for _, tt := range []struct {
+		start, resume, done handshakeState
+		hello               handshaking.HandshakeType
+	}{
+		{stateClientWaitServerHello, stateClientWaitResumeFinished, stateClientWaitHelloRequest, handshaking.HandshakeTypeServerHello},
+		{stateServerWaitClientHello, stateServerWaitResumeFinished, stateIdle, handshaking.HandshakeTypeClientHello},
+	} {
+		t.Run(fmt.Sprintf("Resume/%s", tt.start), func(t *testing.T) {
+			c := &Conn{conn: new(recordingConn), config: new(Config), hsState: tt.start}
+			c.hand.Write([]byte{byte(tt.hello), 0, 0, 0})
+			c.readHandshake(nil)
+			if err := c.branchHandshakeState(tt.resume); err != nil {
+				t.Fatal(err)
+			}
+			c.hand.Write([]byte{byte(handshaking.HandshakeTypeFinished), 0, 0, 0})
+			c.readHandshake(nil)
+			if c.hsState != tt.done {
+				t.Errorf("state after finished of an abbreviated handshake is %s, want %s", c.hsState, tt.done)
+			}
+		})
+	}
+}
+
+func TestHandshakeStateBranch(t *testing.T) {
+	rc := new(recordingConn)
+	c := &Conn{conn: rc, config: new(Config), hsState: stateServerWaitClientHello}
+	c.hand.Write([]byte{byte(handshaking.HandshakeTypeClientHello), 0, 0, 0})
+	c.readHandshake(nil)
+	if c.hsState != stateServerWaitClientKeyExchange {
+		t.Fatalf("state after client_hello is %s", c.hsState)
+	}
+	if err := c.branchHandshakeState(stateServerWaitCertificate); err != nil {
+		t.Fatal(err)
+	}
+	if c.hsState != stateServerWaitCertificate {
+		t.Fatalf("state after branch is %s", c.hsState)
+	}
+	if err := c.branchHandshakeState(stateServerWaitFinished); err == nil {
+		t.Error("branch to a state not listed for client_hello succeeded")
+	}
+}
+
+func TestECCPreMasterSecretVersion(t *testing.T) {
+	pki := getTestPKI(t)
+	config := new(Config)
+	ka := eccKA()
+	hello := &handshaking.ClientHelloMessage{ClientVersion: VersionTLCP11}
+
+	for _, tt := range []struct {
+		name    string
+		version ProtocolVersion
+	}{
+		{"MatchingVersion", VersionTLCP11},
+		{"RollbackVersion", 0x0100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientHello := &handshaking.ClientHelloMessage{ClientVersion: tt.version}
+			want, ckx, err := ka.generateClientKeyExchange(config, clientHello, nil, pki.serverEnc.Leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ka.processClientKeyExchange(config, &pki.serverEnc, nil, hello, ckx)
+			if err != nil {
+				t.Fatalf("processClientKeyExchange: %v", err)
+			}
+			if matched := bytes.Equal(got, want); matched != (tt.version == VersionTLCP11) {
+				t.Errorf("pre_master_secret matched = %v with client_version %s", matched, tt.version)
+			}
+		})
+	}
+
+	// 无法解密的密文不应当报错，而是得到随机的 pre_master_secret
+	ckx := &handshaking.ClientKeyExchangeMessage{Key: []byte{0, 4, 1, 2, 3, 4}}
+	got, err := ka.processClientKeyExchange(config, &pki.serverEnc, nil, hello, ckx)
+	if err != nil || len(got) != handshaking.PreMasterSecretLength {
+		t.Errorf("processClientKeyExchange of garbage = %x, %v, want a random secret", got, err)
+	}
+}
@@ -6,6 +6,7 @@ type CompressionMethod uint8
 
 const (
 	CompressionMethodNull    CompressionMethod = 0
+	CompressionMethodDeflate CompressionMethod = 1 // 定义于 RFC 3749
 	CompressionMethodMaximum CompressionMethod = 255
 )
 
@@ -15,6 +16,8 @@ func (c CompressionMethod) String() string {
 	switch c {
 	case CompressionMethodNull:
 		return "null"
+	case CompressionMethodDeflate:
+		return "deflate"
 	default:
 		return "unknown"
 	}
@@ -62,7 +62,8 @@ func PHash(result, secret, seed []byte, hash func() hash.Hash) {
 
 // PHashSM3 implements the optimized zero allocation P_SM3 function, as defined in GM/T 0024-2014, section 5.
 func PHashSM3(result, secret, seed []byte) {
-	var a [32]byte // round output, length equals to sm3.Size
+	var a [32]byte   // A(i), length equals to sm3.Size
+	var out [32]byte // HMAC_SM3(secret, A(i) + seed)
 	h := hmac.New(sm3.New, secret)
 	h.Write(seed)
 	h.Sum(a[:0]) // let a = A(1)
@@ -72,19 +73,19 @@ func PHashSM3(result, secret, seed []byte) {
 		h.Reset()
 		h.Write(a[:])
 		h.Write(seed)
-		h.Sum(a[:0])
+		h.Sum(out[:0])
 
-		copy(result[j:], a[:])
+		copy(result[j:], out[:])
 
-		if j+len(a) >= len(result) {
+		if j+len(out) >= len(result) {
 			break
 		}
 
-		j += len(a)
+		j += len(out)
 
 		h.Reset()
 		h.Write(a[:])
-		h.Sum(a[:0])
+		h.Sum(a[:0]) // let a = A(i+1)
 	}
 }
 
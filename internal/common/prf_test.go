@@ -61,6 +61,16 @@ func Test_PHash(t *testing.T) {
 	}
 }
 
+func Test_PHashSM3(t *testing.T) {
+	for _, n := range []int{12, 32, 48, 80, 100} {
+		expected := make([]byte, n)
+		common.PHash(expected, []byte("secret"), []byte("seed"), sm3.New)
+		actual := make([]byte, n)
+		common.PHashSM3(actual, []byte("secret"), []byte("seed"))
+		assert.Equal(t, expected, actual, "result length %d", n)
+	}
+}
+
 func Benchmark_PHash(b *testing.B) {
 	result := make([]byte, 512)
 	secret := []byte("secret")
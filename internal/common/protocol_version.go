@@ -6,16 +6,40 @@ import (
 
 // ProtocolVersion 定义于 GM/T 0024-2014 第 6.3.2.1 节
 // 记录层协议版本号，GM/T 0024-2014 标准的协议版本号固定为 1.1
-type ProtocolVersion [2]uint8
+//
+// 网络传输时先发送主版本号，再发送次版本号。
+type ProtocolVersion uint16
+
+const (
+	// VersionGMSSL11 是 GM/T 0024-2014《SSL VPN 技术规范》定义的协议版本 1.1。
+	VersionGMSSL11 ProtocolVersion = 0x0101
+
+	// VersionTLCP11 是 GB/T 38636-2020《传输层密码协议（TLCP）》定义的协议版本 1.1，与 VersionGMSSL11 相同。
+	VersionTLCP11 = VersionGMSSL11
+
+	// VersionDTLCP11 是 DTLCP 记录层使用的协议版本号。与 DTLS 相同，取 TLCP 1.1 版本号的反码。
+	VersionDTLCP11 ProtocolVersion = ^VersionTLCP11
+)
 
 func (v ProtocolVersion) Major() uint8 {
-	return v[0]
+	return uint8(v >> 8)
 }
 
 func (v ProtocolVersion) Minor() uint8 {
-	return v[1]
+	return uint8(v)
 }
 
 func (v ProtocolVersion) String() string {
-	return fmt.Sprintf("gmtls.ProtocolVersion(major=%d, minor=%d)", v[0], v[1])
+	switch v {
+	case VersionTLCP11:
+		return "TLCP 1.1"
+	case VersionDTLCP11:
+		return "DTLCP 1.1"
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301, 0x0302, 0x0303, 0x0304:
+		return fmt.Sprintf("TLS 1.%d", v.Minor()-1)
+	default:
+		return fmt.Sprintf("0x%04X", uint16(v))
+	}
 }
@@ -0,0 +1,26 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtocolVersion_String(t *testing.T) {
+	tests := []struct {
+		version common.ProtocolVersion
+		want    string
+	}{
+		{common.VersionTLCP11, "TLCP 1.1"},
+		{0x0300, "SSL 3.0"},
+		{0x0301, "TLS 1.0"},
+		{0x0303, "TLS 1.2"},
+		{0x0102, "0x0102"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.version.String())
+		})
+	}
+}
@@ -1,15 +1,35 @@
 package common
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 )
 
+// RandomLength 是 Random 编码后的长度。
+const RandomLength = 32
+
 type Random struct {
 	GMTUnixTime uint32   // 格林威治时间 Unix 32位时间戳，单位秒
 	RandomBytes [28]byte // 随机字节数组
 }
 
+// Bytes 返回 Random 在网络传输时的 32 字节编码，用于计算主密钥和密钥块。
+func (r Random) Bytes() []byte {
+	b := make([]byte, RandomLength)
+	binary.BigEndian.PutUint32(b, r.GMTUnixTime)
+	copy(b[4:], r.RandomBytes[:])
+	return b
+}
+
+// RandomFromBytes 从 32 字节的编码中解析 Random。
+func RandomFromBytes(b []byte) Random {
+	var r Random
+	r.GMTUnixTime = binary.BigEndian.Uint32(b)
+	copy(r.RandomBytes[:], b[4:RandomLength])
+	return r
+}
+
 func (r Random) String() string {
 	return fmt.Sprintf("gmtls.Random(GMTUnixTime=%d, RandomBytes=%s)", r.GMTUnixTime, hex.EncodeToString(r.RandomBytes[:]))
 }
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"io"
+
+	"github.com/tjfoc/gmsm/sm2"
+)
+
+// DefaultSM2UserID 是 GM/T 0009-2012 第 10 节规定的默认用户标识（distinguishing identifier）。
+// 没有特殊约定时，SM2 签名和验签都使用这个标识计算 Z 值。
+const DefaultSM2UserID = "1234567812345678"
+
+// SM2SignerOpts 是 SM2 签名的参数，实现了 crypto.SignerOpts。
+//
+// 使用 SM2 私钥的 crypto.Signer 实现（例如 device.PrivateKey）应当检查 opts 是否为 *SM2SignerOpts，
+// 并使用 UID 计算 Z 值。
+type SM2SignerOpts struct {
+	// UID 是签名者的用户标识，为空时使用 DefaultSM2UserID。
+	UID []byte
+}
+
+// HashFunc 实现 crypto.SignerOpts。SM2 签名对原始消息计算 SM3(Z || M)，不使用预先计算的杂凑值，因此返回 0。
+func (o *SM2SignerOpts) HashFunc() crypto.Hash {
+	return 0
+}
+
+// SM2UserID 返回 uid，uid 为空时返回 DefaultSM2UserID。
+func SM2UserID(uid []byte) []byte {
+	if len(uid) == 0 {
+		return []byte(DefaultSM2UserID)
+	}
+	return uid
+}
+
+// SignSM2 使用 key 和用户标识 uid 对 msg 做 SM2 签名，返回 ASN.1 DER 编码的签名值。
+//
+// sm2.PrivateKey.Sign 总是使用默认用户标识，因此 *sm2.PrivateKey 会直接调用 sm2.Sm2Sign；
+// 其他 crypto.Signer 实现会收到 *SM2SignerOpts 作为 opts 参数。
+func SignSM2(key crypto.Signer, msg, uid []byte, r io.Reader) ([]byte, error) {
+	uid = SM2UserID(uid)
+	if priv, ok := key.(*sm2.PrivateKey); ok {
+		sr, ss, err := sm2.Sm2Sign(priv, msg, uid, r)
+		if err != nil {
+			return nil, err
+		}
+		return sm2.SignDigitToSignData(sr, ss)
+	}
+	return key.Sign(r, msg, &SM2SignerOpts{UID: uid})
+}
+
+// VerifySM2 使用公钥 pub 和用户标识 uid 验证 msg 的 SM2 签名 sig。
+// pub 可以是 *sm2.PublicKey，也可以是 x509 证书解析得到的 SM2 曲线上的 *ecdsa.PublicKey。
+func VerifySM2(pub crypto.PublicKey, msg, uid, sig []byte) bool {
+	var key *sm2.PublicKey
+	switch pub := pub.(type) {
+	case *sm2.PublicKey:
+		key = pub
+	case *ecdsa.PublicKey:
+		if pub.Curve != sm2.P256Sm2() {
+			return false
+		}
+		key = &sm2.PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}
+	default:
+		return false
+	}
+
+	r, s, err := sm2.SignDataToSignDigit(sig)
+	if err != nil {
+		return false
+	}
+	return sm2.Sm2Verify(key, msg, SM2UserID(uid), r, s)
+}
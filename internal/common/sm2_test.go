@@ -0,0 +1,31 @@
+package common_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tjfoc/gmsm/sm2"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
+
+func TestSignSM2(t *testing.T) {
+	key, err := sm2.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	msg := []byte("signed params")
+
+	sig, err := common.SignSM2(key, msg, nil, rand.Reader)
+	require.NoError(t, err)
+	assert.True(t, common.VerifySM2(&key.PublicKey, msg, nil, sig))
+	assert.True(t, common.VerifySM2(&key.PublicKey, msg, []byte(common.DefaultSM2UserID), sig))
+	assert.True(t, key.PublicKey.Verify(msg, sig), "default user id must be compatible with sm2.PublicKey.Verify")
+
+	uid := []byte("alice@example.com")
+	sig, err = common.SignSM2(key, msg, uid, rand.Reader)
+	require.NoError(t, err)
+	assert.True(t, common.VerifySM2(&key.PublicKey, msg, uid, sig))
+	assert.False(t, common.VerifySM2(&key.PublicKey, msg, nil, sig))
+	assert.False(t, common.VerifySM2(&key.PublicKey, msg, []byte("bob@example.com"), sig))
+}
@@ -0,0 +1,51 @@
+package fragment
+
+import "github.com/nnnewb/gmtls/internal/common"
+
+// DatagramHeaderLength 是 DTLCP 记录头部的长度。
+const DatagramHeaderLength = 13
+
+// DatagramHeader 是 DTLCP 记录的头部，格式定义于 RFC 6347 第 4.1 节。
+//
+// 与 TLCP 相比增加了显式的 Epoch 和 48 位的 Sequence：每次切换密钥时 Epoch 加一、Sequence 从零开始。
+// 计算 MAC 时使用 Epoch 和 Sequence 拼接成的 64 位序列号。
+type DatagramHeader struct {
+	Type     TLSFragmentContentType
+	Version  common.ProtocolVersion
+	Epoch    uint16
+	Sequence uint64
+	Length   uint16
+}
+
+// MaxDatagramSequence 是 Sequence 的最大值。
+const MaxDatagramSequence = 1<<48 - 1
+
+// Marshal 把记录头部追加到 b 之后。
+func (h *DatagramHeader) Marshal(b []byte) []byte {
+	return append(b,
+		byte(h.Type),
+		byte(h.Version>>8), byte(h.Version),
+		byte(h.Epoch>>8), byte(h.Epoch),
+		byte(h.Sequence>>40), byte(h.Sequence>>32), byte(h.Sequence>>24),
+		byte(h.Sequence>>16), byte(h.Sequence>>8), byte(h.Sequence),
+		byte(h.Length>>8), byte(h.Length))
+}
+
+// SequenceNumber 返回计算 MAC 使用的 64 位序列号。
+func (h *DatagramHeader) SequenceNumber() uint64 {
+	return uint64(h.Epoch)<<48 | h.Sequence
+}
+
+// ParseDatagramHeader 解析记录头部。b 的长度不足时返回 false。
+func ParseDatagramHeader(b []byte) (DatagramHeader, bool) {
+	if len(b) < DatagramHeaderLength {
+		return DatagramHeader{}, false
+	}
+	return DatagramHeader{
+		Type:     TLSFragmentContentType(b[0]),
+		Version:  common.ProtocolVersion(b[1])<<8 | common.ProtocolVersion(b[2]),
+		Epoch:    uint16(b[3])<<8 | uint16(b[4]),
+		Sequence: uint64(b[5])<<40 | uint64(b[6])<<32 | uint64(b[7])<<24 | uint64(b[8])<<16 | uint64(b[9])<<8 | uint64(b[10]),
+		Length:   uint16(b[11])<<8 | uint16(b[12]),
+	}, true
+}
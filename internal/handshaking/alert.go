@@ -1,21 +1,48 @@
 package handshaking
 
+import "strconv"
+
 // AlertMessage 握手协议族中的报警协议。定义于 GM/T 0024-2014 第 6.4.2 节。
+//
+//	struct {
+//	    AlertLevel level;
+//	    AlertDescription description;
+//	} Alert;
 type AlertMessage struct {
 	Level       AlertLevel
 	Description AlertDescription
 }
 
+// AlertMessageLength 是报警消息编码后的长度。
+const AlertMessageLength = 2
+
+// Marshal 返回报警消息的编码。
+func (m *AlertMessage) Marshal() []byte {
+	return []byte{byte(m.Level), byte(m.Description)}
+}
+
+// Unmarshal 解析报警消息。长度不正确或级别未知时返回 ErrMalformedMessage。
+func (m *AlertMessage) Unmarshal(data []byte) error {
+	if len(data) != AlertMessageLength {
+		return ErrMalformedMessage
+	}
+	level := AlertLevel(data[0])
+	if level != AlertLevelWarning && level != AlertLevelFatal {
+		return ErrMalformedMessage
+	}
+	m.Level = level
+	m.Description = AlertDescription(data[1])
+	return nil
+}
+
+// AlertLevel 是报警的级别。
 type AlertLevel uint8
 
 const (
 	AlertLevelWarning AlertLevel = 1
 	AlertLevelFatal   AlertLevel = 2
-	AlertLevelMaximum AlertLevel = 255
 )
 
-var _ = AlertLevelMaximum
-
 func (a AlertLevel) String() string {
 	switch a {
 	case AlertLevelWarning:
@@ -27,6 +54,8 @@ func (a AlertLevel) String() string {
 	}
 }
 
+// AlertDescription 是报警的描述。
+// GM/T 0024-2014 沿用了 RFC 5246 的取值，并在第 6.4.2.2 节定义了 200 到 205 的 GM 专用报警。
 type AlertDescription uint8
 
 const (
@@ -47,92 +76,88 @@ const (
 	AlertDescriptionAccessDenied           AlertDescription = 49
 	AlertDescriptionDecodeError            AlertDescription = 50
 	AlertDescriptionDecryptError           AlertDescription = 51
+	AlertDescriptionExportRestriction      AlertDescription = 60
 	AlertDescriptionProtocolVersion        AlertDescription = 70
 	AlertDescriptionInsufficientSecurity   AlertDescription = 71
 	AlertDescriptionInternalError          AlertDescription = 80
+	AlertDescriptionInappropriateFallback  AlertDescription = 86
 	AlertDescriptionUserCanceled           AlertDescription = 90
-	AlertDescriptionUnsupportedSite2site   AlertDescription = 200
-	AlertDescriptionNoArea                 AlertDescription = 201
-	AlertDescriptionUnsupportedAreatype    AlertDescription = 202
-	AlertDescriptionBadIbcparam            AlertDescription = 203
-	AlertDescriptionUnsupportedIbcparam    AlertDescription = 204
-	AlertDescriptionIdentityNeed           AlertDescription = 205
-	AlertDescriptionMaximum                AlertDescription = 255
+	AlertDescriptionNoRenegotiation        AlertDescription = 100
+	AlertDescriptionUnsupportedExtension   AlertDescription = 110
+	AlertDescriptionNoApplicationProtocol  AlertDescription = 120
+
+	// 定义于 GM/T 0024-2014 第 6.4.2.2 节
+	AlertDescriptionUnsupportedSite2site AlertDescription = 200
+	AlertDescriptionNoArea               AlertDescription = 201
+	AlertDescriptionUnsupportedAreatype  AlertDescription = 202
+	AlertDescriptionBadIbcparam          AlertDescription = 203
+	AlertDescriptionUnsupportedIbcparam  AlertDescription = 204
+	AlertDescriptionIdentityNeed         AlertDescription = 205
 )
 
-var _ = AlertDescriptionMaximum
+var alertText = map[AlertDescription]string{
+	AlertDescriptionCloseNotify:            "close notify",
+	AlertDescriptionUnexpectedMessage:      "unexpected message",
+	AlertDescriptionBadRecordMac:           "bad record MAC",
+	AlertDescriptionDecryptionFailed:       "decryption failed",
+	AlertDescriptionRecordOverflow:         "record overflow",
+	AlertDescriptionDecompressionFailure:   "decompression failure",
+	AlertDescriptionHandshakeFailure:       "handshake failure",
+	AlertDescriptionBadCertificate:         "bad certificate",
+	AlertDescriptionUnsupportedCertificate: "unsupported certificate",
+	AlertDescriptionCertificateRevoked:     "revoked certificate",
+	AlertDescriptionCertificateExpired:     "expired certificate",
+	AlertDescriptionCertificateUnknown:     "unknown certificate",
+	AlertDescriptionIllegalParameter:       "illegal parameter",
+	AlertDescriptionUnknownCa:              "unknown certificate authority",
+	AlertDescriptionAccessDenied:           "access denied",
+	AlertDescriptionDecodeError:            "error decoding message",
+	AlertDescriptionDecryptError:           "error decrypting message",
+	AlertDescriptionExportRestriction:      "export restriction",
+	AlertDescriptionProtocolVersion:        "protocol version not supported",
+	AlertDescriptionInsufficientSecurity:   "insufficient security level",
+	AlertDescriptionInternalError:          "internal error",
+	AlertDescriptionInappropriateFallback:  "inappropriate fallback",
+	AlertDescriptionUserCanceled:           "user canceled",
+	AlertDescriptionNoRenegotiation:        "no renegotiation",
+	AlertDescriptionUnsupportedExtension:   "unsupported extension",
+	AlertDescriptionNoApplicationProtocol:  "no application protocol",
 
+	AlertDescriptionUnsupportedSite2site: "unsupported site2site",
+	AlertDescriptionNoArea:               "no area",
+	AlertDescriptionUnsupportedAreatype:  "unsupported area type",
+	AlertDescriptionBadIbcparam:          "bad IBC parameter",
+	AlertDescriptionUnsupportedIbcparam:  "unsupported IBC parameter",
+	AlertDescriptionIdentityNeed:         "peer IBC identity needed",
+}
+
+// String 返回报警的描述，格式与 crypto/tls 相同，例如 "tls: bad certificate"。
 func (d AlertDescription) String() string {
-	switch d {
-	case AlertDescriptionCloseNotify:
-		return "CloseNotify"
-	case AlertDescriptionUnexpectedMessage:
-		return "UnexpectedMessage"
-	case AlertDescriptionBadRecordMac:
-		return "BadRecordMac"
-	case AlertDescriptionDecryptionFailed:
-		return "DecryptionFailed"
-	case AlertDescriptionRecordOverflow:
-		return "RecordOverflow"
-	case AlertDescriptionDecompressionFailure:
-		return "DecompressionFailure"
-	case AlertDescriptionHandshakeFailure:
-		return "HandshakeFailure"
-	case AlertDescriptionBadCertificate:
-		return "BadCertificate"
-	case AlertDescriptionUnsupportedCertificate:
-		return "UnsupportedCertificate"
-	case AlertDescriptionCertificateRevoked:
-		return "CertificateRevoked"
-	case AlertDescriptionCertificateExpired:
-		return "CertificateExpired"
-	case AlertDescriptionCertificateUnknown:
-		return "CertificateUnknown"
-	case AlertDescriptionIllegalParameter:
-		return "IllegalParameter"
-	case AlertDescriptionUnknownCa:
-		return "UnknownCa"
-	case AlertDescriptionAccessDenied:
-		return "AccessDenied"
-	case AlertDescriptionDecodeError:
-		return "DecodeError"
-	case AlertDescriptionDecryptError:
-		return "DecryptError"
-	case AlertDescriptionProtocolVersion:
-		return "ProtocolVersion"
-	case AlertDescriptionInsufficientSecurity:
-		return "InsufficientSecurity"
-	case AlertDescriptionInternalError:
-		return "InternalError"
-	case AlertDescriptionUserCanceled:
-		return "UserCanceled"
-	case AlertDescriptionUnsupportedSite2site:
-		return "UnsupportedSite2site"
-	case AlertDescriptionNoArea:
-		return "NoArea"
-	case AlertDescriptionUnsupportedAreatype:
-		return "UnsupportedAreatype"
-	case AlertDescriptionBadIbcparam:
-		return "BadIbcparam"
-	case AlertDescriptionUnsupportedIbcparam:
-		return "UnsupportedIbcparam"
-	case AlertDescriptionIdentityNeed:
-		return "IdentityNeed"
-	default:
-		return "unknown"
+	if s, ok := alertText[d]; ok {
+		return "tls: " + s
 	}
+	return "tls: alert(" + strconv.Itoa(int(d)) + ")"
 }
 
-// IsWarning 判断是否为警告。参考 GM/T 0024-2014 第 6.4.2.2 节 "表 1 错误报警表" 定义。
+// Error 使 AlertDescription 可以作为错误使用。
+func (d AlertDescription) Error() string {
+	return d.String()
+}
+
+// IsWarning 报告 d 是否总是警告。参考 GM/T 0024-2014 第 6.4.2.2 节 "表 1 错误报警表" 定义，
+// close_notify 和 no_renegotiation 的级别分别由第 6.4.2.1 节和 RFC 5746 规定。
 func (d AlertDescription) IsWarning() bool {
 	switch d {
-	case AlertDescriptionUserCanceled:
+	case AlertDescriptionCloseNotify,
+		AlertDescriptionUserCanceled,
+		AlertDescriptionNoRenegotiation:
 		return true
 	}
 	return false
 }
 
-// IsFatal 判断是否为致命错误。参考 GM/T 0024-2014 第 6.4.2.2 节 "表 1 错误报警表" 定义。
+// IsFatal 报告 d 是否总是致命错误。参考 GM/T 0024-2014 第 6.4.2.2 节 "表 1 错误报警表" 定义。
+// 表中未列出的报警和既可以是警告也可以是致命错误的报警返回 false。
 func (d AlertDescription) IsFatal() bool {
 	switch d {
 	case AlertDescriptionUnexpectedMessage,
@@ -156,3 +181,11 @@ func (d AlertDescription) IsFatal() bool {
 	}
 	return false
 }
+
+// Level 返回发送 d 时使用的级别：总是警告的报警以警告级别发送，其余报警都会中止连接，以致命级别发送。
+func (d AlertDescription) Level() AlertLevel {
+	if d.IsWarning() {
+		return AlertLevelWarning
+	}
+	return AlertLevelFatal
+}
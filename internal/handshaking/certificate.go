@@ -1,5 +1,7 @@
 package handshaking
 
+import "golang.org/x/crypto/cryptobyte"
+
 // CertificateMessage 是 Server/Client Certificate 消息。定义于 GM/T 0024-2014 第 6.4.4.2 节。
 //
 // 网络传输时的编码定义没找到标准来源，下面是传输格式
@@ -10,6 +12,42 @@ package handshaking
 //
 // 参考 go 源码
 //   - https://go.dev/src/crypto/tls/handshake_messages.go#L1370
+//
+// GM/T 0024-2014 要求签名证书在前，加密证书在后，其余是签发证书的 CA 证书。
 type CertificateMessage struct {
 	Certificates [][]byte
 }
+
+func (m *CertificateMessage) Type() HandshakeType {
+	return HandshakeTypeCertificate
+}
+
+func (m *CertificateMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, cert := range m.Certificates {
+			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(cert)
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+func (m *CertificateMessage) Unmarshal(body []byte) error {
+	*m = CertificateMessage{}
+	s := cryptobyte.String(body)
+
+	var list cryptobyte.String
+	if !s.ReadUint24LengthPrefixed(&list) || !s.Empty() {
+		return ErrMalformedMessage
+	}
+	for !list.Empty() {
+		var cert []byte
+		if !readUint24LengthPrefixed(&list, &cert) || len(cert) == 0 {
+			return ErrMalformedMessage
+		}
+		m.Certificates = append(m.Certificates, cert)
+	}
+	return nil
+}
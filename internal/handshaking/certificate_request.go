@@ -1,5 +1,7 @@
 package handshaking
 
+import "golang.org/x/crypto/cryptobyte"
+
 // CertificateRequestMessage 是 Certificate Request 消息，定义于 GM/T 0024-2014 第 6.4.4.4 节
 type CertificateRequestMessage struct {
 	// 要求客户端提供的证书类型的列表
@@ -11,6 +13,50 @@ type CertificateRequestMessage struct {
 	CertificateAuthorities []DistinguishedName
 }
 
+func (m *CertificateRequestMessage) Type() HandshakeType {
+	return HandshakeTypeCertificateRequest
+}
+
+func (m *CertificateRequestMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, typ := range m.CertificateTypes {
+			b.AddUint8(uint8(typ))
+		}
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, dn := range m.CertificateAuthorities {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(dn)
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+func (m *CertificateRequestMessage) Unmarshal(body []byte) error {
+	*m = CertificateRequestMessage{}
+	s := cryptobyte.String(body)
+
+	var types []byte
+	var cas cryptobyte.String
+	if !readUint8LengthPrefixed(&s, &types) || len(types) == 0 ||
+		!s.ReadUint16LengthPrefixed(&cas) || !s.Empty() {
+		return ErrMalformedMessage
+	}
+	for _, typ := range types {
+		m.CertificateTypes = append(m.CertificateTypes, CertificateType(typ))
+	}
+	for !cas.Empty() {
+		var dn []byte
+		if !readUint16LengthPrefixed(&cas, &dn) || len(dn) == 0 {
+			return ErrMalformedMessage
+		}
+		m.CertificateAuthorities = append(m.CertificateAuthorities, dn)
+	}
+	return nil
+}
+
 // CertificateType 要求客户端提供的证书类型。定义于 GM/T 0024-2014 第 6.4.4.4 节
 type CertificateType uint8
 
@@ -0,0 +1,31 @@
+package handshaking
+
+import "golang.org/x/crypto/cryptobyte"
+
+// CertificateVerifyMessage 是 Certificate Verify 消息，定义于 GM/T 0024-2014 第 6.4.4.7 节。
+// 客户端使用签名私钥对之前所有握手消息的杂凑值签名，用于证明自己持有客户端证书对应的私钥。
+type CertificateVerifyMessage struct {
+	// 签名值，长度前缀为 16 位
+	Signature []byte
+}
+
+func (m *CertificateVerifyMessage) Type() HandshakeType {
+	return HandshakeTypeCertificateVerify
+}
+
+func (m *CertificateVerifyMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.Signature)
+	})
+	return b.Bytes()
+}
+
+func (m *CertificateVerifyMessage) Unmarshal(body []byte) error {
+	*m = CertificateVerifyMessage{}
+	s := cryptobyte.String(body)
+	if !readUint16LengthPrefixed(&s, &m.Signature) || !s.Empty() {
+		return ErrMalformedMessage
+	}
+	return nil
+}
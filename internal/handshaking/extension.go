@@ -0,0 +1,167 @@
+package handshaking
+
+import "golang.org/x/crypto/cryptobyte"
+
+// Extension 是 Hello 消息中的扩展。
+//
+// GM/T 0024-2014 没有定义 Hello 消息的扩展，但常见的实现（GmSSL、BabaSSL 等）都沿用了 RFC 5246 第 7.4.1.4 节
+// 的扩展格式：Hello 消息在压缩方法之后可以带有一个扩展列表。为了兼容这些实现，这里保留扩展的原始内容。
+type Extension struct {
+	Type ExtensionType
+	Data []byte
+}
+
+// ExtensionType 是扩展的类型，取值参考 IANA TLS ExtensionType Values。
+type ExtensionType uint16
+
+const (
+	// ExtensionTypeServerName 是服务端名称指示扩展（SNI），定义于 RFC 6066 第 3 节。
+	ExtensionTypeServerName ExtensionType = 0
+	// ExtensionTypeALPN 是应用层协议协商扩展，定义于 RFC 7301。
+	ExtensionTypeALPN ExtensionType = 16
+	// ExtensionTypeRenegotiationInfo 是安全重新协商扩展，定义于 RFC 5746。
+	ExtensionTypeRenegotiationInfo ExtensionType = 0xff01
+)
+
+// marshalExtensions 把扩展列表写入 b。列表为空时不写入任何内容，以兼容不支持扩展的实现。
+func marshalExtensions(b *cryptobyte.Builder, extensions []Extension) {
+	if len(extensions) == 0 {
+		return
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, ext := range extensions {
+			b.AddUint16(uint16(ext.Type))
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(ext.Data)
+			})
+		}
+	})
+}
+
+// unmarshalExtensions 从 s 中解析扩展列表。s 为空表示没有扩展。
+func unmarshalExtensions(s cryptobyte.String) ([]Extension, bool) {
+	if s.Empty() {
+		return nil, true
+	}
+
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, false
+	}
+
+	var extensions []Extension
+	seen := make(map[ExtensionType]bool)
+	for !list.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !list.ReadUint16(&typ) || !list.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		if seen[ExtensionType(typ)] {
+			return nil, false
+		}
+		seen[ExtensionType(typ)] = true
+		extensions = append(extensions, Extension{Type: ExtensionType(typ), Data: []byte(data)})
+	}
+	return extensions, true
+}
+
+// FindExtension 返回 extensions 中类型为 typ 的扩展的内容。
+func FindExtension(extensions []Extension, typ ExtensionType) ([]byte, bool) {
+	for _, ext := range extensions {
+		if ext.Type == typ {
+			return ext.Data, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalServerName 编码 server_name 扩展的内容，即只包含一个 host_name 的名称列表。
+func MarshalServerName(name string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0) // name_type 为 host_name
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(name))
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// UnmarshalServerName 解析 server_name 扩展的内容，返回其中的 host_name。
+// 名称列表中最多只能有一个 host_name，其他类型的名称被忽略；没有 host_name 时返回空字符串。
+func UnmarshalServerName(data []byte) (string, bool) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() || list.Empty() {
+		return "", false
+	}
+
+	var serverName string
+	for !list.Empty() {
+		var nameType uint8
+		var name cryptobyte.String
+		if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) || name.Empty() {
+			return "", false
+		}
+		if nameType != 0 {
+			continue
+		}
+		if serverName != "" {
+			return "", false
+		}
+		serverName = string(name)
+	}
+	return serverName, true
+}
+
+// MarshalALPN 编码 ALPN 扩展的内容，即协议名称列表。
+func MarshalALPN(protocols []string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, proto := range protocols {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(proto))
+			})
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// UnmarshalALPN 解析 ALPN 扩展的内容。列表和其中的协议名称都不能为空。
+func UnmarshalALPN(data []byte) ([]string, bool) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() || list.Empty() {
+		return nil, false
+	}
+
+	var protocols []string
+	for !list.Empty() {
+		var proto cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+			return nil, false
+		}
+		protocols = append(protocols, string(proto))
+	}
+	return protocols, true
+}
+
+// MarshalRenegotiationInfo 编码 renegotiation_info 扩展的内容。
+func MarshalRenegotiationInfo(renegotiatedConnection []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(renegotiatedConnection)
+	})
+	return b.BytesOrPanic()
+}
+
+// UnmarshalRenegotiationInfo 解析 renegotiation_info 扩展的内容。
+func UnmarshalRenegotiationInfo(data []byte) ([]byte, bool) {
+	s := cryptobyte.String(data)
+	var renegotiatedConnection cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&renegotiatedConnection) || !s.Empty() {
+		return nil, false
+	}
+	return []byte(renegotiatedConnection), true
+}
@@ -0,0 +1,27 @@
+package handshaking
+
+// FinishedVerifyDataLength 是 Finished 消息中 verify_data 的长度。
+const FinishedVerifyDataLength = 12
+
+// FinishedMessage 是 Finished 消息，定义于 GM/T 0024-2014 第 6.4.4.9 节。
+//
+//	verify_data = PRF(master_secret, finished_label, SM3(handshake_messages))[0..11]
+type FinishedMessage struct {
+	VerifyData []byte
+}
+
+func (m *FinishedMessage) Type() HandshakeType {
+	return HandshakeTypeFinished
+}
+
+func (m *FinishedMessage) Marshal() ([]byte, error) {
+	return append([]byte{}, m.VerifyData...), nil
+}
+
+func (m *FinishedMessage) Unmarshal(body []byte) error {
+	if len(body) != FinishedVerifyDataLength {
+		return ErrMalformedMessage
+	}
+	m.VerifyData = append([]byte{}, body...)
+	return nil
+}
@@ -0,0 +1,44 @@
+package handshaking
+
+// FragmentHeaderLength 是 DTLCP 握手消息分片头部的长度。
+const FragmentHeaderLength = 12
+
+// FragmentHeader 是 DTLCP 握手消息分片的头部，格式定义于 RFC 6347 第 4.2.2 节。
+//
+// 数据报可能丢失、重复或乱序，一个握手消息可以分成多个分片发送，接收方根据 MessageSeq 和 FragmentOffset 重组。
+// 重组后的消息使用 TLCP 的 4 字节头部交给握手协议，握手消息的杂凑值也按照 TLCP 的格式计算。
+type FragmentHeader struct {
+	MessageType    HandshakeType
+	Length         Uint24 // 完整消息体的长度
+	MessageSeq     uint16
+	FragmentOffset Uint24
+	FragmentLength Uint24
+}
+
+// Marshal 把分片头部追加到 b 之后。
+func (h *FragmentHeader) Marshal(b []byte) []byte {
+	return append(b,
+		byte(h.MessageType),
+		byte(h.Length>>16), byte(h.Length>>8), byte(h.Length),
+		byte(h.MessageSeq>>8), byte(h.MessageSeq),
+		byte(h.FragmentOffset>>16), byte(h.FragmentOffset>>8), byte(h.FragmentOffset),
+		byte(h.FragmentLength>>16), byte(h.FragmentLength>>8), byte(h.FragmentLength))
+}
+
+// ParseFragmentHeader 解析分片头部。b 的长度不足或分片超出消息范围时返回 false。
+func ParseFragmentHeader(b []byte) (FragmentHeader, bool) {
+	if len(b) < FragmentHeaderLength {
+		return FragmentHeader{}, false
+	}
+	h := FragmentHeader{
+		MessageType:    HandshakeType(b[0]),
+		Length:         Uint24(b[1])<<16 | Uint24(b[2])<<8 | Uint24(b[3]),
+		MessageSeq:     uint16(b[4])<<8 | uint16(b[5]),
+		FragmentOffset: Uint24(b[6])<<16 | Uint24(b[7])<<8 | Uint24(b[8]),
+		FragmentLength: Uint24(b[9])<<16 | Uint24(b[10])<<8 | Uint24(b[11]),
+	}
+	if h.FragmentOffset+h.FragmentLength > h.Length {
+		return FragmentHeader{}, false
+	}
+	return h, true
+}
@@ -1,18 +1,117 @@
 package handshaking
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Uint24 uint32
 
+// HeaderLength 是握手消息头部的长度，包括 1 字节的消息类型和 3 字节的消息长度。
+const HeaderLength = 4
+
+// ErrMalformedMessage 表示握手消息的编码不正确，对应 decode_error 报警。
+var ErrMalformedMessage = errors.New("handshaking: malformed handshake message")
+
 type Handshake struct {
 	MessageType HandshakeType
 	Length      Uint24
 	Body        []byte
 }
 
+// Marshal 返回握手消息在网络传输时的编码，包括消息头部。
+func (h *Handshake) Marshal() []byte {
+	b := make([]byte, HeaderLength+len(h.Body))
+	b[0] = byte(h.MessageType)
+	b[1] = byte(len(h.Body) >> 16)
+	b[2] = byte(len(h.Body) >> 8)
+	b[3] = byte(len(h.Body))
+	copy(b[HeaderLength:], h.Body)
+	return b
+}
+
+// ParseHeader 解析握手消息头部，返回消息类型和消息体长度。调用方应保证 b 的长度不小于 HeaderLength。
+func ParseHeader(b []byte) (HandshakeType, Uint24) {
+	return HandshakeType(b[0]), Uint24(b[1])<<16 | Uint24(b[2])<<8 | Uint24(b[3])
+}
+
+// Message 是握手协议消息的公共接口。
+type Message interface {
+	// Type 返回消息类型。
+	Type() HandshakeType
+
+	// Marshal 返回消息体的编码，不包括握手消息头部。
+	Marshal() ([]byte, error)
+
+	// Unmarshal 从消息体的编码中解析消息，不包括握手消息头部。
+	Unmarshal(body []byte) error
+}
+
+// MarshalMessage 返回消息 m 在网络传输时的完整编码，包括握手消息头部。
+func MarshalMessage(m Message) ([]byte, error) {
+	body, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) >= 1<<24 {
+		return nil, fmt.Errorf("handshaking: %s message too large", m.Type())
+	}
+	h := Handshake{MessageType: m.Type(), Length: Uint24(len(body)), Body: body}
+	return h.Marshal(), nil
+}
+
+// UnmarshalMessage 从完整的握手消息编码（包括头部）中解析消息。
+// 遇到未知的消息类型时返回错误。
+func UnmarshalMessage(data []byte) (Message, error) {
+	if len(data) < HeaderLength {
+		return nil, ErrMalformedMessage
+	}
+	typ, length := ParseHeader(data)
+	if int(length) != len(data)-HeaderLength {
+		return nil, ErrMalformedMessage
+	}
+
+	var m Message
+	switch typ {
+	case HandshakeTypeHelloRequest:
+		m = new(HelloRequestMessage)
+	case HandshakeTypeClientHello:
+		m = new(ClientHelloMessage)
+	case HandshakeTypeServerHello:
+		m = new(ServerHelloMessage)
+	case HandshakeTypeHelloVerifyRequest:
+		m = new(HelloVerifyRequestMessage)
+	case HandshakeTypeCertificate:
+		m = new(CertificateMessage)
+	case HandshakeTypeServerKeyExchange:
+		m = new(ServerKeyExchangeMessage)
+	case HandshakeTypeCertificateRequest:
+		m = new(CertificateRequestMessage)
+	case HandshakeTypeServerHelloDone:
+		m = new(ServerHelloDoneMessage)
+	case HandshakeTypeCertificateVerify:
+		m = new(CertificateVerifyMessage)
+	case HandshakeTypeClientKeyExchange:
+		m = new(ClientKeyExchangeMessage)
+	case HandshakeTypeFinished:
+		m = new(FinishedMessage)
+	default:
+		return nil, fmt.Errorf("handshaking: unknown handshake message type %d", typ)
+	}
+
+	if err := m.Unmarshal(data[HeaderLength:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 type HandshakeType uint8
 
 const (
+	HandshakeTypeHelloRequest       HandshakeType = 0
 	HandshakeTypeClientHello        HandshakeType = 1
 	HandshakeTypeServerHello        HandshakeType = 2
+	HandshakeTypeHelloVerifyRequest HandshakeType = 3
 	HandshakeTypeCertificate        HandshakeType = 11
 	HandshakeTypeServerKeyExchange  HandshakeType = 12
 	HandshakeTypeCertificateRequest HandshakeType = 13
@@ -27,10 +126,14 @@ var _ = HandshakeTypeMaximum
 
 func (h HandshakeType) String() string {
 	switch h {
+	case HandshakeTypeHelloRequest:
+		return "hello_request"
 	case HandshakeTypeClientHello:
 		return "client_hello"
 	case HandshakeTypeServerHello:
 		return "server_hello"
+	case HandshakeTypeHelloVerifyRequest:
+		return "hello_verify_request"
 	case HandshakeTypeCertificate:
 		return "certificate"
 	case HandshakeTypeServerKeyExchange:
@@ -1,6 +1,10 @@
 package handshaking
 
-import "github.com/nnnewb/gmtls/internal/common"
+import (
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
 
 // ClientHelloMessage 是 Client Hello 消息，定义于 GM/T 0024-2014 第 6.4.4.1.1 节
 type ClientHelloMessage struct {
@@ -29,6 +33,68 @@ type ClientHelloMessage struct {
 	//
 	// 小于等于 2^8 - 1 个压缩方法。
 	CompressionMethods []common.CompressionMethod
+
+	// 扩展列表，见 Extension。
+	Extensions []Extension
+}
+
+func (m *ClientHelloMessage) Type() HandshakeType {
+	return HandshakeTypeClientHello
+}
+
+func (m *ClientHelloMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(m.ClientVersion))
+	b.AddBytes(m.Random.Bytes())
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.SessionID)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, suite := range m.CipherSuites {
+			b.AddUint16(uint16(suite))
+		}
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, method := range m.CompressionMethods {
+			b.AddUint8(uint8(method))
+		}
+	})
+	marshalExtensions(&b, m.Extensions)
+	return b.Bytes()
+}
+
+func (m *ClientHelloMessage) Unmarshal(body []byte) error {
+	*m = ClientHelloMessage{}
+	s := cryptobyte.String(body)
+
+	var version uint16
+	var random, sessionID, suites, methods []byte
+	if !s.ReadUint16(&version) ||
+		!s.ReadBytes(&random, common.RandomLength) ||
+		!readUint8LengthPrefixed(&s, &sessionID) ||
+		len(sessionID) > 32 ||
+		!readUint16LengthPrefixed(&s, &suites) ||
+		len(suites)%2 != 0 || len(suites) == 0 ||
+		!readUint8LengthPrefixed(&s, &methods) ||
+		len(methods) == 0 {
+		return ErrMalformedMessage
+	}
+
+	m.ClientVersion = common.ProtocolVersion(version)
+	m.Random = common.RandomFromBytes(random)
+	m.SessionID = sessionID
+	for i := 0; i < len(suites); i += 2 {
+		m.CipherSuites = append(m.CipherSuites, common.CipherSuite(suites[i])<<8|common.CipherSuite(suites[i+1]))
+	}
+	for _, method := range methods {
+		m.CompressionMethods = append(m.CompressionMethods, common.CompressionMethod(method))
+	}
+
+	var ok bool
+	if m.Extensions, ok = unmarshalExtensions(s); !ok {
+		return ErrMalformedMessage
+	}
+	return nil
 }
 
 // ServerHelloMessage 是 Server Hello 消息。定义于 GM/T 0024-2014 第 6.4.4.1.2 节。
@@ -46,4 +112,82 @@ type ServerHelloMessage struct {
 	CipherSuite common.CipherSuite
 	// 服务端从 ClientHelloMessage 中选择的压缩方法。
 	CompressionMethod common.CompressionMethod
+	// 扩展列表，见 Extension。
+	Extensions []Extension
+}
+
+func (m *ServerHelloMessage) Type() HandshakeType {
+	return HandshakeTypeServerHello
+}
+
+func (m *ServerHelloMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(m.ServerVersion))
+	b.AddBytes(m.Random.Bytes())
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.SessionID)
+	})
+	b.AddUint16(uint16(m.CipherSuite))
+	b.AddUint8(uint8(m.CompressionMethod))
+	marshalExtensions(&b, m.Extensions)
+	return b.Bytes()
+}
+
+func (m *ServerHelloMessage) Unmarshal(body []byte) error {
+	*m = ServerHelloMessage{}
+	s := cryptobyte.String(body)
+
+	var version, suite uint16
+	var method uint8
+	var random, sessionID []byte
+	if !s.ReadUint16(&version) ||
+		!s.ReadBytes(&random, common.RandomLength) ||
+		!readUint8LengthPrefixed(&s, &sessionID) ||
+		len(sessionID) > 32 ||
+		!s.ReadUint16(&suite) ||
+		!s.ReadUint8(&method) {
+		return ErrMalformedMessage
+	}
+
+	m.ServerVersion = common.ProtocolVersion(version)
+	m.Random = common.RandomFromBytes(random)
+	m.SessionID = sessionID
+	m.CipherSuite = common.CipherSuite(suite)
+	m.CompressionMethod = common.CompressionMethod(method)
+
+	var ok bool
+	if m.Extensions, ok = unmarshalExtensions(s); !ok {
+		return ErrMalformedMessage
+	}
+	return nil
+}
+
+// readUint8LengthPrefixed 读取 8 位长度前缀的字节串，返回的切片是新分配的副本。
+func readUint8LengthPrefixed(s *cryptobyte.String, out *[]byte) bool {
+	var v cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&v) {
+		return false
+	}
+	*out = append([]byte{}, v...)
+	return true
+}
+
+// readUint16LengthPrefixed 读取 16 位长度前缀的字节串，返回的切片是新分配的副本。
+func readUint16LengthPrefixed(s *cryptobyte.String, out *[]byte) bool {
+	var v cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&v) {
+		return false
+	}
+	*out = append([]byte{}, v...)
+	return true
+}
+
+// readUint24LengthPrefixed 读取 24 位长度前缀的字节串，返回的切片是新分配的副本。
+func readUint24LengthPrefixed(s *cryptobyte.String, out *[]byte) bool {
+	var v cryptobyte.String
+	if !s.ReadUint24LengthPrefixed(&v) {
+		return false
+	}
+	*out = append([]byte{}, v...)
+	return true
 }
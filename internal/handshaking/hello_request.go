@@ -0,0 +1,20 @@
+package handshaking
+
+// HelloRequestMessage 是 Hello Request 消息，定义于 GM/T 0024-2014 第 6.4.4.1.1 节。
+// 服务端可以在任何时候发送该消息，要求客户端重新开始握手。消息体为空，不计入握手消息的杂凑值。
+type HelloRequestMessage struct{}
+
+func (m *HelloRequestMessage) Type() HandshakeType {
+	return HandshakeTypeHelloRequest
+}
+
+func (m *HelloRequestMessage) Marshal() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *HelloRequestMessage) Unmarshal(body []byte) error {
+	if len(body) != 0 {
+		return ErrMalformedMessage
+	}
+	return nil
+}
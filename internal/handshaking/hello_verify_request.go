@@ -0,0 +1,79 @@
+package handshaking
+
+import (
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/nnnewb/gmtls/internal/common"
+)
+
+// HelloVerifyRequestMessage 是 DTLCP 服务端对没有携带有效 cookie 的 ClientHello 的响应，格式定义于 RFC 6347 第 4.2.1 节。
+// 客户端需要在新的 ClientHello 中回送 Cookie，以证明它能接收发往其源地址的数据报。该消息不计入握手消息的杂凑值。
+type HelloVerifyRequestMessage struct {
+	ServerVersion common.ProtocolVersion
+	Cookie        []byte
+}
+
+func (m *HelloVerifyRequestMessage) Type() HandshakeType {
+	return HandshakeTypeHelloVerifyRequest
+}
+
+func (m *HelloVerifyRequestMessage) Marshal() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(m.ServerVersion))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(m.Cookie)
+	})
+	return b.Bytes()
+}
+
+func (m *HelloVerifyRequestMessage) Unmarshal(body []byte) error {
+	s := cryptobyte.String(body)
+	var version uint16
+	var cookie cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadUint8LengthPrefixed(&cookie) || !s.Empty() || cookie.Empty() {
+		return ErrMalformedMessage
+	}
+	m.ServerVersion = common.ProtocolVersion(version)
+	m.Cookie = []byte(cookie)
+	return nil
+}
+
+// MaxCookieLength 是 DTLCP cookie 的最大长度，定义于 RFC 6347 第 4.2.1 节。
+const MaxCookieLength = 255
+
+// clientHelloCookieOffset 返回 ClientHello 消息体中 session_id 之后的位置，即 DTLCP 的 cookie 字段所在的位置。
+func clientHelloCookieOffset(body []byte) (int, bool) {
+	const sessionIDOffset = 2 + common.RandomLength
+	if len(body) <= sessionIDOffset {
+		return 0, false
+	}
+	offset := sessionIDOffset + 1 + int(body[sessionIDOffset])
+	return offset, len(body) >= offset
+}
+
+// AddClientHelloCookie 在 TLCP 格式的 ClientHello 消息体中插入 cookie 字段，返回 DTLCP 格式的消息体。
+//
+// DTLCP 的 ClientHello 与 DTLS 相同，在 session_id 之后有一个 cookie<0..2^8-1> 字段，定义于 RFC 6347 第 4.2.1 节。
+func AddClientHelloCookie(body, cookie []byte) ([]byte, error) {
+	offset, ok := clientHelloCookieOffset(body)
+	if !ok || len(cookie) > MaxCookieLength {
+		return nil, ErrMalformedMessage
+	}
+	out := make([]byte, 0, len(body)+1+len(cookie))
+	out = append(out, body[:offset]...)
+	out = append(out, byte(len(cookie)))
+	out = append(out, cookie...)
+	return append(out, body[offset:]...), nil
+}
+
+// RemoveClientHelloCookie 从 DTLCP 格式的 ClientHello 消息体中取出 cookie 字段，返回 TLCP 格式的消息体和 cookie。
+func RemoveClientHelloCookie(body []byte) (tlcpBody, cookie []byte, err error) {
+	offset, ok := clientHelloCookieOffset(body)
+	if !ok || len(body) <= offset || len(body) < offset+1+int(body[offset]) {
+		return nil, nil, ErrMalformedMessage
+	}
+	end := offset + 1 + int(body[offset])
+	cookie = body[offset+1 : end]
+	tlcpBody = append(append(make([]byte, 0, len(body)-end+offset), body[:offset]...), body[end:]...)
+	return tlcpBody, cookie, nil
+}
@@ -1,38 +1,192 @@
 package handshaking
 
 import (
+	"crypto"
+	"crypto/elliptic"
 	"io"
 
 	"github.com/tjfoc/gmsm/sm2"
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/nnnewb/gmtls/internal/common"
 )
 
+// PreMasterSecretLength 是 pre_master_secret 的长度。
+const PreMasterSecretLength = 48
+
+// ServerKeyExchangeMessage 是 Server Key Exchange 消息，定义于 GM/T 0024-2014 第 6.4.4.3 节。
+//
+// 消息内容取决于密钥交换算法，因此这里保存原始编码，由密钥交换算法负责解析：
+//
+//   - ECC：signed_params，即 16 位长度前缀的签名值
+//   - ECDHE：ServerECDHEParams 后接 16 位长度前缀的签名值
+type ServerKeyExchangeMessage struct {
+	Key []byte
+}
+
+func (m *ServerKeyExchangeMessage) Type() HandshakeType {
+	return HandshakeTypeServerKeyExchange
+}
+
+func (m *ServerKeyExchangeMessage) Marshal() ([]byte, error) {
+	return append([]byte{}, m.Key...), nil
+}
+
+func (m *ServerKeyExchangeMessage) Unmarshal(body []byte) error {
+	m.Key = append([]byte{}, body...)
+	return nil
+}
+
+// ClientKeyExchangeMessage 是 Client Key Exchange 消息，定义于 GM/T 0024-2014 第 6.4.4.8 节。
+//
+// 消息内容取决于密钥交换算法，因此这里保存原始编码，由密钥交换算法负责解析：
+//
+//   - ECC：16 位长度前缀的 ECCEncryptedPreMasterSecret，是 GM/T 0009 ASN.1 编码的 SM2 密文
+//   - ECDHE：ClientECDHEParams
+type ClientKeyExchangeMessage struct {
+	Key []byte
+}
+
+func (m *ClientKeyExchangeMessage) Type() HandshakeType {
+	return HandshakeTypeClientKeyExchange
+}
+
+func (m *ClientKeyExchangeMessage) Marshal() ([]byte, error) {
+	return append([]byte{}, m.Key...), nil
+}
+
+func (m *ClientKeyExchangeMessage) Unmarshal(body []byte) error {
+	m.Key = append([]byte{}, body...)
+	return nil
+}
+
 // ECCKeyExchangeSignature 当秘钥交换算法是 ECC 时，生成 key exchange message 的内容。
 // 定义于 GM/T 0024-2014 第 6.4.4.3 节，signed_params。使用 SM2 算法签名。
 //
-// 参数 result 是最终输出的 signed_params。调用方应保证长度充足。
+//	digitally-signed struct {
+//	    opaque client_random[32];
+//	    opaque server_random[32];
+//	    opaque ASN.1Cert<1..2^24-1>;
+//	} signed_params;
 //
-// 参数 clientRandom、serverRandom、certificate 为待签名的内容。
+// 参数 clientRandom、serverRandom、certificate 为待签名的内容，certificate 是服务端加密证书的 DER 编码，
+// 签名时会加上 24 位的长度前缀。
 //
-// 参数 key 是签名使用的私钥。
+// 参数 key 是签名使用的私钥，可以是 *sm2.PrivateKey，也可以是密码设备中的私钥（见 device 包）。
+//
+// 参数 uid 是签名者的 SM2 用户标识，为空时使用默认标识 "1234567812345678"。
 //
 // 参数 rand 是签名所需的随机数发生器，一般可以用 crypto/rand。
 //
 // 参考实现：https://github.com/guanzhi/GmSSL/blob/d655c06b3a6b0fe8cff900f293bf0e5aac6eb0a2/src/tlcp.c#L721-L735
-func ECCKeyExchangeSignature(clientRandom, serverRandom, certificate []byte, key *sm2.PrivateKey, r io.Reader) ([]byte, error) {
-	msg := make([]byte, len(clientRandom)+len(serverRandom)+len(certificate))
-	copy(msg, clientRandom)
-	copy(msg[len(clientRandom):], serverRandom)
-	copy(msg[len(clientRandom)+len(serverRandom):], certificate)
-	return key.Sign(r, msg, nil)
+func ECCKeyExchangeSignature(clientRandom, serverRandom, certificate []byte, key crypto.Signer, uid []byte, r io.Reader) ([]byte, error) {
+	return common.SignSM2(key, eccSignedParams(clientRandom, serverRandom, certificate), uid, r)
+}
+
+// ECCKeyExchangeVerify 当秘钥交换算法是 ECC 时，验证 key exchange message 中的 signed_params。
+//
+// 参数 pub 是服务端签名证书的公钥，uid 是服务端的 SM2 用户标识，为空时使用默认标识。
+func ECCKeyExchangeVerify(clientRandom, serverRandom, certificate []byte, pub crypto.PublicKey, uid, sig []byte) bool {
+	return common.VerifySM2(pub, eccSignedParams(clientRandom, serverRandom, certificate), uid, sig)
+}
+
+func eccSignedParams(clientRandom, serverRandom, certificate []byte) []byte {
+	msg := make([]byte, 0, len(clientRandom)+len(serverRandom)+3+len(certificate))
+	msg = append(msg, clientRandom...)
+	msg = append(msg, serverRandom...)
+	msg = append(msg, byte(len(certificate)>>16), byte(len(certificate)>>8), byte(len(certificate)))
+	msg = append(msg, certificate...)
+	return msg
 }
 
 // ECCKeyExchangeGeneratePreMasterSecret 当秘钥交换算法是 ECC 时，生成未加密的 pre_master_secret。
-func ECCKeyExchangeGeneratePreMasterSecret(key *sm2.PublicKey, r io.Reader) ([]byte, error) {
-	ret := make([]byte, 48)
-	_, err := io.ReadFull(r, ret)
+//
+//	struct {
+//	    ProtocolVersion client_version;
+//	    opaque random[46];
+//	} PreMasterSecret;
+func ECCKeyExchangeGeneratePreMasterSecret(version common.ProtocolVersion, r io.Reader) ([]byte, error) {
+	ret := make([]byte, PreMasterSecretLength)
+	ret[0] = version.Major()
+	ret[1] = version.Minor()
+	_, err := io.ReadFull(r, ret[2:])
 	if err != nil {
 		return nil, err
 	}
 
 	return ret, nil
 }
+
+// ECCKeyExchangeEncryptPreMasterSecret 当秘钥交换算法是 ECC 时，使用服务端加密证书的公钥加密 pre_master_secret，
+// 返回 GM/T 0009 ASN.1 编码的 SM2 密文。
+func ECCKeyExchangeEncryptPreMasterSecret(pub *sm2.PublicKey, preMasterSecret []byte, r io.Reader) ([]byte, error) {
+	return sm2.EncryptAsn1(pub, preMasterSecret, r)
+}
+
+// NamedCurveSM2 是 sm2p256v1 曲线的编号，取值参考 RFC 8998 第 2.2 节 curveSM2。
+const NamedCurveSM2 uint16 = 41
+
+// namedCurveSM2Legacy 是 GmSSL 2.x 等早期实现使用的 sm2p256v1 曲线编号。
+const namedCurveSM2Legacy uint16 = 30
+
+// ecCurveTypeNamedCurve 是 ECParameters 中的 named_curve 类型，定义于 RFC 4492 第 5.4 节。
+const ecCurveTypeNamedCurve = 3
+
+// MarshalECDHEParams 返回 ServerECDHEParams / ClientECDHEParams 的编码，定义于 GM/T 0024-2014 第 6.4.4.3 节。
+//
+//	struct {
+//	    ECParameters curve_params;
+//	    ECPoint      public;
+//	} ServerECDHEParams;
+func MarshalECDHEParams(pub *sm2.PublicKey) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(ecCurveTypeNamedCurve)
+	b.AddUint16(NamedCurveSM2)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+	})
+	return b.BytesOrPanic()
+}
+
+// ParseECDHEParams 从 b 的开头解析 ServerECDHEParams / ClientECDHEParams，返回其中的临时公钥、参数的原始编码和剩余的数据。
+func ParseECDHEParams(b []byte) (pub *sm2.PublicKey, params, rest []byte, ok bool) {
+	s := cryptobyte.String(b)
+	var curveType uint8
+	var curve uint16
+	var point cryptobyte.String
+	if !s.ReadUint8(&curveType) || curveType != ecCurveTypeNamedCurve ||
+		!s.ReadUint16(&curve) || (curve != NamedCurveSM2 && curve != namedCurveSM2Legacy) ||
+		!s.ReadUint8LengthPrefixed(&point) {
+		return nil, nil, nil, false
+	}
+
+	x, y := elliptic.Unmarshal(sm2.P256Sm2(), point)
+	if x == nil {
+		return nil, nil, nil, false
+	}
+	return &sm2.PublicKey{Curve: sm2.P256Sm2(), X: x, Y: y}, b[:len(b)-len(s)], []byte(s), true
+}
+
+// ECDHEKeyExchangeSignature 当秘钥交换算法是 ECDHE 时，生成 ServerKeyExchange 消息中的签名。
+//
+//	digitally-signed struct {
+//	    opaque client_random[32];
+//	    opaque server_random[32];
+//	    ServerECDHEParams params;
+//	} signed_params;
+func ECDHEKeyExchangeSignature(clientRandom, serverRandom, params []byte, key crypto.Signer, uid []byte, r io.Reader) ([]byte, error) {
+	return common.SignSM2(key, ecdheSignedParams(clientRandom, serverRandom, params), uid, r)
+}
+
+// ECDHEKeyExchangeVerify 当秘钥交换算法是 ECDHE 时，验证 ServerKeyExchange 消息中的签名。
+func ECDHEKeyExchangeVerify(clientRandom, serverRandom, params []byte, pub crypto.PublicKey, uid, sig []byte) bool {
+	return common.VerifySM2(pub, ecdheSignedParams(clientRandom, serverRandom, params), uid, sig)
+}
+
+func ecdheSignedParams(clientRandom, serverRandom, params []byte) []byte {
+	msg := make([]byte, 0, len(clientRandom)+len(serverRandom)+len(params))
+	msg = append(msg, clientRandom...)
+	msg = append(msg, serverRandom...)
+	msg = append(msg, params...)
+	return msg
+}
@@ -0,0 +1,20 @@
+package handshaking
+
+// ServerHelloDoneMessage 是 Server Hello Done 消息，定义于 GM/T 0024-2014 第 6.4.4.5 节。
+// 表示服务端 Hello 阶段的消息已经发送完毕，消息体为空。
+type ServerHelloDoneMessage struct{}
+
+func (m *ServerHelloDoneMessage) Type() HandshakeType {
+	return HandshakeTypeServerHelloDone
+}
+
+func (m *ServerHelloDoneMessage) Marshal() ([]byte, error) {
+	return nil, nil
+}
+
+func (m *ServerHelloDoneMessage) Unmarshal(body []byte) error {
+	if len(body) != 0 {
+		return ErrMalformedMessage
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package testcert 生成测试使用的 SM2 证书。
+package testcert
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/tjfoc/gmsm/sm2"
+	"github.com/tjfoc/gmsm/x509"
+)
+
+// KeyPair 是一张证书及其私钥。
+type KeyPair struct {
+	DER  []byte
+	Key  *sm2.PrivateKey
+	Leaf *x509.Certificate
+}
+
+// PEM 返回 PEM 编码的证书和 PKCS#8 私钥。
+func (kp KeyPair) PEM() (certPEM, keyPEM []byte) {
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.DER})
+	keyDER, err := x509.MarshalSm2UnecryptedPrivateKey(kp.Key)
+	if err != nil {
+		panic("testcert: " + err.Error())
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// PKI 是一个根 CA，以及由它签发的服务端和客户端的签名证书、加密证书。
+// 服务端证书的主机名是 server.example，客户端证书的主机名是 client.example。
+type PKI struct {
+	Root *x509.Certificate
+	Pool *x509.CertPool
+
+	ServerSign, ServerEnc KeyPair
+	ClientSign, ClientEnc KeyPair
+}
+
+var (
+	once   sync.Once
+	shared *PKI
+	err    error
+)
+
+// Get 返回进程内共享的 PKI，第一次调用时生成。
+func Get() (*PKI, error) {
+	once.Do(func() {
+		shared, err = New()
+	})
+	return shared, err
+}
+
+// New 生成一个新的 PKI。
+func New() (*PKI, error) {
+	rootKey, err := sm2.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               name("gmtls test root"),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.SM2WithSM3,
+	}
+	rootDER, err := x509.CreateCertificate(rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	issue := func(serial int64, cn string, usage x509.KeyUsage, extUsage x509.ExtKeyUsage) (KeyPair, error) {
+		key, err := sm2.GenerateKey(rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		template := &x509.Certificate{
+			SerialNumber:       big.NewInt(serial),
+			Subject:            name(cn),
+			DNSNames:           []string{cn},
+			NotBefore:          time.Now().Add(-time.Hour),
+			NotAfter:           time.Now().Add(24 * time.Hour),
+			KeyUsage:           usage,
+			ExtKeyUsage:        []x509.ExtKeyUsage{extUsage},
+			SignatureAlgorithm: x509.SM2WithSM3,
+		}
+		der, err := x509.CreateCertificate(template, root, &key.PublicKey, rootKey)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		leaf, err := x509.ParseCertificate(der)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		return KeyPair{DER: der, Key: key, Leaf: leaf}, nil
+	}
+
+	const signUsage = x509.KeyUsageDigitalSignature
+	const encUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyAgreement
+
+	pki := &PKI{Root: root, Pool: x509.NewCertPool()}
+	pki.Pool.AddCert(root)
+	if pki.ServerSign, err = issue(2, "server.example", signUsage, x509.ExtKeyUsageServerAuth); err != nil {
+		return nil, err
+	}
+	if pki.ServerEnc, err = issue(3, "server.example", encUsage, x509.ExtKeyUsageServerAuth); err != nil {
+		return nil, err
+	}
+	if pki.ClientSign, err = issue(4, "client.example", signUsage, x509.ExtKeyUsageClientAuth); err != nil {
+		return nil, err
+	}
+	if pki.ClientEnc, err = issue(5, "client.example", encUsage, x509.ExtKeyUsageClientAuth); err != nil {
+		return nil, err
+	}
+	return pki, nil
+}
+
+func name(cn string) pkix.Name {
+	return pkix.Name{CommonName: cn, Organization: []string{"gmtls"}}
+}
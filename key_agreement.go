@@ -0,0 +1,302 @@
+package gmtls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"github.com/tjfoc/gmsm/sm2"
+	x509 "github.com/tjfoc/gmsm/x509"
+	"golang.org/x/crypto/cryptobyte"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+var (
+	errClientKeyExchange = errors.New("tls: invalid ClientKeyExchange message")
+	errServerKeyExchange = errors.New("tls: invalid ServerKeyExchange message")
+)
+
+// keyAgreement 是密钥交换算法的实现，定义于 GM/T 0024-2014 第 6.4.4.3 节和第 6.4.4.8 节。
+//
+// 服务端依次调用 generateServerKeyExchange 和 processClientKeyExchange，
+// 客户端依次调用 processServerKeyExchange 和 generateClientKeyExchange。
+type keyAgreement interface {
+	// generateServerKeyExchange 生成 ServerKeyExchange 消息。
+	generateServerKeyExchange(config *Config, signCert, encCert *Certificate, clientHello *handshaking.ClientHelloMessage, hello *handshaking.ServerHelloMessage) (*handshaking.ServerKeyExchangeMessage, error)
+
+	// processClientKeyExchange 处理 ClientKeyExchange 消息，返回 pre_master_secret。
+	// peerEncCert 是客户端的加密证书，客户端没有发送证书时为 nil。
+	processClientKeyExchange(config *Config, encCert *Certificate, peerEncCert *x509.Certificate, clientHello *handshaking.ClientHelloMessage, ckx *handshaking.ClientKeyExchangeMessage) ([]byte, error)
+
+	// processServerKeyExchange 处理 ServerKeyExchange 消息，验证服务端的签名。
+	processServerKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, serverHello *handshaking.ServerHelloMessage, peerSignCert, peerEncCert *x509.Certificate, skx *handshaking.ServerKeyExchangeMessage) error
+
+	// generateClientKeyExchange 生成 ClientKeyExchange 消息，返回 pre_master_secret。
+	// encCert 是客户端的加密证书，客户端没有证书时为 nil。
+	generateClientKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, encCert *Certificate, peerEncCert *x509.Certificate) ([]byte, *handshaking.ClientKeyExchangeMessage, error)
+}
+
+// requiresClientCertificate 报告密钥交换算法是否要求客户端提供加密证书。
+func requiresClientCertificate(ka keyAgreement) bool {
+	_, ok := ka.(*ecdheKeyAgreement)
+	return ok
+}
+
+func eccKA() keyAgreement {
+	return new(eccKeyAgreement)
+}
+
+func ecdheKA() keyAgreement {
+	return new(ecdheKeyAgreement)
+}
+
+// eccKeyAgreement 实现了 ECC 密钥交换算法：客户端生成 pre_master_secret，使用服务端加密证书的公钥加密后发送给服务端。
+type eccKeyAgreement struct{}
+
+func (ka *eccKeyAgreement) generateServerKeyExchange(config *Config, signCert, encCert *Certificate, clientHello *handshaking.ClientHelloMessage, hello *handshaking.ServerHelloMessage) (*handshaking.ServerKeyExchangeMessage, error) {
+	signer, ok := signCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tls: certificate private key does not implement crypto.Signer")
+	}
+	sig, err := handshaking.ECCKeyExchangeSignature(clientHello.Random.Bytes(), hello.Random.Bytes(), encCert.Certificate[0], signer, signCert.sm2UserID(), config.rand())
+	if err != nil {
+		return nil, errors.New("tls: failed to sign ECC parameters: " + err.Error())
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+	key, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &handshaking.ServerKeyExchangeMessage{Key: key}, nil
+}
+
+func (ka *eccKeyAgreement) processClientKeyExchange(config *Config, encCert *Certificate, peerEncCert *x509.Certificate, clientHello *handshaking.ClientHelloMessage, ckx *handshaking.ClientKeyExchangeMessage) ([]byte, error) {
+	s := cryptobyte.String(ckx.Key)
+	var ciphertext cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&ciphertext) || !s.Empty() || ciphertext.Empty() {
+		return nil, errClientKeyExchange
+	}
+
+	// 解密失败或者版本号与 ClientHello 中的 client_version 不符时，使用随机的 pre_master_secret 继续握手，
+	// 握手会在校验 Finished 时失败。这样攻击者无法根据报警区分解密失败和版本号错误，见 RFC 5246 第 7.4.7.1 节。
+	preMasterSecret := make([]byte, handshaking.PreMasterSecretLength)
+	if _, err := io.ReadFull(config.rand(), preMasterSecret); err != nil {
+		return nil, err
+	}
+
+	var decrypted []byte
+	var err error
+	switch key := encCert.PrivateKey.(type) {
+	case *sm2.PrivateKey:
+		decrypted, err = sm2.DecryptAsn1(key, ciphertext)
+	case crypto.Decrypter:
+		decrypted, err = key.Decrypt(config.rand(), ciphertext, nil)
+	default:
+		return nil, errors.New("tls: certificate private key does not implement crypto.Decrypter")
+	}
+	if err != nil || len(decrypted) != handshaking.PreMasterSecretLength {
+		return preMasterSecret, nil
+	}
+	version := clientHello.ClientVersion
+	valid := subtle.ConstantTimeByteEq(decrypted[0], version.Major()) & subtle.ConstantTimeByteEq(decrypted[1], version.Minor())
+	subtle.ConstantTimeCopy(valid, preMasterSecret, decrypted)
+	return preMasterSecret, nil
+}
+
+func (ka *eccKeyAgreement) processServerKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, serverHello *handshaking.ServerHelloMessage, peerSignCert, peerEncCert *x509.Certificate, skx *handshaking.ServerKeyExchangeMessage) error {
+	s := cryptobyte.String(skx.Key)
+	var sig cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&sig) || !s.Empty() || sig.Empty() {
+		return errServerKeyExchange
+	}
+	if !handshaking.ECCKeyExchangeVerify(clientHello.Random.Bytes(), serverHello.Random.Bytes(), peerEncCert.Raw, peerSignCert.PublicKey, config.peerSM2UserID(), sig) {
+		return errors.New("tls: invalid signature by the server certificate")
+	}
+	return nil
+}
+
+func (ka *eccKeyAgreement) generateClientKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, encCert *Certificate, peerEncCert *x509.Certificate) ([]byte, *handshaking.ClientKeyExchangeMessage, error) {
+	pub, ok := sm2PublicKey(peerEncCert.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("tls: server encryption certificate does not contain a SM2 public key")
+	}
+	preMasterSecret, err := handshaking.ECCKeyExchangeGeneratePreMasterSecret(clientHello.ClientVersion, config.rand())
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := handshaking.ECCKeyExchangeEncryptPreMasterSecret(pub, preMasterSecret, config.rand())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(ciphertext)
+	})
+	key, err := b.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return preMasterSecret, &handshaking.ClientKeyExchangeMessage{Key: key}, nil
+}
+
+// ecdheKeyAgreement 实现了 ECDHE 密钥交换算法：双方使用各自的加密密钥对和临时密钥对进行 SM2 密钥协商，
+// 协商结果作为 pre_master_secret。客户端是 GM/T 0003.3 中的发起方 A，服务端是响应方 B。
+type ecdheKeyAgreement struct {
+	// agreement 是服务端进行中的密钥协商
+	agreement SM2Agreement
+	// peerTempPub 是客户端收到的服务端临时公钥
+	peerTempPub *sm2.PublicKey
+}
+
+func (ka *ecdheKeyAgreement) generateServerKeyExchange(config *Config, signCert, encCert *Certificate, clientHello *handshaking.ClientHelloMessage, hello *handshaking.ServerHelloMessage) (*handshaking.ServerKeyExchangeMessage, error) {
+	signer, ok := signCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("tls: certificate private key does not implement crypto.Signer")
+	}
+
+	var err error
+	ka.agreement, err = generateAgreementData(config, encCert, false)
+	if err != nil {
+		return nil, err
+	}
+
+	params := handshaking.MarshalECDHEParams(ka.agreement.TempPublicKey())
+	sig, err := handshaking.ECDHEKeyExchangeSignature(clientHello.Random.Bytes(), hello.Random.Bytes(), params, signer, signCert.sm2UserID(), config.rand())
+	if err != nil {
+		return nil, errors.New("tls: failed to sign ECDHE parameters: " + err.Error())
+	}
+
+	var b cryptobyte.Builder
+	b.AddBytes(params)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(sig)
+	})
+	key, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &handshaking.ServerKeyExchangeMessage{Key: key}, nil
+}
+
+func (ka *ecdheKeyAgreement) processClientKeyExchange(config *Config, encCert *Certificate, peerEncCert *x509.Certificate, clientHello *handshaking.ClientHelloMessage, ckx *handshaking.ClientKeyExchangeMessage) ([]byte, error) {
+	if ka.agreement == nil {
+		return nil, errors.New("tls: missing ServerKeyExchange message")
+	}
+	if peerEncCert == nil {
+		return nil, errors.New("tls: ECDHE key exchange requires a client encryption certificate")
+	}
+	peerPub, ok := sm2PublicKey(peerEncCert.PublicKey)
+	if !ok {
+		return nil, errors.New("tls: client encryption certificate does not contain a SM2 public key")
+	}
+
+	peerTempPub, _, rest, ok := handshaking.ParseECDHEParams(ckx.Key)
+	if !ok || len(rest) != 0 {
+		return nil, errClientKeyExchange
+	}
+	return ka.agreement.GenerateKey(config.peerSM2UserID(), peerPub, peerTempPub, handshaking.PreMasterSecretLength)
+}
+
+func (ka *ecdheKeyAgreement) processServerKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, serverHello *handshaking.ServerHelloMessage, peerSignCert, peerEncCert *x509.Certificate, skx *handshaking.ServerKeyExchangeMessage) error {
+	tempPub, params, rest, ok := handshaking.ParseECDHEParams(skx.Key)
+	if !ok {
+		return errServerKeyExchange
+	}
+	s := cryptobyte.String(rest)
+	var sig cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&sig) || !s.Empty() || sig.Empty() {
+		return errServerKeyExchange
+	}
+	if !handshaking.ECDHEKeyExchangeVerify(clientHello.Random.Bytes(), serverHello.Random.Bytes(), params, peerSignCert.PublicKey, config.peerSM2UserID(), sig) {
+		return errors.New("tls: invalid signature by the server certificate")
+	}
+	ka.peerTempPub = tempPub
+	return nil
+}
+
+func (ka *ecdheKeyAgreement) generateClientKeyExchange(config *Config, clientHello *handshaking.ClientHelloMessage, encCert *Certificate, peerEncCert *x509.Certificate) ([]byte, *handshaking.ClientKeyExchangeMessage, error) {
+	if ka.peerTempPub == nil {
+		return nil, nil, errors.New("tls: missing ServerKeyExchange message")
+	}
+	if encCert == nil {
+		return nil, nil, errors.New("tls: ECDHE key exchange requires a client encryption certificate")
+	}
+	peerPub, ok := sm2PublicKey(peerEncCert.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("tls: server encryption certificate does not contain a SM2 public key")
+	}
+
+	agreement, err := generateAgreementData(config, encCert, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	preMasterSecret, err := agreement.GenerateKey(config.peerSM2UserID(), peerPub, ka.peerTempPub, handshaking.PreMasterSecretLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	ckx := &handshaking.ClientKeyExchangeMessage{Key: handshaking.MarshalECDHEParams(agreement.TempPublicKey())}
+	return preMasterSecret, ckx, nil
+}
+
+// generateAgreementData 使用加密证书的私钥发起一次 SM2 密钥协商。
+func generateAgreementData(config *Config, encCert *Certificate, sponsor bool) (SM2Agreement, error) {
+	switch key := encCert.PrivateKey.(type) {
+	case *sm2.PrivateKey:
+		temp, err := sm2.GenerateKey(config.rand())
+		if err != nil {
+			return nil, err
+		}
+		return &sm2Agreement{key: key, temp: temp, sponsor: sponsor, id: encCert.sm2UserID()}, nil
+	case SM2KeyAgreement:
+		return key.GenerateAgreementData(sponsor, encCert.sm2UserID())
+	default:
+		return nil, errors.New("tls: certificate private key does not support SM2 key agreement")
+	}
+}
+
+// sm2Agreement 是使用 *sm2.PrivateKey 进行的 SM2 密钥协商。
+type sm2Agreement struct {
+	key     *sm2.PrivateKey
+	temp    *sm2.PrivateKey
+	sponsor bool
+	id      []byte
+}
+
+func (a *sm2Agreement) TempPublicKey() *sm2.PublicKey {
+	return &a.temp.PublicKey
+}
+
+func (a *sm2Agreement) GenerateKey(peerID []byte, peerPub, peerTempPub *sm2.PublicKey, length int) ([]byte, error) {
+	var k []byte
+	var err error
+	if a.sponsor {
+		k, _, _, err = sm2.KeyExchangeA(length, a.id, common.SM2UserID(peerID), a.key, peerPub, a.temp, peerTempPub)
+	} else {
+		k, _, _, err = sm2.KeyExchangeB(length, common.SM2UserID(peerID), a.id, a.key, peerPub, a.temp, peerTempPub)
+	}
+	return k, err
+}
+
+// sm2PublicKey 把证书中解析出的 SM2 曲线上的 *ecdsa.PublicKey 转换为 *sm2.PublicKey。
+func sm2PublicKey(pub crypto.PublicKey) (*sm2.PublicKey, bool) {
+	switch pub := pub.(type) {
+	case *sm2.PublicKey:
+		return pub, true
+	case *ecdsa.PublicKey:
+		if pub.Curve != sm2.P256Sm2() {
+			return nil, false
+		}
+		return &sm2.PublicKey{Curve: pub.Curve, X: pub.X, Y: pub.Y}, true
+	default:
+		return nil, false
+	}
+}
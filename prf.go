@@ -0,0 +1,136 @@
+package gmtls
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/tjfoc/gmsm/sm3"
+
+	"github.com/nnnewb/gmtls/internal/common"
+	"github.com/nnnewb/gmtls/internal/handshaking"
+)
+
+const (
+	masterSecretLength   = 48 // master_secret 的长度，定义于 GM/T 0024-2014 第 6.5 节
+	finishedVerifyLength = handshaking.FinishedVerifyDataLength
+)
+
+var (
+	masterSecretLabel   = []byte("master secret")
+	keyExpansionLabel   = []byte("key expansion")
+	clientFinishedLabel = []byte("client finished")
+	serverFinishedLabel = []byte("server finished")
+)
+
+// masterFromPreMasterSecret 根据 pre_master_secret 计算主密钥，定义于 GM/T 0024-2014 第 6.5.1 节。
+//
+//	master_secret = PRF(pre_master_secret, "master secret", ClientHello.random + ServerHello.random)[0..47]
+func masterFromPreMasterSecret(preMasterSecret, clientRandom, serverRandom []byte) []byte {
+	seed := make([]byte, 0, len(clientRandom)+len(serverRandom))
+	seed = append(seed, clientRandom...)
+	seed = append(seed, serverRandom...)
+
+	masterSecret := make([]byte, masterSecretLength)
+	common.PRF(masterSecret, preMasterSecret, masterSecretLabel, seed)
+	return masterSecret
+}
+
+// keysFromMasterSecret 根据主密钥计算工作密钥，定义于 GM/T 0024-2014 第 6.5.2 节。
+//
+//	key_block = PRF(master_secret, "key expansion", server_random + client_random)
+//
+// key_block 依次划分为 client_write_MAC_secret、server_write_MAC_secret、client_write_key、server_write_key、
+// client_write_IV、server_write_IV。
+func keysFromMasterSecret(masterSecret, clientRandom, serverRandom []byte, macLen, keyLen, ivLen int) (clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV []byte) {
+	seed := make([]byte, 0, len(serverRandom)+len(clientRandom))
+	seed = append(seed, serverRandom...)
+	seed = append(seed, clientRandom...)
+
+	n := 2*macLen + 2*keyLen + 2*ivLen
+	keyMaterial := make([]byte, n)
+	common.PRF(keyMaterial, masterSecret, keyExpansionLabel, seed)
+	clientMAC = keyMaterial[:macLen]
+	keyMaterial = keyMaterial[macLen:]
+	serverMAC = keyMaterial[:macLen]
+	keyMaterial = keyMaterial[macLen:]
+	clientKey = keyMaterial[:keyLen]
+	keyMaterial = keyMaterial[keyLen:]
+	serverKey = keyMaterial[:keyLen]
+	keyMaterial = keyMaterial[keyLen:]
+	clientIV = keyMaterial[:ivLen]
+	keyMaterial = keyMaterial[ivLen:]
+	serverIV = keyMaterial[:ivLen]
+	return
+}
+
+// ekmFromMasterSecret 返回基于主密钥的密钥导出函数，参见 RFC 5705。
+//
+//	PRF(master_secret, label, client_random + server_random [+ context_length + context])
+func ekmFromMasterSecret(masterSecret, clientRandom, serverRandom []byte) func(string, []byte, int) ([]byte, error) {
+	return func(label string, context []byte, length int) ([]byte, error) {
+		switch label {
+		case "client finished", "server finished", "master secret", "key expansion":
+			// 这些标签已被 GM/T 0024-2014 使用
+			return nil, fmt.Errorf("tls: reserved ExportKeyingMaterial label: %s", label)
+		}
+
+		seedLen := len(clientRandom) + len(serverRandom)
+		if context != nil {
+			seedLen += 2 + len(context)
+		}
+		seed := make([]byte, 0, seedLen)
+		seed = append(seed, clientRandom...)
+		seed = append(seed, serverRandom...)
+		if context != nil {
+			if len(context) >= 1<<16 {
+				return nil, errors.New("tls: ExportKeyingMaterial context too long")
+			}
+			seed = append(seed, byte(len(context)>>8), byte(len(context)))
+			seed = append(seed, context...)
+		}
+
+		keyMaterial := make([]byte, length)
+		common.PRF(keyMaterial, masterSecret, []byte(label), seed)
+		return keyMaterial, nil
+	}
+}
+
+// noEKMBecauseHandshakeNotComplete 是握手完成之前使用的密钥导出函数。
+func noEKMBecauseHandshakeNotComplete(string, []byte, int) ([]byte, error) {
+	return nil, errors.New("tls: ExportKeyingMaterial is unavailable before the handshake is complete")
+}
+
+// finishedHash 计算握手消息的 SM3 杂凑值，用于 Finished 和 CertificateVerify 消息。
+type finishedHash struct {
+	hash hash.Hash
+}
+
+func newFinishedHash() finishedHash {
+	return finishedHash{hash: sm3.New()}
+}
+
+func (h *finishedHash) Write(msg []byte) (n int, err error) {
+	return h.hash.Write(msg)
+}
+
+// Sum 返回目前为止所有握手消息的杂凑值。
+func (h *finishedHash) Sum() []byte {
+	return h.hash.Sum(nil)
+}
+
+// clientSum 返回客户端 Finished 消息的 verify_data，定义于 GM/T 0024-2014 第 6.4.4.9 节。
+//
+//	verify_data = PRF(master_secret, "client finished", SM3(handshake_messages))[0..11]
+func (h *finishedHash) clientSum(masterSecret []byte) []byte {
+	out := make([]byte, finishedVerifyLength)
+	common.PRF(out, masterSecret, clientFinishedLabel, h.Sum())
+	return out
+}
+
+// serverSum 返回服务端 Finished 消息的 verify_data。
+func (h *finishedHash) serverSum(masterSecret []byte) []byte {
+	out := make([]byte, finishedVerifyLength)
+	common.PRF(out, masterSecret, serverFinishedLabel, h.Sum())
+	return out
+}
@@ -0,0 +1,282 @@
+// Package gmtls 实现了 GM/T 0024-2014《SSL VPN 技术规范》和 GB/T 38636-2020《传输层密码协议（TLCP）》
+// 定义的安全传输协议。接口设计参考了 crypto/tls。
+package gmtls
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tjfoc/gmsm/sm2"
+	x509 "github.com/tjfoc/gmsm/x509"
+)
+
+// Server 使用 conn 作为底层传输，返回一个新的 TLCP 服务端连接。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+func Server(conn net.Conn, config *Config) *Conn {
+	c := &Conn{
+		conn:   conn,
+		config: config,
+	}
+	c.handshakeFn = c.serverHandshake
+	return c
+}
+
+// Client 使用 conn 作为底层传输，返回一个新的 TLCP 客户端连接。
+// 配置 config 不能为 nil：必须设置 ServerName 或 InsecureSkipVerify 之一。
+func Client(conn net.Conn, config *Config) *Conn {
+	c := &Conn{
+		conn:     conn,
+		config:   config,
+		isClient: true,
+	}
+	c.handshakeFn = c.clientHandshake
+	return c
+}
+
+// listener 实现了一个 net.Listener，返回的连接是 TLCP 服务端连接。
+type listener struct {
+	net.Listener
+	config *Config
+}
+
+// Accept 等待并返回下一个连接。返回的连接类型是 *Conn。
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(c, l.config), nil
+}
+
+// NewListener 创建一个 Listener，它接受 inner 的连接并把每个连接包装为 Server 连接。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+func NewListener(inner net.Listener, config *Config) net.Listener {
+	l := new(listener)
+	l.Listener = inner
+	l.config = config
+	return l
+}
+
+// Listen 使用 net.Listen 在指定的网络地址上监听 TLCP 连接。
+// 配置 config 不能为 nil，且必须包含签名证书和加密证书。
+func Listen(network, laddr string, config *Config) (net.Listener, error) {
+	if config == nil || len(config.Certificates) < 2 {
+		return nil, errors.New("tls: neither Certificates[0] nor Certificates[1] set in Config")
+	}
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, config), nil
+}
+
+// DialWithDialer 使用 dialer.Dial 连接到指定的网络地址，然后进行 TLCP 握手。
+// dialer 中的超时和截止时间同时作用于建立连接和握手。
+//
+// config 为 nil 时等价于零值配置。如果没有设置 ServerName，使用 addr 中的主机名。
+//
+// DialWithDialer 在内部使用 context.Background，如果需要指定 context，使用 [Dialer.DialContext]。
+func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
+	return dial(context.Background(), dialer, network, addr, config)
+}
+
+func dial(ctx context.Context, netDialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
+	// dialer 的超时和截止时间需要覆盖建立连接和握手的整个过程
+	if netDialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, netDialer.Timeout)
+		defer cancel()
+	}
+
+	if !netDialer.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, netDialer.Deadline)
+		defer cancel()
+	}
+
+	rawConn, err := netDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := Client(rawConn, withServerName(config, addr))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial 使用 net.Dial 连接到指定的网络地址，然后进行 TLCP 握手。
+// config 为 nil 时等价于零值配置。
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	return DialWithDialer(new(net.Dialer), network, addr, config)
+}
+
+// withServerName 返回用于连接 addr 的客户端配置。config 为 nil 时使用零值配置；
+// 没有设置 ServerName 时使用 addr 中的主机名，此时会复制一份配置以免修改调用方的配置。
+func withServerName(config *Config, addr string) *Config {
+	if config == nil {
+		config = defaultConfig()
+	}
+	if config.ServerName != "" {
+		return config
+	}
+
+	colonPos := strings.LastIndex(addr, ":")
+	if colonPos == -1 {
+		colonPos = len(addr)
+	}
+	c := config.Clone()
+	c.ServerName = addr[:colonPos]
+	return c
+}
+
+// Dialer 使用底层连接的 Dialer 和配置建立 TLCP 连接。
+type Dialer struct {
+	// NetDialer 是建立底层连接使用的 Dialer。为 nil 时使用零值 net.Dialer。
+	// 其中的超时和截止时间同时作用于建立连接和握手。
+	NetDialer *net.Dialer
+
+	// Config 是新连接使用的配置。为 nil 时等价于零值配置。
+	Config *Config
+}
+
+// Dial 连接到指定的网络地址并进行 TLCP 握手。返回的连接类型是 *Conn。
+//
+// Dial 在内部使用 context.Background，如果需要指定 context，使用 DialContext。
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) netDialer() *net.Dialer {
+	if d.NetDialer != nil {
+		return d.NetDialer
+	}
+	return new(net.Dialer)
+}
+
+// DialContext 连接到指定的网络地址并进行 TLCP 握手。返回的连接类型是 *Conn。
+//
+// ctx 必须不为 nil。连接建立之前 ctx 结束时返回错误；握手过程中 ctx 结束时握手被中断，
+// 参见 [Conn.HandshakeContext]。连接建立并完成握手之后，ctx 的结束不再影响连接。
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := dial(ctx, d.netDialer(), network, addr, d.Config)
+	if err != nil {
+		// 不要把类型为 *Conn 的 nil 放入接口
+		return nil, err
+	}
+	return c, nil
+}
+
+// defaultConfig 返回零值配置。
+func defaultConfig() *Config {
+	return &Config{}
+}
+
+// LoadX509KeyPair 从一对文件中读取并解析证书和私钥。文件必须是 PEM 编码。
+// 证书文件可以在叶证书之后包含中间证书，组成证书链。
+//
+// GM/T 0024-2014 使用双证书体系，签名证书和加密证书需要分别调用 LoadX509KeyPair 加载。
+func LoadX509KeyPair(certFile, keyFile string) (Certificate, error) {
+	certPEMBlock, err := os.ReadFile(certFile)
+	if err != nil {
+		return Certificate{}, err
+	}
+	keyPEMBlock, err := os.ReadFile(keyFile)
+	if err != nil {
+		return Certificate{}, err
+	}
+	return X509KeyPair(certPEMBlock, keyPEMBlock)
+}
+
+// X509KeyPair 从 PEM 编码的数据中解析证书和 SM2 私钥。成功时 Certificate.Leaf 为解析后的叶证书。
+func X509KeyPair(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
+	fail := func(err error) (Certificate, error) { return Certificate{}, err }
+
+	var cert Certificate
+	var skippedBlockTypes []string
+	for {
+		var certDERBlock *pem.Block
+		certDERBlock, certPEMBlock = pem.Decode(certPEMBlock)
+		if certDERBlock == nil {
+			break
+		}
+		if certDERBlock.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, certDERBlock.Bytes)
+		} else {
+			skippedBlockTypes = append(skippedBlockTypes, certDERBlock.Type)
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		if len(skippedBlockTypes) == 0 {
+			return fail(errors.New("tls: failed to find any PEM data in certificate input"))
+		}
+		if len(skippedBlockTypes) == 1 && strings.HasSuffix(skippedBlockTypes[0], "PRIVATE KEY") {
+			return fail(errors.New("tls: failed to find certificate PEM data in certificate input, but did find a private key; PEM inputs may have been switched"))
+		}
+		return fail(fmt.Errorf("tls: failed to find \"CERTIFICATE\" PEM block in certificate input after skipping PEM blocks of the following types: %v", skippedBlockTypes))
+	}
+
+	skippedBlockTypes = skippedBlockTypes[:0]
+	var keyDERBlock *pem.Block
+	for {
+		keyDERBlock, keyPEMBlock = pem.Decode(keyPEMBlock)
+		if keyDERBlock == nil {
+			if len(skippedBlockTypes) == 0 {
+				return fail(errors.New("tls: failed to find any PEM data in key input"))
+			}
+			if len(skippedBlockTypes) == 1 && skippedBlockTypes[0] == "CERTIFICATE" {
+				return fail(errors.New("tls: found a certificate rather than a key in the PEM for the private key"))
+			}
+			return fail(fmt.Errorf("tls: failed to find PEM block with type ending in \"PRIVATE KEY\" in key input after skipping PEM blocks of the following types: %v", skippedBlockTypes))
+		}
+		if keyDERBlock.Type == "PRIVATE KEY" || strings.HasSuffix(keyDERBlock.Type, " PRIVATE KEY") {
+			break
+		}
+		skippedBlockTypes = append(skippedBlockTypes, keyDERBlock.Type)
+	}
+
+	var err error
+	cert.PrivateKey, err = parsePrivateKey(keyDERBlock.Bytes)
+	if err != nil {
+		return fail(err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fail(err)
+	}
+
+	pub, ok := cert.Leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != sm2.P256Sm2() {
+		return fail(errors.New("tls: certificate does not contain a SM2 public key"))
+	}
+	priv, ok := cert.PrivateKey.(*sm2.PrivateKey)
+	if !ok {
+		return fail(errors.New("tls: private key type does not match public key type"))
+	}
+	if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		return fail(errors.New("tls: private key does not match public key"))
+	}
+	return cert, nil
+}
+
+// parsePrivateKey 解析 PKCS#8 或 SEC 1 编码的 SM2 私钥。
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8UnecryptedPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseSm2PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("tls: failed to parse private key")
+}